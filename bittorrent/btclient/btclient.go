@@ -0,0 +1,213 @@
+// Package btclient is the supported way to use the BitTorrent client from other programs. A Client
+// downloads and seeds any number of torrents, added from torrent files or magnet links, which share
+// a listen port, a connection budget and rate limits.
+package btclient
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/session"
+	"go-bt-learning.brk3.github.io/internal/storage"
+)
+
+// Storage chooses how torrent data is kept on disk
+type Storage string
+
+const (
+	StorageFile Storage = "file" // read and written through the file system
+	StorageMmap Storage = "mmap" // files are memory mapped, where the platform supports it
+)
+
+// Options configure a Client. The zero value is usable: it downloads into the current directory on
+// any free port, with no rate limits and without logging.
+type Options struct {
+	DataDir  string // where torrent data is written, the current directory if empty
+	Port     uint16 // port peers connect to us on, 0 to pick any free port
+	MaxConns int    // peer connections across all torrents, 0 for the default
+
+	// DownloadRate and UploadRate are limits in bytes per second across all torrents, 0 for
+	// unlimited. They can be changed later with SetRates.
+	DownloadRate int
+	UploadRate   int
+
+	Storage     Storage // StorageFile if empty
+	Preallocate bool    // reserve disk space for files up front rather than leaving them sparse
+
+	// IdleTimeout is how long a peer can stay silent, or keep us choked with nothing we want,
+	// before it's disconnected. 0 for the default.
+	IdleTimeout time.Duration
+
+	// LocalDiscovery finds peers on the local network. Private torrents are never announced or
+	// given local peers.
+	LocalDiscovery bool
+
+	// Seed keeps serving torrents to peers once they're complete. With SuperSeed set peers are
+	// offered one piece at a time, for when we're a torrent's only seeder.
+	Seed      bool
+	SuperSeed bool
+
+	// Logger gets the client's diagnostics, which are discarded if it's nil
+	Logger *log.Logger
+}
+
+// DefaultOptions are what the bittorrent command runs with: the standard port, local peer
+// discovery and logging to stdout
+func DefaultOptions() Options {
+	cfg := session.DefaultConfig
+	return Options{
+		DataDir:        cfg.DataDir,
+		Port:           cfg.Port,
+		MaxConns:       cfg.MaxConns,
+		IdleTimeout:    cfg.IdleTimeout,
+		LocalDiscovery: cfg.LocalDiscovery,
+		Logger:         log.New(os.Stdout, "", 0),
+	}
+}
+
+// Client runs torrents. It must be closed once it's no longer needed.
+type Client struct {
+	s *session.Session
+}
+
+// New starts a client listening for peers on opts.Port
+func New(opts Options) (*Client, error) {
+	switch opts.Storage {
+	case "", StorageFile, StorageMmap:
+	default:
+		return nil, fmt.Errorf("unknown storage %q", opts.Storage)
+	}
+	cfg := session.DefaultConfig
+	cfg.Port = opts.Port
+	if opts.DataDir != "" {
+		cfg.DataDir = opts.DataDir
+	}
+	if opts.MaxConns > 0 {
+		cfg.MaxConns = opts.MaxConns
+	}
+	if opts.IdleTimeout > 0 {
+		cfg.IdleTimeout = opts.IdleTimeout
+	}
+	cfg.DownloadRate = opts.DownloadRate
+	cfg.UploadRate = opts.UploadRate
+	cfg.Storage = storage.Options{Backend: storage.Backend(opts.Storage), Preallocate: opts.Preallocate}
+	cfg.LocalDiscovery = opts.LocalDiscovery
+	cfg.Seed = opts.Seed
+	cfg.SuperSeed = opts.SuperSeed
+	cfg.Logger = opts.Logger
+	s, err := session.New(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{s: s}, nil
+}
+
+// AddTorrent reads a torrent file and starts downloading it. Data already in the data directory is
+// checked first, so only missing pieces are fetched.
+func (c *Client) AddTorrent(r io.Reader) (*Torrent, error) {
+	st, err := c.s.Add(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.handle(st)
+}
+
+// AddTorrentFile is AddTorrent for the torrent file at path
+func (c *Client) AddTorrentFile(path string) (*Torrent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return c.AddTorrent(f)
+}
+
+// AddMagnet adds a torrent from a magnet link. Its metadata is fetched from the peers the link and
+// its trackers give us, during which it's in StateMetadata, then it's downloaded like any other.
+func (c *Client) AddMagnet(uri string) (*Torrent, error) {
+	st, err := c.s.AddMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+	return c.handle(st)
+}
+
+func (c *Client) handle(st session.Status) (*Torrent, error) {
+	infoHash, err := ParseInfoHash(st.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	return &Torrent{c: c, infoHash: infoHash}, nil
+}
+
+// Torrent returns a handle on a torrent that's already been added, or ErrNotFound
+func (c *Client) Torrent(infoHash InfoHash) (*Torrent, error) {
+	if _, err := c.s.Status([20]byte(infoHash)); err != nil {
+		return nil, err
+	}
+	return &Torrent{c: c, infoHash: infoHash}, nil
+}
+
+// Torrents returns the status of every torrent
+func (c *Client) Torrents() []Status {
+	list := c.s.List()
+	res := make([]Status, 0, len(list))
+	for _, st := range list {
+		res = append(res, newStatus(st))
+	}
+	return res
+}
+
+// Subscribe returns a channel of events from every torrent, and a function that stops them and
+// closes the channel. Events are dropped rather than holding the client up if the subscriber falls
+// too far behind, so anything that matters should be confirmed with Status.
+func (c *Client) Subscribe() (<-chan Event, func()) {
+	in, stop := c.s.Subscribe()
+	out := make(chan Event, session.EventBuffer)
+	go func() {
+		defer close(out)
+		for e := range in {
+			select {
+			case out <- Event{Type: EventType(e.Type), Status: newStatus(e.Status)}:
+			default:
+			}
+		}
+	}()
+	return out, stop
+}
+
+// Port returns the port we're accepting peers on
+func (c *Client) Port() uint16 {
+	return c.s.Port()
+}
+
+// SetRates changes the download and upload limits in bytes per second, 0 for unlimited
+func (c *Client) SetRates(download, upload int) {
+	c.s.SetRates(download, upload)
+}
+
+// APIHeader has to be set, to any value, on every request to the API that isn't a GET. It stops web
+// pages from controlling the client through the user's browser.
+const APIHeader = session.APIHeader
+
+// Handler returns a JSON API for controlling the client over HTTP, as served by the bittorrent
+// command. Requests must be addressed to a loopback host.
+func (c *Client) Handler() http.Handler {
+	return c.s.Handler()
+}
+
+// ServeAPI serves Handler on addr until ctx is cancelled. Anything that can reach the API can control
+// the client, so addr has to be a loopback address.
+func (c *Client) ServeAPI(ctx context.Context, addr string) error {
+	return c.s.ServeAPI(ctx, addr)
+}
+
+// Close stops every torrent, leaving their data on disk, and stops accepting peers
+func (c *Client) Close() error {
+	return c.s.Close()
+}
@@ -0,0 +1,160 @@
+package btclient_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/btclient"
+)
+
+// testTorrent returns a trackerless torrent file for data, along with its info hash
+func testTorrent(name string, data []byte, pieceLength int) ([]byte, btclient.InfoHash) {
+	pieces := []byte{}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[begin:end])
+		pieces = append(pieces, h[:]...)
+	}
+	info := fmt.Sprintf("d6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
+		len(data), len(name), name, pieceLength, len(pieces), pieces)
+	return []byte("d4:info" + info + "e"), sha1.Sum([]byte(info))
+}
+
+func newTestClient(t *testing.T, dir string, seed bool) *btclient.Client {
+	c, err := btclient.New(btclient.Options{DataDir: dir, Seed: seed})
+	if err != nil {
+		t.Fatalf("error creating client: %v", err)
+	}
+	return c
+}
+
+func TestMagnet(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 5000)
+	tf, infoHash := testTorrent("data", data, 16384)
+
+	seedDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(seedDir, "data"), data, 0644); err != nil {
+		t.Fatalf("error writing seeder's data: %v", err)
+	}
+	seeder := newTestClient(t, seedDir, true)
+	defer seeder.Close()
+	seeding, err := seeder.AddTorrent(bytes.NewReader(tf))
+	if err != nil {
+		t.Fatalf("unexpected error adding torrent: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if st, err := seeding.Wait(ctx); err != nil || st.State != btclient.StateSeeding {
+		t.Fatalf("expected the seeder to be seeding, got %+v, %v", st, err)
+	}
+
+	leechDir := t.TempDir()
+	leecher := newTestClient(t, leechDir, false)
+	defer leecher.Close()
+	events, unsubscribe := leecher.Subscribe()
+	defer unsubscribe()
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%s&x.pe=127.0.0.1:%d", infoHash, seeder.Port())
+	to, err := leecher.AddMagnet(uri)
+	if err != nil {
+		t.Fatalf("unexpected error adding magnet: %v", err)
+	}
+	if to.InfoHash() != infoHash {
+		t.Errorf("expected info hash %s, got %s", infoHash, to.InfoHash())
+	}
+	st, err := to.Wait(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	if st.State != btclient.StateComplete || st.Completed != st.Pieces || st.Name != "data" {
+		t.Errorf("unexpected status once complete %+v", st)
+	}
+	if len(st.Files) != 1 || st.Files[0].Length != len(data) || st.Files[0].Priority != btclient.PriorityNormal {
+		t.Errorf("unexpected files %+v", st.Files)
+	}
+	have, err := os.ReadFile(filepath.Join(leechDir, st.Files[0].Path))
+	if err != nil || !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match, %v", err)
+	}
+	seen := map[btclient.EventType]bool{}
+	for len(events) > 0 {
+		e := <-events
+		seen[e.Type] = true
+	}
+	if !seen[btclient.EventAdded] || !seen[btclient.EventMetadata] || !seen[btclient.EventState] {
+		t.Errorf("expected added, metadata and state events, got %v", seen)
+	}
+}
+
+func TestTorrentRemoved(t *testing.T) {
+	c := newTestClient(t, t.TempDir(), false)
+	defer c.Close()
+	tf, infoHash := testTorrent("data", make([]byte, 1000), 256)
+	to, err := c.AddTorrent(bytes.NewReader(tf))
+	if err != nil {
+		t.Fatalf("unexpected error adding torrent: %v", err)
+	}
+	if _, err := c.AddTorrent(bytes.NewReader(tf)); err == nil {
+		t.Errorf("expected an error adding the same torrent twice")
+	}
+	if got, err := c.Torrent(infoHash); err != nil || got.InfoHash() != infoHash {
+		t.Errorf("expected to find the torrent, got %v", err)
+	}
+	if err := to.SetFilePriority(0, btclient.PrioritySkip); err != nil {
+		t.Errorf("unexpected error skipping file: %v", err)
+	}
+	if err := to.Remove(); err != nil {
+		t.Fatalf("unexpected error removing torrent: %v", err)
+	}
+	if _, err := to.Status(); !errors.Is(err, btclient.ErrNotFound) {
+		t.Errorf("expected ErrNotFound for a removed torrent, got %v", err)
+	}
+	if _, err := to.Wait(context.Background()); !errors.Is(err, btclient.ErrNotFound) {
+		t.Errorf("expected ErrNotFound waiting on a removed torrent, got %v", err)
+	}
+	if _, err := c.Torrent(infoHash); !errors.Is(err, btclient.ErrNotFound) {
+		t.Errorf("expected ErrNotFound looking up a removed torrent, got %v", err)
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	if _, err := btclient.New(btclient.Options{Storage: "tape"}); err == nil {
+		t.Errorf("expected an error for an unknown storage backend")
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	st := btclient.Status{
+		InfoHash: btclient.InfoHash{0xab, 0xcd},
+		State:    btclient.StateDownloading,
+		Files:    []btclient.File{{Path: "a", Length: 1, Priority: btclient.PriorityHigh}},
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := `"info_hash":"abcd000000000000000000000000000000000000"`
+	if !bytes.Contains(b, []byte(want)) || !bytes.Contains(b, []byte(`"priority":"high"`)) {
+		t.Errorf("unexpected JSON %s", b)
+	}
+	have := btclient.Status{}
+	if err := json.Unmarshal(b, &have); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have.InfoHash != st.InfoHash || have.Files[0].Priority != btclient.PriorityHigh {
+		t.Errorf("expected %+v after a round trip, got %+v", st, have)
+	}
+	if _, err := btclient.ParseInfoHash("abcd"); err == nil {
+		t.Errorf("expected an error for a short info hash")
+	}
+}
@@ -0,0 +1,113 @@
+package btclient_test
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+
+	"go-bt-learning.brk3.github.io/btclient"
+)
+
+// Download a torrent file into a directory, giving up on ctrl-c
+func Example() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	opts := btclient.DefaultOptions()
+	opts.DataDir = "downloads"
+	c, err := btclient.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	t, err := c.AddTorrentFile("debian-11.5.0-amd64-netinst.iso.torrent")
+	if err != nil {
+		log.Fatal(err)
+	}
+	st, err := t.Wait(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("downloaded %s\n", st.Name)
+}
+
+// Torrents added from magnet links start in StateMetadata while the info dict is fetched from peers
+func ExampleClient_AddMagnet() {
+	c, err := btclient.New(btclient.Options{DataDir: "downloads", Port: 6881})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	t, err := c.AddMagnet("magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&tr=http%3A%2F%2Ftracker.example.com%2Fannounce")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := t.Wait(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Follow what every torrent in a client is doing
+func ExampleClient_Subscribe() {
+	c, err := btclient.New(btclient.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	go func() {
+		for e := range events {
+			switch e.Type {
+			case btclient.EventMetadata:
+				fmt.Printf("%s: metadata arrived, %d files\n", e.Status.InfoHash, len(e.Status.Files))
+			case btclient.EventState:
+				fmt.Printf("%s: %s %s\n", e.Status.InfoHash, e.Status.State, e.Status.Error)
+			}
+		}
+	}()
+	// add torrents...
+}
+
+// Only download the files that are wanted
+func ExampleTorrent_SetFilePriority() {
+	c, err := btclient.New(btclient.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+	t, err := c.AddTorrentFile("album.torrent")
+	if err != nil {
+		log.Fatal(err)
+	}
+	st, err := t.Status()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for i, f := range st.Files {
+		if f.Length > 100<<20 {
+			t.SetFilePriority(i, btclient.PrioritySkip)
+		}
+	}
+}
+
+// Send the client's diagnostics to stderr, with timestamps
+func ExampleOptions_logger() {
+	opts := btclient.DefaultOptions()
+	opts.Logger = log.New(os.Stderr, "bittorrent: ", log.LstdFlags)
+	c, err := btclient.New(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer c.Close()
+}
+
+func ExampleParseInfoHash() {
+	h, err := btclient.ParseInfoHash("C9E15763F722F23E98A29DECDFAE341B98D53056")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(h)
+	// Output: c9e15763f722f23e98a29decdfae341b98d53056
+}
@@ -0,0 +1,239 @@
+package btclient
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/session"
+	"go-bt-learning.brk3.github.io/internal/torrent"
+)
+
+var (
+	// ErrNotFound is returned for torrents that aren't in the client, or have been removed
+	ErrNotFound = session.ErrNotFound
+
+	// ErrNoMetadata is returned when changing a torrent added from a magnet link before its
+	// metadata has arrived
+	ErrNoMetadata = session.ErrNoMetadata
+)
+
+// InfoHash identifies a torrent. It's written as 40 hex digits.
+type InfoHash [20]byte
+
+// ParseInfoHash reads an info hash written as 40 hex digits
+func ParseInfoHash(s string) (InfoHash, error) {
+	infoHash := InfoHash{}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(infoHash) {
+		return infoHash, fmt.Errorf("invalid info hash %q", s)
+	}
+	copy(infoHash[:], b)
+	return infoHash, nil
+}
+
+func (h InfoHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+func (h InfoHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *InfoHash) UnmarshalText(b []byte) error {
+	parsed, err := ParseInfoHash(string(b))
+	if err != nil {
+		return err
+	}
+	*h = parsed
+	return nil
+}
+
+// State is what a torrent is currently doing
+type State string
+
+const (
+	StateMetadata    State = "metadata" // fetching a magnet link's metadata from peers
+	StateChecking    State = "checking" // hashing data already on disk
+	StateDownloading State = "downloading"
+	StatePaused      State = "paused"
+	StateSeeding     State = "seeding"  // complete and serving peers, with Options.Seed
+	StateComplete    State = "complete" // every wanted piece is downloaded
+	StateError       State = "error"    // stopped, with the reason in Status.Error
+)
+
+// Priority decides whether and how soon a file is downloaded
+type Priority int
+
+const (
+	PrioritySkip   = Priority(torrent.PrioritySkip)
+	PriorityNormal = Priority(torrent.PriorityNormal)
+	PriorityHigh   = Priority(torrent.PriorityHigh)
+)
+
+func (p Priority) String() string {
+	return torrent.Priority(p).String()
+}
+
+// ParsePriority is the inverse of Priority.String
+func ParsePriority(s string) (Priority, error) {
+	p, err := torrent.ParsePriority(s)
+	return Priority(p), err
+}
+
+func (p Priority) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Priority) UnmarshalText(b []byte) error {
+	parsed, err := ParsePriority(string(b))
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// Status is a snapshot of a torrent. Until a magnet link's metadata arrives only the info hash,
+// name, state and error are known.
+type Status struct {
+	InfoHash  InfoHash `json:"info_hash"`
+	Name      string   `json:"name"`
+	State     State    `json:"state"`
+	Pieces    int      `json:"pieces"`
+	Completed int      `json:"completed"`
+	Peers     int      `json:"peers"`
+	Private   bool     `json:"private"`
+	Uploaded  int64    `json:"uploaded"`
+	SeedRatio float64  `json:"seed_ratio"` // bytes uploaded for each distinct byte uploaded
+	Error     string   `json:"error,omitempty"`
+	Files     []File   `json:"files"`
+}
+
+// Done reports whether the torrent has everything it wants
+func (st Status) Done() bool {
+	return st.State == StateComplete || st.State == StateSeeding
+}
+
+// File is the status of one of a torrent's files
+type File struct {
+	Path     string   `json:"path"` // relative to the data directory
+	Length   int      `json:"length"`
+	Priority Priority `json:"priority"`
+}
+
+func newStatus(st session.Status) Status {
+	res := Status{
+		Name:      st.Name,
+		State:     State(st.State),
+		Pieces:    st.Pieces,
+		Completed: st.Completed,
+		Peers:     st.Peers,
+		Private:   st.Private,
+		Uploaded:  st.Uploaded,
+		SeedRatio: st.SeedRatio,
+		Error:     st.Error,
+	}
+	res.InfoHash, _ = ParseInfoHash(st.InfoHash)
+	for _, f := range st.Files {
+		p, _ := ParsePriority(f.Priority)
+		res.Files = append(res.Files, File{Path: f.Path, Length: f.Length, Priority: p})
+	}
+	return res
+}
+
+// EventType says what happened to a torrent
+type EventType string
+
+const (
+	EventAdded    EventType = "added"
+	EventState    EventType = "state"    // the torrent's state changed, to StateError if it failed
+	EventMetadata EventType = "metadata" // a magnet link's metadata arrived
+	EventRemoved  EventType = "removed"
+)
+
+// Event is something that happened to a torrent, with its status just after
+type Event struct {
+	Type   EventType `json:"type"`
+	Status Status    `json:"status"`
+}
+
+// Torrent is a handle on a torrent in a Client. Once the torrent is removed its methods return
+// ErrNotFound.
+type Torrent struct {
+	c        *Client
+	infoHash InfoHash
+}
+
+func (t *Torrent) InfoHash() InfoHash {
+	return t.infoHash
+}
+
+func (t *Torrent) Status() (Status, error) {
+	st, err := t.c.s.Status([20]byte(t.infoHash))
+	if err != nil {
+		return Status{}, err
+	}
+	return newStatus(st), nil
+}
+
+// Pause stops downloading or seeding, keeping the pieces we have
+func (t *Torrent) Pause() error {
+	return t.c.s.Pause([20]byte(t.infoHash))
+}
+
+// Resume restarts a paused or failed torrent
+func (t *Torrent) Resume() error {
+	return t.c.s.Resume([20]byte(t.infoHash))
+}
+
+// Recheck hashes the torrent's data on disk again, then carries on where the check leaves it
+func (t *Torrent) Recheck() error {
+	return t.c.s.Recheck([20]byte(t.infoHash))
+}
+
+// Remove stops the torrent and drops it from the client, leaving its data on disk
+func (t *Torrent) Remove() error {
+	return t.c.s.Remove([20]byte(t.infoHash))
+}
+
+// SetFilePriority changes the priority of one of the torrent's files, indexed as in Status.Files
+func (t *Torrent) SetFilePriority(file int, p Priority) error {
+	return t.c.s.SetFilePriority([20]byte(t.infoHash), file, torrent.Priority(p))
+}
+
+// waitPoll is how often Wait checks the torrent's status in case it missed an event
+const waitPoll = time.Second
+
+// Wait blocks until the torrent has everything it wants, returning its status. It returns an error
+// if the torrent fails, is removed or ctx is cancelled first. A paused torrent is waited on until
+// it's resumed.
+func (t *Torrent) Wait(ctx context.Context) (Status, error) {
+	events, stop := t.c.Subscribe()
+	defer stop()
+	ticker := time.NewTicker(waitPoll)
+	defer ticker.Stop()
+	for {
+		st, err := t.Status()
+		if err != nil {
+			return Status{}, err
+		}
+		if st.Done() {
+			return st, nil
+		}
+		if st.State == StateError {
+			return st, errors.New(st.Error)
+		}
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return st, errors.New("client closed")
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return st, ctx.Err()
+		}
+	}
+}
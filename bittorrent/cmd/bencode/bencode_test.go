@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	v := map[string]any{
+		"text":    "hello",
+		"binary":  "\xff\x00\x01",
+		"prefix":  "hex:not really hex",
+		"\xfekey": []any{1, -2, "base64:x", map[string]any{}},
+	}
+	for _, useBase64 := range []bool{false, true} {
+		j, err := toJSON(v, useBase64)
+		if err != nil {
+			t.Fatalf("unexpected error converting to JSON: %v", err)
+		}
+		b, err := json.Marshal(j)
+		if err != nil {
+			t.Fatalf("unexpected error marshalling JSON: %v", err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		var back any
+		if err := dec.Decode(&back); err != nil {
+			t.Fatalf("unexpected error unmarshalling JSON: %v", err)
+		}
+		have, err := fromJSON(back)
+		if err != nil {
+			t.Fatalf("unexpected error converting from JSON: %v", err)
+		}
+		if !reflect.DeepEqual(have, any(v)) {
+			t.Errorf("base64 %v: expected %#v after a round trip through %s, got %#v", useBase64, v, b, have)
+		}
+	}
+}
+
+func TestFromJSONErrors(t *testing.T) {
+	for _, in := range []string{`1.5`, `null`, `true`, `["hex:zz"]`, `{"a": [false]}`} {
+		dec := json.NewDecoder(strings.NewReader(in))
+		dec.UseNumber()
+		var j any
+		if err := dec.Decode(&j); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fromJSON(j); err == nil {
+			t.Errorf("%s: expected an error", in)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	in := "d8:announce3:url4:infod5:filesld6:lengthi1e4:pathl1:a1:beed6:lengthi2e4:pathl1:ceee4:name1:xee"
+	tests := []struct {
+		path string
+		want any
+	}{
+		{"announce", "url"},
+		{"info.name", "x"},
+		{"info.files[1].length", 2},
+		{"info.files[0].path[1]", "b"},
+		{"info.files[1].path", []any{"c"}},
+	}
+	for _, tt := range tests {
+		have, err := lookup(bencodecustom.NewDecoder(strings.NewReader(in)), tt.path)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(have, tt.want) {
+			t.Errorf("%s: expected %#v, got %#v", tt.path, tt.want, have)
+		}
+	}
+	for _, path := range []string{"missing", "info.files[2]", "announce.x", "info[0]", "info..name", "info.files[x]", "info.files[0"} {
+		if _, err := lookup(bencodecustom.NewDecoder(strings.NewReader(in)), path); err == nil {
+			t.Errorf("%s: expected an error", path)
+		}
+	}
+}
+
+func TestPrint(t *testing.T) {
+	buf := bytes.Buffer{}
+	p := printer{w: &buf, maxBinary: 2}
+	p.print(map[string]any{"b": []any{1, "\xff\xfe\xfd"}, "a": "x", "c": []any{}}, 0)
+	want := `{
+  "a": "x"
+  "b": [
+    1
+    <3 bytes fffe...>
+  ]
+  "c": []
+}`
+	if buf.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, buf.String())
+	}
+}
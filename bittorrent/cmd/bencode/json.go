@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Strings that aren't valid UTF-8 can't go into JSON as they are, so they're written with one of
+// these prefixes and the rest encoded. Text strings that happen to start with a prefix are encoded
+// too, so that every JSON string converts back to exactly the bytes it came from.
+const (
+	hexPrefix    = "hex:"
+	base64Prefix = "base64:"
+)
+
+// toJSON converts a bencoded value into one encoding/json writes out, with binary strings
+// encoded as hex or base64
+func toJSON(v any, useBase64 bool) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return jsonString(v, useBase64), nil
+	case int:
+		return v, nil
+	case []any:
+		res := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if res[i], err = toJSON(item, useBase64); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for k, item := range v {
+			val, err := toJSON(item, useBase64)
+			if err != nil {
+				return nil, err
+			}
+			res[jsonString(k, useBase64)] = val
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("can't convert a %T to JSON", v)
+}
+
+func jsonString(s string, useBase64 bool) string {
+	if utf8.ValidString(s) && !strings.HasPrefix(s, hexPrefix) && !strings.HasPrefix(s, base64Prefix) {
+		return s
+	}
+	if useBase64 {
+		return base64Prefix + base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return hexPrefix + hex.EncodeToString([]byte(s))
+}
+
+// fromJSON is the inverse of toJSON, for values decoded by encoding/json with UseNumber
+func fromJSON(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return bencodeString(v)
+	case json.Number:
+		i, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("bencode only has integers, can't convert %s", v)
+		}
+		return int(i), nil
+	case []any:
+		res := make([]any, len(v))
+		for i, item := range v {
+			var err error
+			if res[i], err = fromJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case map[string]any:
+		res := make(map[string]any, len(v))
+		for k, item := range v {
+			key, err := bencodeString(k)
+			if err != nil {
+				return nil, err
+			}
+			if res[key], err = fromJSON(item); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case nil:
+		return nil, errors.New("bencode has no null")
+	}
+	return nil, fmt.Errorf("bencode has no %T", v)
+}
+
+func bencodeString(s string) (string, error) {
+	var b []byte
+	var err error
+	switch {
+	case strings.HasPrefix(s, hexPrefix):
+		b, err = hex.DecodeString(s[len(hexPrefix):])
+	case strings.HasPrefix(s, base64Prefix):
+		b, err = base64.StdEncoding.DecodeString(s[len(base64Prefix):])
+	default:
+		return s, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("error decoding %.20q: %w", s, err)
+	}
+	return string(b), nil
+}
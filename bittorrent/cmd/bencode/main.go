@@ -0,0 +1,156 @@
+// Command bencode inspects bencoded data such as torrent files and tracker responses. It
+// pretty-prints it, converts it to JSON and back, and pulls out values by path.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "print":
+			printCmd(os.Args[2:])
+			return
+		case "json":
+			toJSONCmd(os.Args[2:])
+			return
+		case "fromjson":
+			fromJSONCmd(os.Args[2:])
+			return
+		}
+	}
+	printCmd(os.Args[1:])
+}
+
+// readFlags are shared by the commands that read bencode
+type readFlags struct {
+	path   *string
+	strict *bool
+}
+
+func addReadFlags(fs *flag.FlagSet) readFlags {
+	return readFlags{
+		path:   fs.String("path", "", "only output the value at a path like info.files[0].path"),
+		strict: fs.Bool("strict", false, "reject dictionaries whose keys aren't sorted"),
+	}
+}
+
+// read decodes the value at the path flag, or everything, from the file named by the one argument
+// or from stdin
+func (rf readFlags) read(fs *flag.FlagSet) any {
+	in := openInput(fs)
+	defer in.Close()
+	d := bencodecustom.NewDecoderWithOptions(in, bencodecustom.Options{StrictKeys: *rf.strict})
+	var v any
+	var err error
+	if *rf.path != "" {
+		v, err = lookup(d, *rf.path)
+	} else {
+		err = d.Decode(&v)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading bencode: %v\n", err)
+		os.Exit(1)
+	}
+	return v
+}
+
+func openInput(fs *flag.FlagSet) io.ReadCloser {
+	if fs.NArg() > 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if fs.NArg() == 0 || fs.Arg(0) == "-" {
+		return io.NopCloser(os.Stdin)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error opening input: %v\n", err)
+		os.Exit(1)
+	}
+	return f
+}
+
+// printCmd pretty-prints bencoded data
+func printCmd(args []string) {
+	fs := flag.NewFlagSet("print", flag.ExitOnError)
+	rf := addReadFlags(fs)
+	full := fs.Bool("full", false, "show binary strings in full rather than their first 32 bytes")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bencode [print] [flags] [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	v := rf.read(fs)
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	p := printer{w: w, maxBinary: 32}
+	if *full {
+		p.maxBinary = 0
+	}
+	p.print(v, 0)
+	fmt.Fprintln(w)
+}
+
+// toJSONCmd converts bencoded data to JSON
+func toJSONCmd(args []string) {
+	fs := flag.NewFlagSet("json", flag.ExitOnError)
+	rf := addReadFlags(fs)
+	useBase64 := fs.Bool("base64", false, "encode binary strings as base64 rather than hex")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bencode json [flags] [file]\n\n")
+		fmt.Fprintf(fs.Output(), "Strings that aren't UTF-8 are written as \"hex:...\" or \"base64:...\", which fromjson turns back into the original bytes.\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	v, err := toJSON(rf.read(fs), *useBase64)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error converting to JSON: %v\n", err)
+		os.Exit(1)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing JSON: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// fromJSONCmd converts JSON written by the json command back to bencode
+func fromJSONCmd(args []string) {
+	fs := flag.NewFlagSet("fromjson", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bencode fromjson [file]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	in := openInput(fs)
+	defer in.Close()
+	dec := json.NewDecoder(in)
+	dec.UseNumber()
+	var j any
+	if err := dec.Decode(&j); err != nil {
+		fmt.Fprintf(os.Stderr, "error reading JSON: %v\n", err)
+		os.Exit(1)
+	}
+	v, err := fromJSON(j)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error converting from JSON: %v\n", err)
+		os.Exit(1)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	if err := bencodecustom.NewEncoder(w).Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing bencode: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+)
+
+// a path step is either a dictionary key or, if key is empty, a list index
+type step struct {
+	key   string
+	index int
+}
+
+// parsePath splits a path like info.files[0].path into its steps
+func parsePath(path string) ([]step, error) {
+	steps := []step{}
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		if i := strings.IndexByte(part, '['); i != -1 {
+			key, part = part[:i], part[i:]
+		} else {
+			part = ""
+		}
+		if key != "" {
+			steps = append(steps, step{key: key})
+		} else if part == "" {
+			return nil, fmt.Errorf("empty key in path %q", path)
+		}
+		for part != "" {
+			end := strings.IndexByte(part, ']')
+			if part[0] != '[' || end == -1 {
+				return nil, fmt.Errorf("malformed index in path %q", path)
+			}
+			n, err := strconv.Atoi(part[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad index %q in path %q", part[1:end], path)
+			}
+			steps = append(steps, step{index: n})
+			part = part[end+1:]
+		}
+	}
+	return steps, nil
+}
+
+// lookup decodes the value at path, skipping over everything else rather than decoding it
+func lookup(d *bencodecustom.Decoder, path string) (any, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+	at := "top level"
+	for _, s := range steps {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if s.key != "" {
+			if tok != bencodecustom.Delim('d') {
+				return nil, fmt.Errorf("%s isn't a dict", at)
+			}
+			if err := findKey(d, s.key); err != nil {
+				return nil, fmt.Errorf("%s: %w", at, err)
+			}
+			at = s.key
+			continue
+		}
+		if tok != bencodecustom.Delim('l') {
+			return nil, fmt.Errorf("%s isn't a list", at)
+		}
+		for i := 0; i < s.index; i++ {
+			if !d.More() {
+				return nil, fmt.Errorf("%s has only %d items", at, i)
+			}
+			if err := d.Skip(); err != nil {
+				return nil, err
+			}
+		}
+		if !d.More() {
+			return nil, fmt.Errorf("%s has only %d items", at, s.index)
+		}
+		at = fmt.Sprintf("%s[%d]", at, s.index)
+	}
+	var v any
+	err = d.Decode(&v)
+	return v, err
+}
+
+// findKey reads through a dictionary until the value for key is next
+func findKey(d *bencodecustom.Decoder, key string) error {
+	for d.More() {
+		var k string
+		if err := d.Decode(&k); err != nil {
+			return err
+		}
+		if k == key {
+			return nil
+		}
+		if err := d.Skip(); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("no key %q", key)
+}
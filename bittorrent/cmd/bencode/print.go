@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// printer writes bencoded values out for people to read. Dictionaries and lists are indented a
+// level per nesting, and binary strings shown as hex.
+type printer struct {
+	w io.Writer
+	// maxBinary is how many bytes of a binary string to show, 0 for all of them
+	maxBinary int
+}
+
+func (p printer) print(v any, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case string:
+		fmt.Fprint(p.w, p.str(v))
+	case int:
+		fmt.Fprint(p.w, v)
+	case []any:
+		if len(v) == 0 {
+			fmt.Fprint(p.w, "[]")
+			return
+		}
+		fmt.Fprintln(p.w, "[")
+		for _, item := range v {
+			fmt.Fprint(p.w, pad+"  ")
+			p.print(item, indent+1)
+			fmt.Fprintln(p.w)
+		}
+		fmt.Fprint(p.w, pad+"]")
+	case map[string]any:
+		if len(v) == 0 {
+			fmt.Fprint(p.w, "{}")
+			return
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintln(p.w, "{")
+		for _, k := range keys {
+			fmt.Fprintf(p.w, "%s  %s: ", pad, p.str(k))
+			p.print(v[k], indent+1)
+			fmt.Fprintln(p.w)
+		}
+		fmt.Fprint(p.w, pad+"}")
+	default:
+		fmt.Fprintf(p.w, "<%T>", v)
+	}
+}
+
+// str quotes text, and shows binary as its length and hex
+func (p printer) str(s string) string {
+	if utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	if p.maxBinary == 0 || len(s) <= p.maxBinary {
+		return fmt.Sprintf("<%d bytes %s>", len(s), hex.EncodeToString([]byte(s)))
+	}
+	return fmt.Sprintf("<%d bytes %s...>", len(s), hex.EncodeToString([]byte(s[:p.maxBinary])))
+}
@@ -1,16 +1,121 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 
-	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/btclient"
 	"go-bt-learning.brk3.github.io/internal/torrent"
 	"go-bt-learning.brk3.github.io/internal/torrentfile"
+	"go-bt-learning.brk3.github.io/internal/tracker"
 )
 
 func main() {
-	f, err := os.Open("debian-11.5.0-amd64-netinst.iso.torrent")
+	// cancelling on ctrl-c lets downloads close their connections, flush what they have to disk and
+	// tell the tracker we've gone
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "serve":
+			serve(ctx, os.Args[2:])
+			return
+		case "info":
+			info(ctx, os.Args[2:])
+			return
+		case "tracker":
+			runTracker(ctx, os.Args[2:])
+			return
+		}
+	}
+	download(ctx, os.Args[1:])
+}
+
+// serve runs a client for many torrents, controlled over a local HTTP API
+func serve(ctx context.Context, args []string) {
+	opts := btclient.DefaultOptions()
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	port := fs.Uint("port", uint(opts.Port), "port to accept peers on")
+	api := fs.String("api", "127.0.0.1:6880", "loopback address to serve the control API on")
+	fs.StringVar(&opts.DataDir, "dir", opts.DataDir, "directory to download into")
+	fs.IntVar(&opts.MaxConns, "max-conns", opts.MaxConns, "maximum peer connections across all torrents")
+	fs.IntVar(&opts.DownloadRate, "down", 0, "download limit in bytes per second, 0 for unlimited")
+	fs.IntVar(&opts.UploadRate, "up", 0, "upload limit in bytes per second, 0 for unlimited")
+	backend := fs.String("storage", string(btclient.StorageFile), "how torrent data is stored, file or mmap")
+	fs.BoolVar(&opts.Preallocate, "preallocate", opts.Preallocate, "reserve disk space for files up front rather than leaving them sparse")
+	fs.DurationVar(&opts.IdleTimeout, "idle-timeout", opts.IdleTimeout, "disconnect peers that are silent or of no use for this long")
+	fs.BoolVar(&opts.LocalDiscovery, "lsd", opts.LocalDiscovery, "find peers on the local network")
+	fs.BoolVar(&opts.Seed, "seed", opts.Seed, "keep seeding torrents once they're complete")
+	fs.BoolVar(&opts.SuperSeed, "superseed", opts.SuperSeed, "offer peers one piece at a time when seeding, for initial seeders")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bittorrent serve [flags] [torrent files or magnet links...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	opts.Port = uint16(*port)
+	opts.Storage = btclient.Storage(*backend)
+	c, err := btclient.New(opts)
+	if err != nil {
+		fmt.Printf("error starting client: %v\n", err)
+		os.Exit(1)
+	}
+	defer c.Close()
+	for _, arg := range fs.Args() {
+		if _, err := add(c, arg); err != nil {
+			fmt.Printf("error adding %s: %v\n", arg, err)
+		}
+	}
+	fmt.Printf("accepting peers on port %d, control API on %s\n", c.Port(), *api)
+	if err := c.ServeAPI(ctx, *api); err != nil {
+		fmt.Printf("error serving control API: %v\n", err)
+	}
+}
+
+// add adds a torrent file or magnet link to the client
+func add(c *btclient.Client, arg string) (*btclient.Torrent, error) {
+	if strings.HasPrefix(arg, "magnet:") {
+		return c.AddMagnet(arg)
+	}
+	return c.AddTorrentFile(arg)
+}
+
+// runTracker serves a tracker for running swarms without public infrastructure
+func runTracker(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	addr := fs.String("addr", ":6969", "address to serve announce and scrape on")
+	interval := fs.Duration("interval", tracker.DefaultInterval, "how often peers should announce")
+	fs.Parse(args)
+	srv := &http.Server{Addr: *addr, Handler: tracker.NewServer(*interval).Handler()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	fmt.Printf("tracker listening on %s\n", *addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		fmt.Printf("error serving tracker: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// info describes a torrent file, and optionally asks its tracker about the swarm
+func info(ctx context.Context, args []string) {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	scrape := fs.Bool("scrape", false, "ask the tracker how many seeders and leechers there are")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bittorrent info [flags] torrent-file\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(fs.Arg(0))
 	if err != nil {
 		fmt.Printf("error opening torrent file: %v\n", err)
 		os.Exit(1)
@@ -21,22 +126,67 @@ func main() {
 		fmt.Printf("error loading torrent file: %v\n", err)
 		os.Exit(1)
 	}
-	t := torrent.NewTorrent(tf)
-	err = t.Announce(client.PeerID, 6881)
+	fmt.Printf("name:      %s\n", tf.Name)
+	fmt.Printf("info hash: %x\n", tf.InfoHash)
+	if tf.MetaVersion == 2 {
+		fmt.Printf("v2 hash:   %x\n", tf.InfoHashV2)
+	}
+	fmt.Printf("tracker:   %s\n", tf.Announce)
+	fmt.Printf("length:    %d\n", tf.Length)
+	fmt.Printf("pieces:    %d of %d bytes\n", tf.NumPieces(), tf.PieceLength)
+	fmt.Printf("private:   %v\n", tf.Private)
+	for _, u := range tf.URLList {
+		fmt.Printf("web seed:  %s\n", u)
+	}
+	for _, file := range tf.Files {
+		if file.Padding {
+			continue
+		}
+		fmt.Printf("file:      %s (%d bytes)\n", file.Path, file.Length)
+	}
+	if !*scrape {
+		return
+	}
+	res, err := torrent.NewTorrent(tf).Scrape(ctx)
 	if err != nil {
-		fmt.Printf("error announcing ourselves to tracker: %v\n", err)
+		fmt.Printf("error scraping tracker: %v\n", err)
 		os.Exit(1)
 	}
-	fmt.Printf("received %d peers from tracker\n", len(t.Peers))
-	data := t.Download()
-	f, err = os.Create(t.File.Name)
+	fmt.Printf("seeders:   %d\n", res.Seeders)
+	fmt.Printf("leechers:  %d\n", res.Leechers)
+	fmt.Printf("completed: %d\n", res.Completed)
+}
+
+// download fetches a torrent file or magnet link into the current directory, the debian netinst
+// image by default
+func download(ctx context.Context, args []string) {
+	arg := "debian-11.5.0-amd64-netinst.iso.torrent"
+	if len(args) > 0 {
+		arg = args[0]
+	}
+	c, err := btclient.New(btclient.DefaultOptions())
 	if err != nil {
-		fmt.Printf("error opening output file: %v\n", err)
+		fmt.Printf("error starting client: %v\n", err)
 		os.Exit(1)
 	}
-	_, err = f.Write(data)
+	defer c.Close()
+	events, unsubscribe := c.Subscribe()
+	defer unsubscribe()
+	go func() {
+		for e := range events {
+			if e.Type == btclient.EventState {
+				fmt.Printf("%s: %s\n", e.Status.Name, e.Status.State)
+			}
+		}
+	}()
+	t, err := add(c, arg)
 	if err != nil {
-		fmt.Printf("error writing output file: %v\n", err)
+		fmt.Printf("error adding %s: %v\n", arg, err)
+		os.Exit(1)
+	}
+	if _, err := t.Wait(ctx); err != nil {
+		fmt.Printf("error downloading torrent: %v\n", err)
+		c.Close()
 		os.Exit(1)
 	}
 }
@@ -2,115 +2,348 @@ package bencodecustom
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
 )
 
+// Defaults for the limits in Options. They're generous enough for any real torrent file, where the
+// largest string is the piece hashes, while stopping hostile input from using unbounded memory or
+// stack.
+const (
+	DefaultMaxStringLen = 64 << 20
+	DefaultMaxDepth     = 64
+	DefaultMaxSize      = 128 << 20
+)
+
+// stringChunk is the most that's allocated for a string before its data has been read
+const stringChunk = 1 << 16
+
+var (
+	// ErrLimit is returned when input exceeds one of the limits in Options
+	ErrLimit = errors.New("bencode limit exceeded")
+	// ErrNonCanonical is returned for input that's valid but not in the one form the spec allows,
+	// such as an integer with leading zeros or, with Options.StrictKeys, unsorted dictionary keys
+	ErrNonCanonical = errors.New("non-canonical bencode")
+)
+
+// Options control how strictly input is parsed. The zero value uses the default limits.
+type Options struct {
+	MaxStringLen int   // longest string allowed
+	MaxDepth     int   // deepest nesting of lists and dictionaries allowed
+	MaxSize      int64 // most bytes that may be read for a single value
+
+	// StrictKeys requires dictionary keys to be in sorted order, as the spec says they must be.
+	// Plenty of encoders in the wild get this wrong, so it's off by default.
+	StrictKeys bool
+}
+
+func (o Options) withDefaults() Options {
+	if o.MaxStringLen == 0 {
+		o.MaxStringLen = DefaultMaxStringLen
+	}
+	if o.MaxDepth == 0 {
+		o.MaxDepth = DefaultMaxDepth
+	}
+	if o.MaxSize == 0 {
+		o.MaxSize = DefaultMaxSize
+	}
+	return o
+}
+
+// Parse reads a single bencoded value with the default Options. Strings are returned as string,
+// integers as int, lists as []any and dictionaries as map[string]any.
 func Parse(b *bufio.Reader) (any, error) {
-	t, err := b.Peek(1)
+	return ParseWithOptions(b, Options{})
+}
+
+// ParseWithOptions reads a single bencoded value within the given limits
+func ParseWithOptions(b *bufio.Reader, opts Options) (any, error) {
+	return newParser(b, opts).parse()
+}
+
+// parser tracks how deep and how far into a value we are, so limits can be enforced
+type parser struct {
+	b      *bufio.Reader
+	opts   Options
+	depth  int
+	read   int64
+	offset int64 // bytes read since the start of the input
+}
+
+func newParser(b *bufio.Reader, opts Options) *parser {
+	return &parser{b: b, opts: opts.withDefaults()}
+}
+
+func (p *parser) peek() (byte, error) {
+	t, err := p.b.Peek(1)
+	if err == io.EOF && p.read > 0 {
+		err = io.ErrUnexpectedEOF // the value we're part way through has been cut off
+	}
+	if err != nil {
+		return 0, err
+	}
+	return t[0], nil
+}
+
+func (p *parser) readByte() (byte, error) {
+	if err := p.consume(1); err != nil {
+		return 0, err
+	}
+	c, err := p.b.ReadByte()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return c, err
+}
+
+// consume accounts for n more bytes of input
+func (p *parser) consume(n int64) error {
+	p.read += n
+	p.offset += n
+	if p.read > p.opts.MaxSize {
+		return fmt.Errorf("%w: value is over %d bytes", ErrLimit, p.opts.MaxSize)
+	}
+	return nil
+}
+
+func (p *parser) parse() (any, error) {
+	t, err := p.peek()
 	if err != nil {
 		return nil, err
 	}
-	if t[0] >= '0' && t[0] <= '9' {
-		s, err := parseString(b)
+	if t >= '0' && t <= '9' {
+		s, err := p.parseString()
 		return s, err
 	}
-	_, err = b.ReadByte()
-	if err != nil {
+	if t == 'l' || t == 'd' {
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > p.opts.MaxDepth {
+			return nil, fmt.Errorf("%w: nested over %d deep", ErrLimit, p.opts.MaxDepth)
+		}
+	}
+	if _, err := p.readByte(); err != nil {
 		return nil, err
 	}
-	switch t[0] {
+	switch t {
 	case 'i':
-		i, err := parseInt(b)
+		i, err := p.parseInt()
 		return i, err
 	case 'l':
-		l, err := parseList(b)
+		l, err := p.parseList()
 		return l, err
 	case 'd':
-		d, err := parseDict(b)
+		d, err := p.parseDict()
 		return d, err
 	default:
-		return nil, fmt.Errorf("unknown type found in parse: %v", t[0])
+		return nil, fmt.Errorf("unknown type found in parse: %v", t)
 	}
 }
 
-func parseList(b *bufio.Reader) ([]any, error) {
-	t, err := b.Peek(1)
+func (p *parser) parseList() ([]any, error) {
+	t, err := p.peek()
 	if err != nil {
 		return nil, err
 	}
 	res := []any{}
-	for t[0] != 'e' {
-		item, err := Parse(b)
+	for t != 'e' {
+		item, err := p.parse()
 		if err != nil {
 			return nil, err
 		}
 		res = append(res, item)
-		t, err = b.Peek(1)
+		t, err = p.peek()
 		if err != nil {
 			return nil, err
 		}
 	}
-	b.ReadByte() // discard final 'e'
+	p.readByte() // discard final 'e'
 	return res, nil
 }
 
-func parseDict(b *bufio.Reader) (map[string]any, error) {
-	t, err := b.Peek(1)
+func (p *parser) parseDict() (map[string]any, error) {
+	t, err := p.peek()
 	if err != nil {
 		return nil, err
 	}
 	res := map[string]any{}
-	for t[0] != 'e' {
-		key, err := parseString(b)
-		if err != nil {
-			return nil, err
+	prev := ""
+	for t != 'e' {
+		if t < '0' || t > '9' {
+			return nil, fmt.Errorf("dict key must be a string, found %q", t)
 		}
-		val, err := Parse(b)
+		key, err := p.parseString()
 		if err != nil {
 			return nil, err
 		}
-		_, exists := res[key]
-		if exists {
+		if _, exists := res[key]; exists {
 			return nil, fmt.Errorf("dupe key '%s' found in dict", key)
 		}
+		if p.opts.StrictKeys && len(res) > 0 && key < prev {
+			return nil, fmt.Errorf("%w: dict key '%s' comes after '%s'", ErrNonCanonical, key, prev)
+		}
+		val, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
 		res[key] = val
-		t, err = b.Peek(1)
+		prev = key
+		t, err = p.peek()
 		if err != nil {
 			return nil, err
 		}
 	}
-	b.ReadByte() // discard final 'e'
+	p.readByte() // discard final 'e'
 	return res, nil
 }
 
-func parseString(b *bufio.Reader) (string, error) {
-	l, err := b.ReadString(':')
+func (p *parser) parseString() (string, error) {
+	sLen, err := p.stringLen()
 	if err != nil {
 		return "", err
 	}
-	sLen, err := strconv.Atoi(l[:len(l)-1])
-	if err != nil {
-		return "", err
+	// the string grows as data arrives, rather than trusting the length up front
+	var s strings.Builder
+	if sLen < stringChunk {
+		s.Grow(sLen)
+	} else {
+		s.Grow(stringChunk)
 	}
-	buf := make([]byte, sLen)
-	_, err = io.ReadFull(b, buf)
-	if err != nil {
-		return "", err
+	for remaining := sLen; remaining > 0; {
+		n := remaining
+		if n > p.b.Size() {
+			n = p.b.Size()
+		}
+		chunk, err := p.b.Peek(n)
+		s.Write(chunk)
+		p.b.Discard(len(chunk))
+		remaining -= len(chunk)
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		} else if err != nil {
+			return "", err
+		}
 	}
-	return string(buf), nil
+	return s.String(), nil
 }
 
-func parseInt(b *bufio.Reader) (int, error) {
-	s, err := b.ReadString('e')
+// stringLen reads a string's length prefix, accounting for the string that follows it
+func (p *parser) stringLen() (int, error) {
+	sLen, err := p.readNumber(':')
 	if err != nil {
 		return 0, err
 	}
-	val := s[:len(s)-1]
-	n, err := strconv.Atoi(val)
-	if err != nil {
+	if sLen < 0 {
+		return 0, fmt.Errorf("invalid string length %d", sLen)
+	}
+	if sLen > p.opts.MaxStringLen {
+		return 0, fmt.Errorf("%w: string of %d bytes is over %d", ErrLimit, sLen, p.opts.MaxStringLen)
+	}
+	if err := p.consume(int64(sLen)); err != nil {
 		return 0, err
 	}
-	return n, nil
+	return sLen, nil
+}
+
+func (p *parser) parseInt() (int, error) {
+	return p.readNumber('e')
+}
+
+// readNumber reads a canonical decimal number up to the delimiter, which is consumed. Canonical
+// means no leading zeros, no plus sign and no negative zero.
+func (p *parser) readNumber(delim byte) (int, error) {
+	var n uint64
+	neg := false
+	digits := 0
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case c == delim:
+		case c == '-' && digits == 0 && !neg:
+			neg = true
+			continue
+		case c < '0' || c > '9':
+			return 0, fmt.Errorf("unexpected %q in number", c)
+		case digits > 0 && n == 0:
+			return 0, fmt.Errorf("%w: number has a leading zero", ErrNonCanonical)
+		default:
+			d := uint64(c - '0')
+			if n > (math.MaxUint64-d)/10 {
+				return 0, errors.New("number out of range")
+			}
+			n = n*10 + d
+			digits++
+			continue
+		}
+		break
+	}
+	switch {
+	case digits == 0:
+		return 0, errors.New("number has no digits")
+	case neg && n == 0:
+		return 0, fmt.Errorf("%w: negative zero", ErrNonCanonical)
+	case neg && n == uint64(math.MaxInt)+1:
+		return math.MinInt, nil
+	case n > math.MaxInt:
+		return 0, errors.New("number out of range")
+	case neg:
+		return -int(n), nil
+	}
+	return int(n), nil
+}
+
+// Marshal bencodes a value of the kind Parse returns: a string, int, []any or map[string]any.
+// Dictionary keys are written in sorted order, so a parsed value marshals back to the same bytes as
+// long as the original was canonical.
+func Marshal(v any) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := marshal(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func marshal(buf *bytes.Buffer, v any) error {
+	switch v := v.(type) {
+	case string:
+		buf.WriteString(strconv.Itoa(len(v)))
+		buf.WriteByte(':')
+		buf.WriteString(v)
+	case int:
+		buf.WriteString("i" + strconv.Itoa(v) + "e")
+	case []any:
+		buf.WriteByte('l')
+		for _, item := range v {
+			if err := marshal(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			marshal(buf, k)
+			if err := marshal(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("can't bencode a %T", v)
+	}
+	return nil
 }
@@ -2,7 +2,12 @@ package bencodecustom
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -12,7 +17,7 @@ func TestParseInt(t *testing.T) {
 	s := strings.NewReader(fmt.Sprintf("i%de", want))
 	r := bufio.NewReader(s)
 	r.ReadByte() // simulate Parse dropping first byte
-	have, err := parseInt(r)
+	have, err := newParser(r, Options{}).parseInt()
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -25,7 +30,7 @@ func TestParseString(t *testing.T) {
 	// standard
 	want := "hello!"
 	s := strings.NewReader(fmt.Sprintf("%d:%s", len(want), want))
-	have, err := parseString(bufio.NewReader(s))
+	have, err := newParser(bufio.NewReader(s), Options{}).parseString()
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -36,7 +41,7 @@ func TestParseString(t *testing.T) {
 	// containing colon
 	want = "hel:lo"
 	s = strings.NewReader(fmt.Sprintf("%d:%s", len(want), want))
-	have, err = parseString(bufio.NewReader(s))
+	have, err = newParser(bufio.NewReader(s), Options{}).parseString()
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -47,7 +52,7 @@ func TestParseString(t *testing.T) {
 	// empty
 	want = ""
 	s = strings.NewReader(fmt.Sprintf("%d:%s", len(want), want))
-	have, err = parseString(bufio.NewReader(s))
+	have, err = newParser(bufio.NewReader(s), Options{}).parseString()
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -60,7 +65,7 @@ func TestParseList(t *testing.T) {
 	// two strings
 	r := strings.NewReader("l4:spam4:eggse")
 	r.ReadByte() // simulate Parse dropping first byte
-	l, err := parseList(bufio.NewReader(r))
+	l, err := newParser(bufio.NewReader(r), Options{}).parseList()
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -77,7 +82,7 @@ func TestParseList(t *testing.T) {
 	// mix of string and int
 	r = strings.NewReader("l4:spami1e4:eggse")
 	r.ReadByte() // simulate Parse dropping first byte
-	l, err = parseList(bufio.NewReader(r))
+	l, err = newParser(bufio.NewReader(r), Options{}).parseList()
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -98,7 +103,7 @@ func TestParseList(t *testing.T) {
 func TestParseDicct(t *testing.T) {
 	r := strings.NewReader("d3:cow3:moo4:spam4:eggse")
 	r.ReadByte() // simulate Parse dropping first byte
-	d, err := parseDict(bufio.NewReader(r))
+	d, err := newParser(bufio.NewReader(r), Options{}).parseDict()
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -155,3 +160,135 @@ func TestParse(t *testing.T) {
 		t.Errorf("expected bar[1] to be 'b', got %v", barList[1])
 	}
 }
+
+func TestMarshal(t *testing.T) {
+	in := "d4:infod5:filesld6:lengthi-3e4:pathl1:aeee4:name0:e1:xli1e1:yee"
+	v, err := Parse(bufio.NewReader(strings.NewReader(in)))
+	if err != nil {
+		t.Fatalf("unexpected error parsing: %v", err)
+	}
+	have, err := Marshal(v)
+	if err != nil {
+		t.Fatalf("unexpected error marshalling: %v", err)
+	}
+	if string(have) != in {
+		t.Errorf("expected %s, got %s", in, have)
+	}
+	if _, err := Marshal(map[string]any{"a": 1.5}); err == nil {
+		t.Errorf("expected an error marshalling a float")
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	tests := []struct {
+		in   string
+		want error // checked with errors.Is if set
+	}{
+		{"i-0e", ErrNonCanonical},
+		{"i03e", ErrNonCanonical},
+		{"i-03e", ErrNonCanonical},
+		{"ie", nil},
+		{"i-e", nil},
+		{"i+1e", nil},
+		{"i1x2e", nil},
+		{"i99999999999999999999999e", nil},
+		{"i9223372036854775808e", nil},
+		{"i1", io.ErrUnexpectedEOF},
+		{"-1:a", nil},
+		{"01:a", ErrNonCanonical},
+		{"5:abc", io.ErrUnexpectedEOF},
+		{"99999999999:a", ErrLimit},
+		{"li1e", io.ErrUnexpectedEOF},
+		{"di1ei2ee", nil},
+		{"d1:ai1e1:ai2ee", nil},
+		{"x", nil},
+	}
+	for _, tt := range tests {
+		_, err := Parse(bufio.NewReader(strings.NewReader(tt.in)))
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.in)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.in, tt.want, err)
+		}
+	}
+	for _, in := range []string{"i0e", "i-1e", "i10e", "i-9223372036854775808e", "0:", "10:0123456789"} {
+		if _, err := Parse(bufio.NewReader(strings.NewReader(in))); err != nil {
+			t.Errorf("%s: unexpected error %v", in, err)
+		}
+	}
+}
+
+func TestParseLimits(t *testing.T) {
+	deep := strings.Repeat("l", 10) + strings.Repeat("e", 10)
+	tests := []struct {
+		in   string
+		opts Options
+	}{
+		{"5:hello", Options{MaxStringLen: 4}},
+		{deep, Options{MaxDepth: 9}},
+		{"l5:hello5:worlde", Options{MaxSize: 10}},
+		{strings.Repeat("l", 100000), Options{}},
+	}
+	for _, tt := range tests {
+		_, err := ParseWithOptions(bufio.NewReader(strings.NewReader(tt.in)), tt.opts)
+		if !errors.Is(err, ErrLimit) {
+			t.Errorf("%.20s: expected ErrLimit with %+v, got %v", tt.in, tt.opts, err)
+		}
+	}
+	if _, err := ParseWithOptions(bufio.NewReader(strings.NewReader(deep)), Options{MaxDepth: 10}); err != nil {
+		t.Errorf("unexpected error at the depth limit: %v", err)
+	}
+}
+
+func TestParseStrictKeys(t *testing.T) {
+	unsorted := "d1:bi1e1:ai2ee"
+	if _, err := Parse(bufio.NewReader(strings.NewReader(unsorted))); err != nil {
+		t.Errorf("unexpected error for unsorted keys by default: %v", err)
+	}
+	_, err := ParseWithOptions(bufio.NewReader(strings.NewReader(unsorted)), Options{StrictKeys: true})
+	if !errors.Is(err, ErrNonCanonical) {
+		t.Errorf("expected ErrNonCanonical for unsorted keys, got %v", err)
+	}
+	sorted := "d1:ai2e1:bi1e2:bai3ee"
+	if _, err := ParseWithOptions(bufio.NewReader(strings.NewReader(sorted)), Options{StrictKeys: true}); err != nil {
+		t.Errorf("unexpected error for sorted keys: %v", err)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{
+		"i42e", "i-1e", "0:", "4:spam", "le", "de",
+		"d3:barl1:a1:be3:fooi42ee",
+		"d4:infod5:filesld6:lengthi-3e4:pathl1:aeee4:name0:e1:xli1e1:yee",
+		"d1:bi1e1:ai2ee",
+	} {
+		f.Add([]byte(s))
+	}
+	if torrent, err := os.ReadFile("../../debian-11.5.0-amd64-netinst.iso.torrent"); err == nil {
+		f.Add(torrent)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		opts := Options{MaxStringLen: 1 << 20, MaxSize: 4 << 20}
+		v, err := ParseWithOptions(bufio.NewReader(bytes.NewReader(b)), opts)
+		if err != nil {
+			return
+		}
+		have, err := Marshal(v)
+		if err != nil {
+			t.Fatalf("unexpected error marshalling %#v: %v", v, err)
+		}
+		// canonical input marshals back to exactly the bytes it was parsed from
+		opts.StrictKeys = true
+		if _, err := ParseWithOptions(bufio.NewReader(bytes.NewReader(b)), opts); err == nil && !bytes.HasPrefix(b, have) {
+			t.Errorf("expected %q to marshal back to itself, got %q", b, have)
+		}
+		// and whatever we marshal parses back to the same value, strictly
+		again, err := ParseWithOptions(bufio.NewReader(bytes.NewReader(have)), Options{StrictKeys: true})
+		if err != nil {
+			t.Fatalf("unexpected error parsing marshalled %q: %v", have, err)
+		}
+		if !reflect.DeepEqual(again, v) {
+			t.Errorf("expected %#v after a round trip, got %#v", v, again)
+		}
+	})
+}
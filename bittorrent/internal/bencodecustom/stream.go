@@ -0,0 +1,275 @@
+package bencodecustom
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// A Token is a Delim, a string or an int
+type Token any
+
+// A Delim is the start of a list ('l') or dictionary ('d'), or the end of either ('e')
+type Delim byte
+
+func (d Delim) String() string {
+	return string(d)
+}
+
+// A Decoder reads a stream of bencoded values a token or a value at a time, so large or
+// uninteresting parts of the input needn't be held in memory. Limits apply to each top level
+// value.
+type Decoder struct {
+	p     *parser
+	stack []frame // the lists and dictionaries we're inside, innermost last
+}
+
+// frame is a list or dictionary we're part way through
+type frame struct {
+	dict bool
+	key  bool // a dictionary's next token is a key
+	prev string
+	keys map[string]bool
+}
+
+// NewDecoder returns a decoder reading from r with the default Options. If r is a *bufio.Reader
+// it's used as is, so whatever follows the values read from it is left there.
+func NewDecoder(r io.Reader) *Decoder {
+	return NewDecoderWithOptions(r, Options{})
+}
+
+// NewDecoderWithOptions returns a decoder reading from r within the given limits
+func NewDecoderWithOptions(r io.Reader, opts Options) *Decoder {
+	b, ok := r.(*bufio.Reader)
+	if !ok {
+		b = bufio.NewReader(r)
+	}
+	return &Decoder{p: newParser(b, opts)}
+}
+
+// Token returns the next token. Strings and ints are returned whole, and lists and dictionaries as
+// a start Delim, their contents and an end Delim. At the end of the input it returns io.EOF.
+func (d *Decoder) Token() (Token, error) {
+	return d.token(false)
+}
+
+// token reads the next token, throwing away strings that aren't dictionary keys if discard is set
+func (d *Decoder) token(discard bool) (Token, error) {
+	t, key, err := d.begin()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t == 'e':
+		d.p.readByte()
+		d.stack = d.stack[:len(d.stack)-1]
+		d.p.depth--
+		return Delim('e'), nil
+	case key:
+		return d.readKey()
+	case t == 'l' || t == 'd':
+		d.p.readByte()
+		d.p.depth++
+		if d.p.depth > d.p.opts.MaxDepth {
+			return nil, fmt.Errorf("%w: nested over %d deep", ErrLimit, d.p.opts.MaxDepth)
+		}
+		f := frame{dict: t == 'd', key: t == 'd'}
+		if f.dict {
+			f.keys = map[string]bool{}
+		}
+		d.stack = append(d.stack, f)
+		return Delim(t), nil
+	case t == 'i':
+		d.p.readByte()
+		return d.p.parseInt()
+	case t >= '0' && t <= '9' && discard:
+		return "", d.p.skipString()
+	case t >= '0' && t <= '9':
+		return d.p.parseString()
+	}
+	return nil, fmt.Errorf("unknown type found in parse: %v", t)
+}
+
+func (d *Decoder) peek() (byte, error) {
+	if len(d.stack) == 0 {
+		d.p.read = 0 // a new top level value
+	}
+	return d.p.peek()
+}
+
+// begin peeks at the next token and works out where it sits in the enclosing dictionary, if any
+func (d *Decoder) begin() (next byte, key bool, err error) {
+	if next, err = d.peek(); err != nil {
+		return 0, false, err
+	}
+	if len(d.stack) == 0 {
+		if next == 'e' {
+			return 0, false, errors.New("unexpected 'e' outside of a list or dict")
+		}
+		return next, false, nil
+	}
+	f := &d.stack[len(d.stack)-1]
+	if !f.dict {
+		return next, false, nil
+	}
+	if f.key {
+		if next != 'e' && (next < '0' || next > '9') {
+			return 0, false, fmt.Errorf("dict key must be a string, found %q", next)
+		}
+		return next, next != 'e', nil
+	}
+	if next == 'e' {
+		return 0, false, fmt.Errorf("dict key '%s' has no value", f.prev)
+	}
+	f.key = true // once this value is read
+	return next, false, nil
+}
+
+// readKey reads a dictionary key, checking it against those before it
+func (d *Decoder) readKey() (string, error) {
+	key, err := d.p.parseString()
+	if err != nil {
+		return "", err
+	}
+	f := &d.stack[len(d.stack)-1]
+	if f.keys[key] {
+		return "", fmt.Errorf("dupe key '%s' found in dict", key)
+	}
+	if d.p.opts.StrictKeys && len(f.keys) > 0 && key < f.prev {
+		return "", fmt.Errorf("%w: dict key '%s' comes after '%s'", ErrNonCanonical, key, f.prev)
+	}
+	f.keys[key] = true
+	f.prev = key
+	f.key = false
+	return key, nil
+}
+
+// More reports whether the list or dictionary we're in has more in it
+func (d *Decoder) More() bool {
+	t, err := d.peek()
+	return err == nil && t != 'e'
+}
+
+// Skip reads past the next value without keeping it, which is a cheap way of ignoring parts of
+// the input
+func (d *Decoder) Skip() error {
+	if t, err := d.peek(); err != nil {
+		return err
+	} else if t == 'e' {
+		return errors.New("no value to skip at the end of a list or dict")
+	}
+	depth := 0
+	for {
+		tok, err := d.token(true)
+		if err != nil {
+			return err
+		}
+		switch tok {
+		case Delim('l'), Delim('d'):
+			depth++
+		case Delim('e'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// Decode reads the next whole value into v, which must be a pointer to an any, string, int, []any
+// or map[string]any
+func (d *Decoder) Decode(v any) error {
+	t, key, err := d.begin()
+	if err != nil {
+		return err
+	}
+	if t == 'e' {
+		return errors.New("no value to decode at the end of a list or dict")
+	}
+	var val any
+	if key {
+		val, err = d.readKey()
+	} else {
+		val, err = d.p.parse()
+	}
+	if err != nil {
+		return err
+	}
+	switch v := v.(type) {
+	case *any:
+		*v = val
+		return nil
+	case *string:
+		if s, ok := val.(string); ok {
+			*v = s
+			return nil
+		}
+	case *int:
+		if i, ok := val.(int); ok {
+			*v = i
+			return nil
+		}
+	case *[]any:
+		if l, ok := val.([]any); ok {
+			*v = l
+			return nil
+		}
+	case *map[string]any:
+		if m, ok := val.(map[string]any); ok {
+			*v = m
+			return nil
+		}
+	default:
+		return fmt.Errorf("can't decode into a %T", v)
+	}
+	return fmt.Errorf("can't decode a %T into a %T", val, v)
+}
+
+// Buffered returns the input that's been read from the underlying reader but not yet decoded
+func (d *Decoder) Buffered() io.Reader {
+	b, _ := d.p.b.Peek(d.p.b.Buffered())
+	return bytes.NewReader(b)
+}
+
+// InputOffset returns how many bytes of input have been decoded, which is where the next token
+// starts. Together with Skip it finds the exact bytes a value was encoded as.
+func (d *Decoder) InputOffset() int64 {
+	return d.p.offset
+}
+
+// skipString reads past a string without keeping it
+func (p *parser) skipString() error {
+	sLen, err := p.stringLen()
+	if err != nil {
+		return err
+	}
+	if _, err := p.b.Discard(sLen); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
+
+// An Encoder writes bencoded values to a stream
+type Encoder struct {
+	w   io.Writer
+	buf bytes.Buffer
+}
+
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes v, which must be something Marshal accepts. Nothing is written if it isn't.
+func (e *Encoder) Encode(v any) error {
+	e.buf.Reset()
+	if err := marshal(&e.buf, v); err != nil {
+		return err
+	}
+	_, err := e.w.Write(e.buf.Bytes())
+	return err
+}
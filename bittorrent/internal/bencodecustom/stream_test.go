@@ -0,0 +1,295 @@
+package bencodecustom
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoderToken(t *testing.T) {
+	d := NewDecoder(strings.NewReader("d3:barl1:a1:be3:fooi42ee"))
+	want := []Token{Delim('d'), "bar", Delim('l'), "a", "b", Delim('e'), "foo", 42, Delim('e')}
+	for i, w := range want {
+		have, err := d.Token()
+		if err != nil {
+			t.Fatalf("token %d: unexpected error %v", i, err)
+		}
+		if have != w {
+			t.Errorf("token %d: expected %v, got %v", i, w, have)
+		}
+	}
+	if _, err := d.Token(); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the input, got %v", err)
+	}
+}
+
+func TestDecoderStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e4:spamli2eede"))
+	want := []any{1, "spam", []any{2}, map[string]any{}}
+	for _, w := range want {
+		var have any
+		if err := d.Decode(&have); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(have, w) {
+			t.Errorf("expected %#v, got %#v", w, have)
+		}
+	}
+	var v any
+	if err := d.Decode(&v); err != io.EOF {
+		t.Errorf("expected io.EOF at the end of the input, got %v", err)
+	}
+}
+
+func TestDecoderSkip(t *testing.T) {
+	in := "d8:announce3:url4:infod6:lengthi5e4:name4:test6:pieces4:xxxxe5:nodesll1:ai1eeee"
+	d := NewDecoder(strings.NewReader(in))
+	if tok, err := d.Token(); err != nil || tok != Delim('d') {
+		t.Fatalf("expected a dict, got %v, %v", tok, err)
+	}
+	var name string
+	for d.More() {
+		var key string
+		if err := d.Decode(&key); err != nil {
+			t.Fatalf("unexpected error reading key: %v", err)
+		}
+		if key != "info" {
+			if err := d.Skip(); err != nil {
+				t.Fatalf("unexpected error skipping %s: %v", key, err)
+			}
+			continue
+		}
+		var info map[string]any
+		if err := d.Decode(&info); err != nil {
+			t.Fatalf("unexpected error decoding info: %v", err)
+		}
+		name, _ = info["name"].(string)
+	}
+	if tok, err := d.Token(); err != nil || tok != Delim('e') {
+		t.Fatalf("expected the end of the dict, got %v, %v", tok, err)
+	}
+	if name != "test" {
+		t.Errorf("expected name test, got %q", name)
+	}
+	if err := d.Skip(); err != io.EOF {
+		t.Errorf("expected io.EOF skipping past the end, got %v", err)
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	tests := []struct {
+		in   string
+		opts Options
+		want error // checked with errors.Is if set
+	}{
+		{"d1:ai1e1:ai2ee", Options{}, nil},
+		{"di1ei2ee", Options{}, nil},
+		{"d1:ae", Options{}, nil},
+		{"d1:bi1e1:ai2ee", Options{StrictKeys: true}, ErrNonCanonical},
+		{"e", Options{}, nil},
+		{"llle", Options{MaxDepth: 2}, ErrLimit},
+		{"l5:hello", Options{MaxStringLen: 4}, ErrLimit},
+		{"li1e", Options{}, io.ErrUnexpectedEOF},
+		{"i01e", Options{}, ErrNonCanonical},
+	}
+	for _, tt := range tests {
+		d := NewDecoderWithOptions(strings.NewReader(tt.in), tt.opts)
+		var err error
+		for err == nil {
+			_, err = d.Token()
+		}
+		if err == io.EOF {
+			t.Errorf("%s: expected an error", tt.in)
+		} else if tt.want != nil && !errors.Is(err, tt.want) {
+			t.Errorf("%s: expected %v, got %v", tt.in, tt.want, err)
+		}
+	}
+	var s string
+	if err := NewDecoder(strings.NewReader("i1e")).Decode(&s); err == nil {
+		t.Errorf("expected an error decoding an int into a string")
+	}
+}
+
+func TestDecoderBuffered(t *testing.T) {
+	d := NewDecoder(strings.NewReader("d1:ai1eetrailing"))
+	var v any
+	if err := d.Decode(&v); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	rest, _ := io.ReadAll(d.Buffered())
+	if string(rest) != "trailing" {
+		t.Errorf("expected trailing to be left over, got %q", rest)
+	}
+}
+
+func TestDecoderInputOffset(t *testing.T) {
+	in := "d1:zi1e4:infod1:b0:1:al3:fooeee1:a2:xx"
+	d := NewDecoder(strings.NewReader(in))
+	if tok, err := d.Token(); err != nil || tok != Delim('d') {
+		t.Fatalf("expected a dict, got %v, %v", tok, err)
+	}
+	var raw string
+	for d.More() {
+		key, err := d.Token()
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		start := d.InputOffset()
+		if err := d.Skip(); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if key == "info" {
+			raw = in[start:d.InputOffset()]
+		}
+	}
+	if raw != "d1:b0:1:al3:fooee" {
+		t.Errorf("expected the info dict's bytes, got %q", raw)
+	}
+	d.Token()
+	if d.InputOffset() != int64(len(in)-len("1:a2:xx")) {
+		t.Errorf("expected to be at the end of the dict, got offset %d", d.InputOffset())
+	}
+}
+
+func TestEncoder(t *testing.T) {
+	buf := bytes.Buffer{}
+	e := NewEncoder(&buf)
+	values := []any{1, "spam", []any{"a", 2}, map[string]any{"b": 1, "a": []any{}}}
+	for _, v := range values {
+		if err := e.Encode(v); err != nil {
+			t.Fatalf("unexpected error encoding %v: %v", v, err)
+		}
+	}
+	if err := e.Encode([]any{1, 1.5}); err == nil {
+		t.Errorf("expected an error encoding a float")
+	}
+	want := "i1e4:spaml1:ai2eed1:ale1:bi1ee"
+	if buf.String() != want {
+		t.Errorf("expected %s, got %s", want, buf.String())
+	}
+}
+
+// benchInputs are a real torrent file and a tracker response listing plenty of peers
+func benchInputs(b *testing.B) map[string][]byte {
+	peers := []any{}
+	for i := 0; i < 200; i++ {
+		peers = append(peers, map[string]any{
+			"ip":      fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+			"peer id": strings.Repeat("x", 20),
+			"port":    6881 + i,
+		})
+	}
+	announce, err := Marshal(map[string]any{"interval": 1800, "peers": peers})
+	if err != nil {
+		b.Fatal(err)
+	}
+	inputs := map[string][]byte{"announce": announce}
+	if torrent, err := os.ReadFile("../../debian-11.5.0-amd64-netinst.iso.torrent"); err == nil {
+		inputs["torrent"] = torrent
+	}
+	return inputs
+}
+
+func benchmarkDecoding(b *testing.B, decode func(r io.Reader) error) {
+	for name, in := range benchInputs(b) {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := decode(bytes.NewReader(in)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkParse(b *testing.B) {
+	benchmarkDecoding(b, func(r io.Reader) error {
+		_, err := Parse(bufio.NewReader(r))
+		return err
+	})
+}
+
+func BenchmarkDecode(b *testing.B) {
+	benchmarkDecoding(b, func(r io.Reader) error {
+		var v any
+		return NewDecoder(r).Decode(&v)
+	})
+}
+
+func BenchmarkToken(b *testing.B) {
+	benchmarkDecoding(b, func(r io.Reader) error {
+		d := NewDecoder(r)
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	})
+}
+
+func BenchmarkSkip(b *testing.B) {
+	benchmarkDecoding(b, func(r io.Reader) error {
+		return NewDecoder(r).Skip()
+	})
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	for name, in := range benchInputs(b) {
+		v, _ := Parse(bufio.NewReader(bytes.NewReader(in)))
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := Marshal(v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	for name, in := range benchInputs(b) {
+		v, _ := Parse(bufio.NewReader(bytes.NewReader(in)))
+		e := NewEncoder(io.Discard)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(in)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := e.Encode(v); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	for _, s := range []string{"i42e", "4:spam", "d3:barl1:a1:be3:fooi42ee", "d1:ad1:bleee", "d1:ai1e1:ai2ee", "le"} {
+		f.Add([]byte(s))
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		opts := Options{MaxStringLen: 1 << 20, MaxSize: 4 << 20}
+		want, wantErr := ParseWithOptions(bufio.NewReader(bytes.NewReader(b)), opts)
+		// the decoder accepts exactly what Parse does, whichever way the value's read
+		var have any
+		err := NewDecoderWithOptions(bytes.NewReader(b), opts).Decode(&have)
+		if (err == nil) != (wantErr == nil) || err == nil && !reflect.DeepEqual(have, want) {
+			t.Errorf("expected Decode to give %#v, %v like Parse, got %#v, %v", want, wantErr, have, err)
+		}
+		err = NewDecoderWithOptions(bytes.NewReader(b), opts).Skip()
+		if (err == nil) != (wantErr == nil) {
+			t.Errorf("expected Skip to give %v like Parse, got %v", wantErr, err)
+		}
+	})
+}
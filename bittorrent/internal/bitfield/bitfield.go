@@ -1,20 +1,130 @@
 package bitfield
 
-// A Bitfield represents the pieces that a peer has
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// A Bitfield represents the pieces that a peer has. The first piece is the high bit of the first
+// byte, and any spare bits at the end of the last byte are clear.
 type Bitfield []byte
 
-// HasPiece tells if a bitfield has a particular index set
+// New returns an empty bitfield for a torrent of numPieces pieces
+func New(numPieces int) Bitfield {
+	return make(Bitfield, (numPieces+7)/8) // round up trick to ensure enough bytes
+}
+
+// Full returns a bitfield with each of numPieces pieces set
+func Full(numPieces int) Bitfield {
+	bf := New(numPieces)
+	for i := range bf {
+		bf[i] = 0xff
+	}
+	if spare := numPieces % 8; spare != 0 {
+		bf[len(bf)-1] = 0xff << (8 - spare)
+	}
+	return bf
+}
+
+// Validate checks a bitfield from a peer is the right length for numPieces pieces and has none of
+// the spare bits at the end set
+func (bf Bitfield) Validate(numPieces int) error {
+	if len(bf) != (numPieces+7)/8 {
+		return fmt.Errorf("expected bitfield of %d bytes for %d pieces, got %d", (numPieces+7)/8, numPieces, len(bf))
+	}
+	if spare := numPieces % 8; spare != 0 && bf[len(bf)-1]&(0xff>>spare) != 0 {
+		return errors.New("bitfield has spare bits set")
+	}
+	return nil
+}
+
+// HasPiece tells if a bitfield has a particular index set. Indexes past the end are never set.
 func (bf Bitfield) HasPiece(index int) bool {
 	byteIndex := index / 8
 	bitIndex := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return false
+	}
 	check := bf[byteIndex] >> (7 - bitIndex) // shift target bit all the way to the right
 	return check&1 == 1                      // AND with mask of 1 to check if set
 }
 
-// SetPiece sets a bit in the bitfield
+// SetPiece sets a bit in the bitfield. Indexes past the end are ignored.
 func (bf Bitfield) SetPiece(index int) {
 	byteIndex := index / 8
 	bitIndex := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
 	mask := byte(1 << (7 - bitIndex)) // take a binary 1 and shift the right most bit into position
 	bf[byteIndex] |= mask
 }
+
+// ClearPiece clears a bit in the bitfield. Indexes past the end are ignored.
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	bitIndex := index % 8
+	if index < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= byte(1 << (7 - bitIndex))
+}
+
+// Count returns how many pieces are set
+func (bf Bitfield) Count() int {
+	n := 0
+	for _, b := range bf {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// And returns the pieces set in both bitfields. The result is the length of bf, with anything past
+// the end of other treated as clear.
+func (bf Bitfield) And(other Bitfield) Bitfield {
+	return bf.combine(other, func(a, b byte) byte { return a & b })
+}
+
+// Or returns the pieces set in either bitfield, the length of bf
+func (bf Bitfield) Or(other Bitfield) Bitfield {
+	return bf.combine(other, func(a, b byte) byte { return a | b })
+}
+
+// AndNot returns the pieces set in bf but not in other, such as the pieces a peer has that we
+// don't
+func (bf Bitfield) AndNot(other Bitfield) Bitfield {
+	return bf.combine(other, func(a, b byte) byte { return a &^ b })
+}
+
+func (bf Bitfield) combine(other Bitfield, op func(a, b byte) byte) Bitfield {
+	res := make(Bitfield, len(bf))
+	for i := range bf {
+		var b byte
+		if i < len(other) {
+			b = other[i]
+		}
+		res[i] = op(bf[i], b)
+	}
+	return res
+}
+
+// NextSet returns the first piece set at or after from, or -1 if there isn't one. Set pieces can
+// be iterated over with
+//
+//	for i := bf.NextSet(0); i != -1; i = bf.NextSet(i + 1) {
+func (bf Bitfield) NextSet(from int) int {
+	if from < 0 {
+		from = 0
+	}
+	for byteIndex := from / 8; byteIndex < len(bf); byteIndex++ {
+		b := bf[byteIndex]
+		if byteIndex == from/8 {
+			b &= 0xff >> (from % 8) // skip the bits before from
+		}
+		if b != 0 {
+			return byteIndex*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return -1
+}
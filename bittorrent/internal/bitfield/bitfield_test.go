@@ -0,0 +1,86 @@
+package bitfield
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	if bf := New(10); len(bf) != 2 || bf.Count() != 0 {
+		t.Errorf("expected 2 empty bytes for 10 pieces, got %08b", bf)
+	}
+	if bf := Full(10); !bytes.Equal(bf, []byte{0xff, 0xc0}) || bf.Count() != 10 {
+		t.Errorf("expected 10 pieces set, got %08b", bf)
+	}
+	if bf := Full(16); !bytes.Equal(bf, []byte{0xff, 0xff}) {
+		t.Errorf("expected 16 pieces set, got %08b", bf)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		bf Bitfield
+		ok bool
+	}{
+		{Bitfield{0xff, 0xc0}, true},
+		{Bitfield{0xff, 0xe0}, false}, // spare bit set
+		{Bitfield{0xff}, false},
+		{Bitfield{0xff, 0xc0, 0}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.bf.Validate(10); (err == nil) != tt.ok {
+			t.Errorf("Validate(%08b) returned %v, want ok %v", tt.bf, err, tt.ok)
+		}
+	}
+}
+
+func TestSetAndClear(t *testing.T) {
+	bf := New(10)
+	bf.SetPiece(0)
+	bf.SetPiece(9)
+	bf.SetPiece(16) // past the end
+	bf.SetPiece(-1)
+	if !bytes.Equal(bf, []byte{0x80, 0x40}) {
+		t.Errorf("expected pieces 0 and 9 set, got %08b", bf)
+	}
+	if !bf.HasPiece(9) || bf.HasPiece(8) || bf.HasPiece(16) || bf.HasPiece(-1) {
+		t.Errorf("HasPiece disagrees with %08b", bf)
+	}
+	bf.ClearPiece(0)
+	bf.ClearPiece(16)
+	if !bytes.Equal(bf, []byte{0, 0x40}) || bf.Count() != 1 {
+		t.Errorf("expected only piece 9 left, got %08b", bf)
+	}
+}
+
+func TestOps(t *testing.T) {
+	a := Bitfield{0xf0, 0x80}
+	b := Bitfield{0x3c}
+	if have := a.And(b); !bytes.Equal(have, []byte{0x30, 0}) {
+		t.Errorf("expected a and b to be 00110000 00000000, got %08b", have)
+	}
+	if have := a.Or(b); !bytes.Equal(have, []byte{0xfc, 0x80}) {
+		t.Errorf("expected a or b to be 11111100 10000000, got %08b", have)
+	}
+	if have := a.AndNot(b); !bytes.Equal(have, []byte{0xc0, 0x80}) {
+		t.Errorf("expected a and not b to be 11000000 10000000, got %08b", have)
+	}
+	if !bytes.Equal(a, []byte{0xf0, 0x80}) {
+		t.Errorf("expected the operands to be left alone, got %08b", a)
+	}
+}
+
+func TestNextSet(t *testing.T) {
+	bf := Bitfield{0x81, 0, 0x01}
+	have := []int{}
+	for i := bf.NextSet(0); i != -1; i = bf.NextSet(i + 1) {
+		have = append(have, i)
+	}
+	if want := []int{0, 7, 23}; !reflect.DeepEqual(have, want) {
+		t.Errorf("expected set pieces %v, got %v", want, have)
+	}
+	if i := bf.NextSet(24); i != -1 {
+		t.Errorf("expected nothing past the end, got %d", i)
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import "strings"
+
+// Capability is an extension a peer can support, signalled by a bit in the handshake's reserved
+// bytes
+type Capability int
+
+const (
+	CapExtensions Capability = iota // extension protocol (BEP 10)
+	CapDHT                          // DHT, the peer will send its DHT port (BEP 5)
+	CapFast                         // fast extension (BEP 6)
+	CapV2                           // upgrade from a hybrid torrent's v1 swarm to v2 (BEP 52)
+)
+
+// capabilityBits is where each capability lives in the reserved bytes
+var capabilityBits = []struct {
+	cap   Capability
+	index int
+	mask  byte
+	name  string
+}{
+	{CapExtensions, 5, 0x10, "extensions"},
+	{CapDHT, 7, 0x01, "dht"},
+	{CapFast, 7, 0x04, "fast"},
+	{CapV2, 7, 0x10, "v2"},
+}
+
+// Capabilities is the set of capabilities in a handshake's reserved bytes. Bits we don't know
+// about are kept so they survive a round trip.
+type Capabilities [8]byte
+
+// NewCapabilities returns a set holding caps
+func NewCapabilities(caps ...Capability) Capabilities {
+	c := Capabilities{}
+	for _, cap := range caps {
+		c.Set(cap)
+	}
+	return c
+}
+
+// Has reports whether the set holds cap
+func (c Capabilities) Has(cap Capability) bool {
+	for _, b := range capabilityBits {
+		if b.cap == cap {
+			return c[b.index]&b.mask != 0
+		}
+	}
+	return false
+}
+
+// Set adds cap to the set
+func (c *Capabilities) Set(cap Capability) {
+	for _, b := range capabilityBits {
+		if b.cap == cap {
+			c[b.index] |= b.mask
+		}
+	}
+}
+
+// String lists the capabilities we know about, "none" if there aren't any
+func (c Capabilities) String() string {
+	names := []string{}
+	for _, b := range capabilityBits {
+		if c.Has(b.cap) {
+			names = append(names, b.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Supported is what we advertise in our handshakes. The extension protocol is only used to exchange
+// metadata for magnet links (BEP 9).
+var Supported = NewCapabilities(CapExtensions)
@@ -1,10 +1,11 @@
 package client
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
+	"log"
 	"net"
+	"sync"
 	"time"
 
 	"go-bt-learning.brk3.github.io/internal/bitfield"
@@ -14,26 +15,70 @@ import (
 // PeerID is a 20 byte identifier for our client
 const PeerID = "paulsbittorentclient"
 
+// DialTimeout is how long we wait for a peer to accept a TCP connection
+const DialTimeout = 3 * time.Second
+
 type Client struct {
 	Conn     net.Conn
 	Choked   bool
 	Bitfield bitfield.Bitfield
 	Peer     Peer
+	PeerID   [20]byte // the remote peer's id, as sent in its handshake
+	InfoHash [20]byte // the swarm we handshook in, which for hybrid torrents may be either of two
+
+	// Capabilities are the extensions the remote peer supports, from its handshake
+	Capabilities Capabilities
+
+	// NumPieces is how many pieces the torrent has, which messages from the peer are checked
+	// against. It must be set before handling messages.
+	NumPieces int
+
+	// Logger gets diagnostics about the peer, which are discarded if it's nil
+	Logger *log.Logger
+
+	// writes can come from the keepalive loop as well as whoever owns the client
+	wmu sync.Mutex
+	w   *message.Writer // created on first use, so it writes to whatever Conn is by then
+
+	// when we last sent or received anything
+	amu       sync.Mutex
+	lastWrite time.Time
+	lastRead  time.Time
 }
 
 func NewClient(peer Peer, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	conn, err := Dial(peer)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewClientFromConn(conn, peer, infoHash)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
+	return c, nil
+}
+
+// Dial opens a TCP connection to the peer without handshaking
+func Dial(peer Peer) (net.Conn, error) {
+	return net.DialTimeout("tcp", peer.String(), DialTimeout)
+}
+
+// NewClientFromConn handshakes over an already established connection. The caller owns conn and
+// should close it if an error is returned.
+func NewClientFromConn(conn net.Conn, peer Peer, infoHash [20]byte) (*Client, error) {
 	p := [20]byte{}
 	copy(p[:], PeerID)
 	h := Handshake{
-		Pstr:     "BitTorrent protocol",
+		Pstr:     protocol,
+		Reserved: Supported,
 		InfoHash: infoHash,
 		PeerID:   p,
 	}
-	_, err = doHandshake(conn, h, peer)
+	// don't let a silent peer hold the handshake open forever
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	hr, err := doHandshake(conn, h, peer)
 	if err != nil {
 		return nil, err
 	}
@@ -42,56 +87,177 @@ func NewClient(peer Peer, infoHash [20]byte) (*Client, error) {
 		Choked:   true,
 		Bitfield: nil,
 		Peer:     peer,
+		PeerID:   hr.PeerID,
+		InfoHash: infoHash,
+
+		Capabilities: hr.Reserved,
 	}, nil
 }
 
+// Accept handshakes with a peer that connected to us. Their handshake is read first so that known can
+// check we're serving the info hash they asked for before we reply. The caller owns conn and should
+// close it if an error is returned.
+func Accept(conn net.Conn, known func(infoHash [20]byte) bool) (*Client, [20]byte, error) {
+	conn.SetDeadline(time.Now().Add(DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	res := make([]byte, 68)
+	_, err := io.ReadFull(conn, res)
+	if err != nil {
+		return nil, [20]byte{}, err
+	}
+	hr := Handshake{}
+	if err := hr.Deserialize(res); err != nil {
+		return nil, [20]byte{}, fmt.Errorf("%s: %w", conn.RemoteAddr(), err)
+	}
+	if !known(hr.InfoHash) {
+		return nil, hr.InfoHash, fmt.Errorf("%s: peer asked for unknown infohash %x", conn.RemoteAddr(), hr.InfoHash)
+	}
+	p := [20]byte{}
+	copy(p[:], PeerID)
+	h := Handshake{
+		Pstr:     protocol,
+		Reserved: Supported,
+		InfoHash: hr.InfoHash,
+		PeerID:   p,
+	}
+	_, err = conn.Write(h.Serialize())
+	if err != nil {
+		return nil, hr.InfoHash, err
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, hr.InfoHash, fmt.Errorf("unexpected remote address type %T", conn.RemoteAddr())
+	}
+	return &Client{
+		Conn:     conn,
+		Choked:   true,
+		Bitfield: nil,
+		Peer:     Peer{IP: addr.IP, Port: uint16(addr.Port)},
+		PeerID:   hr.PeerID,
+		InfoHash: hr.InfoHash,
+
+		Capabilities: hr.Reserved,
+	}, hr.InfoHash, nil
+}
+
+// logf logs to c.Logger, if there is one
+func (c *Client) logf(format string, args ...any) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+	}
+}
+
 // HandleMessage updates the Client state based on the message received. It returns the message for
 // optional further processing.
 func (c *Client) HandleMessage() (*message.Message, error) {
-	msg, err := message.ReadMessage(c.Conn)
+	msg, err := c.ReadMessage()
 	if err != nil {
 		return nil, err
 	}
 	if msg == nil {
-		fmt.Printf("%s: received keepalive message\n", c.Peer.String())
+		c.logf("%s: received keepalive message\n", c.Peer.String())
 		return nil, nil
 	}
 	switch msg.ID {
 	case message.MsgBitfield:
-		fmt.Printf("%s: received bitfield message\n", c.Peer.String())
-		c.Bitfield = msg.Payload
+		c.logf("%s: received bitfield message\n", c.Peer.String())
+		bf, err := message.ParseBitfield(msg, c.NumPieces)
+		if err != nil {
+			return nil, err
+		}
+		c.Bitfield = bf
 	case message.MsgUnchoke:
-		fmt.Printf("%s: received unchoke message\n", c.Peer.String())
+		c.logf("%s: received unchoke message\n", c.Peer.String())
 		c.Choked = false
 	case message.MsgChoke:
-		fmt.Printf("%s: received choke message\n", c.Peer.String())
+		c.logf("%s: received choke message\n", c.Peer.String())
 		c.Choked = true
 	case message.MsgHave:
-		fmt.Printf("%s: received have message\n", c.Peer.String())
-		index := binary.BigEndian.Uint32(msg.Payload)
-		c.Bitfield.SetPiece(int(index))
-		// case message.MsgPiece:
-		// 	fmt.Printf("%s: received piece message\n", c.Peer.String())
+		c.logf("%s: received have message\n", c.Peer.String())
+		index, err := message.ParseHave(msg, c.NumPieces)
+		if err != nil {
+			return nil, err
+		}
+		if c.Bitfield == nil {
+			// peers with nothing to start with needn't send a bitfield
+			c.Bitfield = bitfield.New(c.NumPieces)
+		}
+		c.Bitfield.SetPiece(index)
 	}
 	return msg, nil
 }
 
-// request: <len=0013><id=6><index><begin><length>
-func (c *Client) SendRequest(index, begin, length int) error {
-	p := make([]byte, 12)
-	binary.BigEndian.PutUint32(p[0:4], uint32(index))
-	binary.BigEndian.PutUint32(p[4:8], uint32(begin))
-	binary.BigEndian.PutUint32(p[8:12], uint32(length))
-	m := message.Message{
-		ID:      message.MsgRequest,
-		Payload: p,
+// ReadMessage reads the next message from the peer without acting on it. Returns nil for a
+// keepalive.
+func (c *Client) ReadMessage() (*message.Message, error) {
+	msg, err := message.ReadMessage(c.Conn)
+	if err == nil {
+		c.amu.Lock()
+		c.lastRead = time.Now()
+		c.amu.Unlock()
+	}
+	return msg, err
+}
+
+// Send writes a message to the peer straight away, along with anything queued before it
+func (c *Client) Send(m message.Typed) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.queue(m); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+// Queue buffers a message to go out with the next Send or Flush, so runs of small messages like
+// requests are sent in one write
+func (c *Client) Queue(m message.Typed) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.queue(m)
+}
+
+// Flush sends any queued messages
+func (c *Client) Flush() error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.flush()
+}
+
+// queue must be called with c.wmu held
+func (c *Client) queue(m message.Typed) error {
+	if c.w == nil {
+		c.w = message.NewWriter(connWriter{c})
+	}
+	return c.w.Write(m)
+}
+
+// flush must be called with c.wmu held
+func (c *Client) flush() error {
+	if c.w == nil {
+		return nil
 	}
-	_, err := c.Conn.Write(m.Serialize())
-	return err
+	return c.w.Flush()
+}
+
+// connWriter writes to the client's current connection, recording when it last did
+type connWriter struct {
+	c *Client
+}
+
+func (w connWriter) Write(p []byte) (int, error) {
+	w.c.amu.Lock()
+	w.c.lastWrite = time.Now()
+	w.c.amu.Unlock()
+	return w.c.Conn.Write(p)
+}
+
+func (c *Client) SendHave(index int) error {
+	return c.Send(message.Have{Index: index})
 }
 
 func (c *Client) Connect() (io.ReadWriteCloser, error) {
-	conn, err := net.DialTimeout("tcp", c.Peer.String(), 3*time.Second)
+	conn, err := Dial(c.Peer)
 	if err != nil {
 		return nil, err
 	}
@@ -109,7 +275,9 @@ func doHandshake(rw io.ReadWriter, h Handshake, p Peer) (Handshake, error) {
 		return Handshake{}, err
 	}
 	hr := Handshake{}
-	hr.Deserialize(res)
+	if err := hr.Deserialize(res); err != nil {
+		return Handshake{}, fmt.Errorf("%s: %w", p.String(), err)
+	}
 	if hr.InfoHash != h.InfoHash {
 		return Handshake{}, fmt.Errorf("%s: infohash from peer (%s) doesn't match what we asked for (%s)\n",
 			p.String(), hr.InfoHash, h.InfoHash)
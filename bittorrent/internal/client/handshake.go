@@ -1,8 +1,14 @@
 package client
 
+import "fmt"
+
+// protocol is the protocol identifier every handshake starts with
+const protocol = "BitTorrent protocol"
+
 // Handshake is a special message that a peer uses to identify itself
 type Handshake struct {
-	Pstr     string // protocol identifier
+	Pstr     string       // protocol identifier
+	Reserved Capabilities // the extensions the sender supports
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
@@ -13,20 +19,31 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	copy(buf[curr:], h.PeerID[:])
 	return buf
 }
 
-// Read parses a handshake from a stream
-func (h *Handshake) Deserialize(buf []byte) {
-	pstrLen := int(buf[0])
+// Deserialize parses a handshake read from a peer. Only the standard protocol identifier is
+// accepted, as the rest of the handshake can't be found without trusting the length prefix.
+func (h *Handshake) Deserialize(buf []byte) error {
+	if len(buf) == 0 || int(buf[0]) != len(protocol) {
+		return fmt.Errorf("handshake has an unexpected protocol identifier length")
+	}
+	if len(buf) < len(protocol)+49 {
+		return fmt.Errorf("handshake too short, %d bytes", len(buf))
+	}
 	buf = buf[1:]
-	h.Pstr = string(buf[:pstrLen])
-	buf = buf[pstrLen:]
-	buf = buf[8:] // skip reserved
+	if string(buf[:len(protocol)]) != protocol {
+		return fmt.Errorf("handshake is for protocol %q", buf[:len(protocol)])
+	}
+	h.Pstr = protocol
+	buf = buf[len(protocol):]
+	copy(h.Reserved[:], buf[:8])
+	buf = buf[8:]
 	copy(h.InfoHash[:], buf[:20])
 	buf = buf[20:]
 	copy(h.PeerID[:], buf[:20])
+	return nil
 }
@@ -1,6 +1,7 @@
 package client
 
 import (
+	"net"
 	"testing"
 )
 
@@ -13,7 +14,9 @@ func TestHandshakeRoundTrip(t *testing.T) {
 	// test round trip
 	data := h1.Serialize()
 	h2 := Handshake{}
-	h2.Deserialize(data)
+	if err := h2.Deserialize(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
 	if h1.Pstr != h2.Pstr {
 		t.Errorf("Pstr mismatch: got %q, want %q", h2.Pstr, h1.Pstr)
 	}
@@ -24,3 +27,85 @@ func TestHandshakeRoundTrip(t *testing.T) {
 		t.Errorf("PeerID mismatch: got %x, want %x", h2.PeerID, h1.PeerID)
 	}
 }
+
+func TestHandshakeCapabilities(t *testing.T) {
+	h1 := Handshake{Pstr: "BitTorrent protocol", Reserved: NewCapabilities(CapDHT, CapExtensions)}
+	h1.Reserved[0] = 0x80 // a bit we don't know about should survive too
+	data := h1.Serialize()
+	if data[20+5] != 0x10 || data[20+7] != 0x01 {
+		t.Errorf("expected extension and dht bits in reserved bytes, got %x", data[20:28])
+	}
+	h2 := Handshake{}
+	if err := h2.Deserialize(data); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if h2.Reserved != h1.Reserved {
+		t.Errorf("Reserved mismatch: got %x, want %x", h2.Reserved, h1.Reserved)
+	}
+	if !h2.Reserved.Has(CapDHT) || !h2.Reserved.Has(CapExtensions) || h2.Reserved.Has(CapFast) {
+		t.Errorf("expected dht and extensions only, got %s", h2.Reserved)
+	}
+	if s := h2.Reserved.String(); s != "extensions,dht" {
+		t.Errorf("expected capabilities extensions,dht, got %s", s)
+	}
+	if s := (Capabilities{}).String(); s != "none" {
+		t.Errorf("expected no capabilities, got %s", s)
+	}
+}
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"-qB4630-abcdefghijkl", "qBittorrent 4.6.3.0"},
+		{"-TR2940-abcdefghijkl", "Transmission 2.9.4.0"},
+		{"-XX0100-abcdefghijkl", "unknown client XX 0.1.0.0"},
+		{"S58B-----abcdefghijk", "Shadow 5.8.11"},
+		{"T03I--00abcdefghijkl", "BitTornado 0.3.18"},
+		{"M4-3-6--abcdefghijkl", "Mainline 4.3.6"},
+		{"paulsbittorentclient", `unknown client "paulsbit"`},
+		{"\x00\x01abcdefghijklmnopqr", `unknown client ""`},
+	}
+	for _, tt := range tests {
+		id := [20]byte{}
+		copy(id[:], tt.id)
+		if have := ClientName(id); have != tt.want {
+			t.Errorf("ClientName(%q) = %q, want %q", tt.id, have, tt.want)
+		}
+	}
+}
+
+func TestHandshakeMalformed(t *testing.T) {
+	good := (&Handshake{Pstr: "BitTorrent protocol"}).Serialize()
+	long := append([]byte{}, good...)
+	long[0] = 200
+	other := append([]byte{}, good...)
+	copy(other[1:], "BitTorrent protocoL")
+	for name, buf := range map[string][]byte{
+		"empty":      nil,
+		"long pstr":  long,
+		"short pstr": append([]byte{3}, good[1:]...),
+		"other pstr": other,
+		"truncated":  good[:40],
+	} {
+		if err := (&Handshake{}).Deserialize(buf); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestAcceptMalformedHandshake(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	go func() {
+		buf := make([]byte, 68)
+		buf[0] = 0xff // a pstrlen that runs past the end of the handshake
+		theirs.Write(buf)
+	}()
+	_, _, err := Accept(ours, func([20]byte) bool { return true })
+	if err == nil {
+		t.Errorf("expected an error accepting a malformed handshake")
+	}
+}
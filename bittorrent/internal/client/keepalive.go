@@ -0,0 +1,71 @@
+package client
+
+import (
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/message"
+)
+
+// KeepAliveInterval is how long we let a connection go without sending anything before sending a
+// keepalive, so the peer doesn't give up on us
+const KeepAliveInterval = 2 * time.Minute
+
+// DefaultIdleTimeout is how long we wait to hear anything from a peer before disconnecting. Peers
+// send keepalives every two minutes, which leaves room for one to be late.
+const DefaultIdleTimeout = 3 * time.Minute
+
+// keepAliveInterval is KeepAliveInterval, shortened by tests
+var keepAliveInterval = KeepAliveInterval
+
+// KeepAlive runs the connection's writer loop until stop is called: it sends a keepalive whenever
+// we've been quiet for KeepAliveInterval, and closes the connection if the peer has been silent
+// for longer than idleTimeout, which unblocks anything reading from it. Conn mustn't be replaced
+// once it's started.
+func (c *Client) KeepAlive(idleTimeout time.Duration) (stop func()) {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	c.amu.Lock()
+	if c.lastRead.IsZero() {
+		c.lastRead = time.Now()
+	}
+	if c.lastWrite.IsZero() {
+		c.lastWrite = time.Now()
+	}
+	c.amu.Unlock()
+	check := keepAliveInterval
+	if idleTimeout < check {
+		check = idleTimeout
+	}
+	ticker := time.NewTicker(check / 4)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			c.amu.Lock()
+			silent, quiet := time.Since(c.lastRead), time.Since(c.lastWrite)
+			c.amu.Unlock()
+			if silent > idleTimeout {
+				c.logf("%s: nothing heard for over %v, disconnecting\n", c.Peer.String(), idleTimeout)
+				c.Conn.Close()
+				return
+			}
+			if quiet >= keepAliveInterval {
+				if err := c.Send(message.KeepAlive{}); err != nil {
+					return // whoever's using the connection will see the error too
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
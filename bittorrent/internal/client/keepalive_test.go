@@ -0,0 +1,47 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	keepAliveInterval = 20 * time.Millisecond
+	defer func() { keepAliveInterval = KeepAliveInterval }()
+	ours, theirs := net.Pipe()
+	defer ours.Close()
+	defer theirs.Close()
+	c := &Client{Conn: ours}
+	stop := c.KeepAlive(time.Hour)
+	defer stop()
+	theirs.SetDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(theirs, buf); err != nil || !bytes.Equal(buf, []byte{0, 0, 0, 0}) {
+		t.Errorf("expected a keepalive after a quiet spell, got %v (%v)", buf, err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	ours, theirs := net.Pipe()
+	defer theirs.Close()
+	c := &Client{Conn: ours}
+	stop := c.KeepAlive(50 * time.Millisecond)
+	defer stop()
+	start := time.Now()
+	done := make(chan error)
+	go func() {
+		_, err := c.ReadMessage()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || time.Since(start) < 50*time.Millisecond {
+			t.Errorf("expected the connection to be closed after the idle timeout, got %v after %v", err, time.Since(start))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a silent peer to be disconnected")
+	}
+}
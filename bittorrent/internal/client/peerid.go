@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// azureusClients maps the two letter codes of Azureus style peer ids, like -qB4630-, to client names
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+	"UM": "µTorrent Mac",
+	"WW": "WebTorrent",
+}
+
+// shadowClients maps the first letter of Shadow style peer ids, like S58B-----, to client names
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigits are the characters of a Shadow style version, each worth its index
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// ClientName decodes the client and version from a peer id. Ids in a style we don't recognise are
+// described by their printable prefix.
+func ClientName(id [20]byte) string {
+	if id[0] == '-' && id[7] == '-' {
+		code := string(id[1:3])
+		name, ok := azureusClients[code]
+		if !ok {
+			name = "unknown client " + code
+		}
+		version := []string{}
+		for _, b := range id[3:7] {
+			version = append(version, string(b))
+		}
+		return name + " " + strings.Join(version, ".")
+	}
+	if name, ok := shadowClients[id[0]]; ok {
+		if version, ok := shadowVersion(id[1:7]); ok {
+			return name + " " + version
+		}
+	}
+	if id[0] == 'M' {
+		// Mainline, like M4-3-6--
+		if parts := strings.SplitN(strings.TrimRight(string(id[1:8]), "-"), "-", 3); len(parts) == 3 {
+			return "Mainline " + strings.Join(parts, ".")
+		}
+	}
+	return unknownClient(id)
+}
+
+// shadowVersion decodes up to five version characters, which must be followed by a '-'
+func shadowVersion(b []byte) (string, bool) {
+	version := []string{}
+	for _, c := range b {
+		if c == '-' {
+			return strings.Join(version, "."), len(version) > 0
+		}
+		v := strings.IndexByte(shadowDigits, c)
+		if v == -1 {
+			return "", false
+		}
+		version = append(version, fmt.Sprint(v))
+	}
+	return "", false
+}
+
+func unknownClient(id [20]byte) string {
+	prefix := []byte{}
+	for _, b := range id[:8] {
+		if b < 0x20 || b > 0x7e {
+			break
+		}
+		prefix = append(prefix, b)
+	}
+	return fmt.Sprintf("unknown client %q", prefix)
+}
+
+// ClientName decodes the peer's client from its peer id
+func (c *Client) ClientName() string {
+	return ClientName(c.PeerID)
+}
@@ -0,0 +1,393 @@
+// Package connmgr decides which peers a torrent is connected to. It keeps a pool of known peers,
+// dials them within the configured limits, retries failures with exponential backoff and replaces
+// connections as they die.
+package connmgr
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/ratelimit"
+)
+
+// Config controls how a single torrent uses the connections it's allowed
+type Config struct {
+	MaxConns    int           // connections for this torrent
+	BackoffBase time.Duration // wait after the first failure, doubled for each failure after that
+	BackoffMax  time.Duration
+	MaxAttempts int // consecutive failures before we give up on a peer
+
+	// IdleTimeout is how long a peer can go without sending anything, or keep us choked with
+	// nothing we want, before it's disconnected. client.DefaultIdleTimeout if zero.
+	IdleTimeout time.Duration
+}
+
+// stableConn is how long a connection has to last before the peer's failures are forgiven, so that
+// a peer which accepts and then immediately drops us is eventually given up on
+const stableConn = time.Minute
+
+var DefaultConfig = Config{
+	MaxConns:    30,
+	BackoffBase: 5 * time.Second,
+	BackoffMax:  5 * time.Minute,
+	MaxAttempts: 6,
+	IdleTimeout: client.DefaultIdleTimeout,
+}
+
+// DefaultLimits returns the limits used when a torrent isn't sharing them with anything else
+func DefaultLimits() *Limits {
+	return NewLimits(200, 20, 8)
+}
+
+type peerState struct {
+	peer        client.Peer
+	failures    int
+	nextAttempt time.Time
+	connectedAt time.Time
+	dialing     bool
+	connected   bool
+	dropped     bool // we've given up on this peer
+	inbound     bool // the peer connected to us, so its address isn't one we can dial
+}
+
+// Manager owns the connections for one torrent
+type Manager struct {
+	limits   *Limits
+	cfg      Config
+	infoHash [20]byte
+	logger   *log.Logger // nil to discard diagnostics
+	handle   func(*client.Client)
+
+	// dialing is split from handshaking so the half-open limit only covers the TCP connect
+	dial      func(client.Peer) (net.Conn, error)
+	handshake func(net.Conn, client.Peer, [20]byte) (*client.Client, error)
+
+	mu       sync.Mutex
+	down, up *ratelimit.Limiter // nil for no limit
+	known    map[string]*peerState
+	active   map[[20]byte]*client.Client // keyed by remote peer id
+	banned   map[string]bool             // keyed by IP
+	conns    int                         // established connections plus attempts in progress
+	closed   bool
+
+	wakeup chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+// New creates a manager for the swarm of infoHash. Diagnostics about its connections go to logger,
+// which may be nil to discard them.
+func New(limits *Limits, cfg Config, infoHash [20]byte, logger *log.Logger) *Manager {
+	return &Manager{
+		limits:    limits,
+		cfg:       cfg,
+		infoHash:  infoHash,
+		logger:    logger,
+		dial:      client.Dial,
+		handshake: client.NewClientFromConn,
+		known:     map[string]*peerState{},
+		active:    map[[20]byte]*client.Client{},
+		banned:    map[string]bool{},
+		wakeup:    make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// SetRateLimits throttles connections made or accepted from now on. Either may be nil for no limit.
+func (m *Manager) SetRateLimits(down, up *ratelimit.Limiter) {
+	m.mu.Lock()
+	m.down, m.up = down, up
+	m.mu.Unlock()
+}
+
+// AddPeers adds peers to the pool of candidates we can connect to
+func (m *Manager) AddPeers(peers []client.Peer) {
+	m.mu.Lock()
+	for _, p := range peers {
+		if m.banned[p.IP.String()] {
+			continue
+		}
+		if _, ok := m.known[p.String()]; !ok {
+			m.known[p.String()] = &peerState{peer: p}
+		}
+	}
+	m.mu.Unlock()
+	poke(m.wakeup)
+}
+
+// Start begins dialing peers. handle is called in its own goroutine for each connected peer, and
+// the connection is closed and replaced once it returns.
+func (m *Manager) Start(handle func(*client.Client)) {
+	m.mu.Lock()
+	m.handle = handle
+	m.mu.Unlock()
+	m.wg.Add(1)
+	go m.run()
+}
+
+// Close stops dialing, closes every connection and waits for their handlers to return
+func (m *Manager) Close() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	m.closed = true
+	for _, c := range m.active {
+		c.Conn.Close()
+	}
+	m.mu.Unlock()
+	close(m.done)
+	m.wg.Wait()
+}
+
+// AddConn hands the manager a connection that a peer opened to us. It returns false, leaving the
+// caller to close the connection, if we're at our limits or don't want the peer.
+func (m *Manager) AddConn(c *client.Client) bool {
+	if !m.limits.reserveConn() {
+		return false
+	}
+	m.mu.Lock()
+	_, dup := m.active[c.PeerID]
+	if m.closed || m.handle == nil || dup || m.banned[c.Peer.IP.String()] || m.conns >= m.cfg.MaxConns {
+		m.mu.Unlock()
+		m.limits.releaseConn()
+		return false
+	}
+	ps := &peerState{peer: c.Peer, inbound: true, connected: true, connectedAt: time.Now()}
+	m.known[c.Peer.String()] = ps
+	m.throttle(c)
+	m.active[c.PeerID] = c
+	m.conns++
+	m.wg.Add(1)
+	m.mu.Unlock()
+	go func() {
+		defer m.wg.Done()
+		m.handle(c)
+		// forget the peer before hanging up, so it isn't taken for a duplicate if it reconnects as
+		// soon as it sees the connection close
+		m.unregister(ps, c)
+		c.Conn.Close()
+	}()
+	return true
+}
+
+// Ban disconnects every connection to ip and stops us connecting to it again
+func (m *Manager) Ban(ip net.IP) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.banned[ip.String()] = true
+	for _, ps := range m.known {
+		if ps.peer.IP.Equal(ip) {
+			ps.dropped = true
+		}
+	}
+	for _, c := range m.active {
+		if c.Peer.IP.Equal(ip) {
+			c.Conn.Close()
+		}
+	}
+}
+
+// Exhausted reports whether there's no one left to connect to: nothing is connected or being
+// dialed, and every known peer has been given up on
+func (m *Manager) Exhausted() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.conns > 0 {
+		return false
+	}
+	for _, ps := range m.known {
+		if !ps.dropped {
+			return false
+		}
+	}
+	return true
+}
+
+// NumConns returns the number of established connections
+func (m *Manager) NumConns() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.active)
+}
+
+func (m *Manager) run() {
+	defer m.wg.Done()
+	m.limits.subscribe(m.wakeup)
+	defer m.limits.unsubscribe(m.wakeup)
+	for {
+		var retry <-chan time.Time
+		var timer *time.Timer
+		if wait := m.dialEligible(); wait > 0 {
+			timer = time.NewTimer(wait)
+			retry = timer.C
+		}
+		select {
+		case <-m.done:
+		case <-m.wakeup:
+		case <-retry:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-m.done:
+			return
+		default:
+		}
+	}
+}
+
+// dialEligible starts connection attempts to as many peers as the limits allow. It returns how long
+// until the next peer in backoff becomes eligible, or 0 if there's nothing to wait for.
+func (m *Manager) dialEligible() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, ps := range m.known {
+		if ps.dialing || ps.connected || ps.dropped {
+			continue
+		}
+		if d := ps.nextAttempt.Sub(now); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		if m.conns >= m.cfg.MaxConns || !m.limits.reserveDial() {
+			break
+		}
+		ps.dialing = true
+		m.conns++
+		m.wg.Add(1)
+		go m.connect(ps)
+	}
+	return wait
+}
+
+func (m *Manager) connect(ps *peerState) {
+	defer m.wg.Done()
+	m.limits.acquireHalfOpen()
+	conn, err := m.dial(ps.peer)
+	m.limits.releaseHalfOpen()
+	var c *client.Client
+	if err == nil {
+		c, err = m.handshake(conn, ps.peer, m.infoHash)
+		if err != nil {
+			conn.Close()
+		} else {
+			c.Logger = m.logger
+		}
+	}
+	m.limits.finishDial(err == nil)
+	if err != nil {
+		m.logf("%s: error connecting to peer: %v\n", ps.peer.String(), err)
+		m.mu.Lock()
+		ps.dialing = false
+		m.conns--
+		m.backoff(ps)
+		m.mu.Unlock()
+		poke(m.wakeup)
+		return
+	}
+	if !m.register(ps, c) {
+		c.Conn.Close()
+		m.limits.releaseConn()
+		return
+	}
+	m.handle(c)
+	m.unregister(ps, c)
+	c.Conn.Close()
+}
+
+// register records a successful connection, refusing it if we're shutting down or already
+// connected to the same peer id under another address
+func (m *Manager) register(ps *peerState, c *client.Client) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ps.dialing = false
+	if m.closed {
+		m.conns--
+		return false
+	}
+	if _, dup := m.active[c.PeerID]; dup {
+		m.logf("%s: already connected to peer id %x (%s), dropping duplicate\n", ps.peer.String(), c.PeerID, c.ClientName())
+		ps.dropped = true
+		m.conns--
+		return false
+	}
+	ps.connected = true
+	ps.connectedAt = time.Now()
+	m.throttle(c)
+	m.active[c.PeerID] = c
+	m.logf("%s: connected to %s, capabilities %s\n", ps.peer.String(), c.ClientName(), c.Capabilities)
+	return true
+}
+
+// throttle applies the rate limits to a connection. It has to happen before the connection is
+// registered, as Close and Ban close whatever c.Conn is from then on. Must be called with m.mu held.
+func (m *Manager) throttle(c *client.Client) {
+	if m.down != nil || m.up != nil {
+		c.Conn = ratelimit.NewConn(c.Conn, m.down, m.up)
+	}
+}
+
+// unregister frees the slot held by a dead connection and schedules a reconnect to the peer. The
+// freed slot is offered to whichever known peer is eligible first.
+func (m *Manager) unregister(ps *peerState, c *client.Client) {
+	m.mu.Lock()
+	delete(m.active, c.PeerID)
+	ps.connected = false
+	m.conns--
+	if ps.inbound {
+		ps.dropped = true
+		m.mu.Unlock()
+		m.limits.releaseConn()
+		return
+	}
+	if time.Since(ps.connectedAt) >= stableConn {
+		ps.failures = 0
+	}
+	m.backoff(ps)
+	m.mu.Unlock()
+	m.limits.releaseConn()
+}
+
+// backoff records a failure against the peer and schedules its next attempt. Must be called with
+// m.mu held.
+func (m *Manager) backoff(ps *peerState) {
+	ps.failures++
+	if ps.failures >= m.cfg.MaxAttempts {
+		m.logf("%s: giving up on peer after %d attempts\n", ps.peer.String(), ps.failures)
+		ps.dropped = true
+		return
+	}
+	ps.nextAttempt = time.Now().Add(m.cfg.Backoff(ps.failures))
+}
+
+// logf logs to m.logger, if there is one
+func (m *Manager) logf(format string, args ...any) {
+	if m.logger != nil {
+		m.logger.Printf(format, args...)
+	}
+}
+
+// Backoff returns how long to wait before retrying a peer that has failed n times in a row
+func (c Config) Backoff(n int) time.Duration {
+	d := c.BackoffBase
+	for i := 1; i < n && d < c.BackoffMax; i++ {
+		d *= 2
+	}
+	if d > c.BackoffMax {
+		d = c.BackoffMax
+	}
+	return d
+}
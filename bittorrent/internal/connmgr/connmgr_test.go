@@ -0,0 +1,216 @@
+package connmgr
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/ratelimit"
+)
+
+func TestBackoff(t *testing.T) {
+	cfg := Config{BackoffBase: time.Second, BackoffMax: 10 * time.Second}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{20, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if have := cfg.Backoff(tt.failures); have != tt.want {
+			t.Errorf("backoff after %d failures: expected %v, got %v", tt.failures, tt.want, have)
+		}
+	}
+}
+
+func testPeers(n int) []client.Peer {
+	peers := make([]client.Peer, n)
+	for i := range peers {
+		peers[i] = client.Peer{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 6881}
+	}
+	return peers
+}
+
+// fakeManager returns a manager whose dials succeed instantly, giving each peer the id returned by
+// peerID
+func fakeManager(limits *Limits, cfg Config, peerID func(client.Peer) [20]byte) *Manager {
+	m := New(limits, cfg, [20]byte{}, nil)
+	m.dial = func(p client.Peer) (net.Conn, error) {
+		c1, _ := net.Pipe()
+		return c1, nil
+	}
+	m.handshake = func(conn net.Conn, p client.Peer, _ [20]byte) (*client.Client, error) {
+		return &client.Client{Conn: conn, Peer: p, PeerID: peerID(p)}, nil
+	}
+	return m
+}
+
+func uniqueID(p client.Peer) [20]byte {
+	id := [20]byte{}
+	copy(id[:], p.String())
+	return id
+}
+
+// waitFor polls cond until it's true or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPerTorrentLimit(t *testing.T) {
+	cfg := DefaultConfig
+	cfg.MaxConns = 3
+	m := fakeManager(NewLimits(100, 100, 100), cfg, uniqueID)
+	release := make(chan struct{})
+	m.Start(func(c *client.Client) { <-release })
+	m.AddPeers(testPeers(10))
+	waitFor(t, func() bool { return m.NumConns() == 3 })
+	time.Sleep(20 * time.Millisecond)
+	if n := m.NumConns(); n != 3 {
+		t.Errorf("expected 3 connections, got %d", n)
+	}
+	close(release)
+	m.Close()
+}
+
+func TestSharedLimit(t *testing.T) {
+	limits := NewLimits(4, 100, 100)
+	release := make(chan struct{})
+	m1 := fakeManager(limits, DefaultConfig, uniqueID)
+	m2 := fakeManager(limits, DefaultConfig, uniqueID)
+	m1.Start(func(c *client.Client) { <-release })
+	m2.Start(func(c *client.Client) { <-release })
+	m1.AddPeers(testPeers(10))
+	m2.AddPeers(testPeers(10))
+	waitFor(t, func() bool { return m1.NumConns()+m2.NumConns() == 4 })
+	time.Sleep(20 * time.Millisecond)
+	if n := m1.NumConns() + m2.NumConns(); n != 4 {
+		t.Errorf("expected 4 connections across both torrents, got %d", n)
+	}
+	close(release)
+	m1.Close()
+	m2.Close()
+}
+
+func TestDuplicatePeerID(t *testing.T) {
+	m := fakeManager(DefaultLimits(), DefaultConfig, func(client.Peer) [20]byte { return [20]byte{1} })
+	release := make(chan struct{})
+	m.Start(func(c *client.Client) { <-release })
+	m.AddPeers(testPeers(5))
+	waitFor(t, func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		dropped := 0
+		for _, ps := range m.known {
+			if ps.dropped {
+				dropped++
+			}
+		}
+		return dropped == 4
+	})
+	if n := m.NumConns(); n != 1 {
+		t.Errorf("expected a single connection to the duplicated peer id, got %d", n)
+	}
+	close(release)
+	m.Close()
+}
+
+func TestRetryAndReplace(t *testing.T) {
+	cfg := Config{MaxConns: 1, BackoffBase: time.Millisecond, BackoffMax: time.Millisecond, MaxAttempts: 3}
+	m := fakeManager(DefaultLimits(), cfg, uniqueID)
+	var mu sync.Mutex
+	attempts := map[string]int{}
+	dial := m.dial
+	m.dial = func(p client.Peer) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts[p.String()]++
+		if p.IP.Equal(net.IPv4(10, 0, 0, 1)) {
+			return nil, errors.New("connection refused")
+		}
+		return dial(p)
+	}
+	handled := make(chan client.Peer, 10)
+	m.Start(func(c *client.Client) { handled <- c.Peer })
+	m.AddPeers(testPeers(2))
+	// each connection dies as soon as it's handled, so the good peer is reconnected until it's
+	// used up its attempts, and the bad peer is retried until it's dropped
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return attempts["10.0.0.1:6881"] == cfg.MaxAttempts && attempts["10.0.0.2:6881"] == cfg.MaxAttempts
+	})
+	m.Close()
+	if len(handled) != cfg.MaxAttempts {
+		t.Errorf("expected the good peer to be handled %d times, got %d", cfg.MaxAttempts, len(handled))
+	}
+}
+
+func TestBan(t *testing.T) {
+	m := fakeManager(DefaultLimits(), DefaultConfig, uniqueID)
+	release := make(chan struct{})
+	m.Start(func(c *client.Client) {
+		select {
+		case <-release:
+		case <-waitClosed(c):
+		}
+	})
+	peers := testPeers(2)
+	m.AddPeers(peers)
+	waitFor(t, func() bool { return m.NumConns() == 2 })
+	m.Ban(peers[0].IP)
+	waitFor(t, func() bool { return m.NumConns() == 1 })
+	m.AddPeers(peers[:1])
+	time.Sleep(20 * time.Millisecond)
+	if n := m.NumConns(); n != 1 {
+		t.Errorf("expected banned peer not to be reconnected, got %d connections", n)
+	}
+	close(release)
+	m.Close()
+}
+
+func TestRateLimits(t *testing.T) {
+	m := fakeManager(DefaultLimits(), DefaultConfig, uniqueID)
+	m.SetRateLimits(ratelimit.NewLimiter(1<<20), nil)
+	conns := make(chan net.Conn, 2)
+	m.Start(func(c *client.Client) {
+		conns <- c.Conn
+		<-waitClosed(c)
+	})
+	m.AddPeers(testPeers(1))
+	in, _ := net.Pipe()
+	if !m.AddConn(&client.Client{Conn: in, Peer: client.Peer{IP: net.IPv4(10, 0, 1, 1), Port: 1}, PeerID: [20]byte{1}}) {
+		t.Fatalf("expected an inbound connection to be accepted")
+	}
+	for i := 0; i < 2; i++ {
+		if _, ok := (<-conns).(*ratelimit.Conn); !ok {
+			t.Errorf("expected the handler to be given a throttled connection")
+		}
+	}
+	// the handlers only return once Close has closed the throttled connections
+	m.Close()
+}
+
+// waitClosed returns a channel that's closed once the client's connection has been closed
+func waitClosed(c *client.Client) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		c.Conn.Read(make([]byte, 1))
+		close(done)
+	}()
+	return done
+}
@@ -0,0 +1,100 @@
+package connmgr
+
+import "sync"
+
+// Limits caps connections and connection attempts across every torrent that shares it
+type Limits struct {
+	maxConns int
+	maxDials int
+	halfOpen chan struct{} // semaphore for TCP connects that haven't completed yet
+
+	mu      sync.Mutex
+	conns   int // established connections plus attempts that have reserved a slot
+	dials   int // attempts in progress, from TCP connect through to handshake
+	waiters map[chan struct{}]struct{}
+}
+
+// NewLimits returns limits allowing at most maxConns connections in total, maxDials concurrent
+// connection attempts and maxHalfOpen concurrent TCP connects that haven't been accepted yet
+func NewLimits(maxConns, maxDials, maxHalfOpen int) *Limits {
+	return &Limits{
+		maxConns: maxConns,
+		maxDials: maxDials,
+		halfOpen: make(chan struct{}, maxHalfOpen),
+		waiters:  map[chan struct{}]struct{}{},
+	}
+}
+
+// reserveDial takes a connection slot and a dial slot if both are available
+func (l *Limits) reserveDial() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns >= l.maxConns || l.dials >= l.maxDials {
+		return false
+	}
+	l.conns++
+	l.dials++
+	return true
+}
+
+// reserveConn takes a connection slot for a connection that didn't need dialing
+func (l *Limits) reserveConn() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns >= l.maxConns {
+		return false
+	}
+	l.conns++
+	return true
+}
+
+// finishDial gives back the dial slot, and the connection slot too if the attempt failed
+func (l *Limits) finishDial(connected bool) {
+	l.mu.Lock()
+	l.dials--
+	if !connected {
+		l.conns--
+	}
+	l.mu.Unlock()
+	l.wake()
+}
+
+func (l *Limits) releaseConn() {
+	l.mu.Lock()
+	l.conns--
+	l.mu.Unlock()
+	l.wake()
+}
+
+func (l *Limits) acquireHalfOpen() { l.halfOpen <- struct{}{} }
+func (l *Limits) releaseHalfOpen() { <-l.halfOpen }
+
+// subscribe registers a channel that is poked whenever a slot frees up, so a manager blocked on
+// the shared limits can be woken by another torrent's connection closing
+func (l *Limits) subscribe(c chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waiters[c] = struct{}{}
+}
+
+func (l *Limits) unsubscribe(c chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.waiters, c)
+}
+
+func (l *Limits) wake() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for c := range l.waiters {
+		poke(c)
+	}
+}
+
+// poke does a non-blocking send on a wakeup channel with a buffer of one
+func poke(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,257 @@
+// Package lsd finds peers on the local network by multicasting which torrents we have (BEP 14)
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+)
+
+const (
+	// AnnounceInterval is how often each torrent should be announced
+	AnnounceInterval = 5 * time.Minute
+
+	// MinInterval is the least time between two announces of the same torrent, and between two
+	// reports of the same peer
+	MinInterval = time.Minute
+
+	// maxInfoHashes caps how many torrents go in one announce, keeping it within a single packet
+	maxInfoHashes = 20
+)
+
+var (
+	// Group4 and Group6 are the multicast groups announces are sent to
+	Group4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	Group6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// Service announces our torrents on the local network and reports peers announcing theirs
+type Service struct {
+	port   uint16
+	cookie string // sent in our announces so we can ignore our own
+	found  func(infoHash [20]byte, peer client.Peer)
+	groups []group
+	logger *log.Logger // nil to discard diagnostics
+
+	mu       sync.Mutex
+	lastSent map[[20]byte]time.Time
+	lastSeen map[string]time.Time // keyed by peer address and info hash
+	now      func() time.Time     // replaced in tests
+	wg       sync.WaitGroup
+}
+
+// group is a socket listening on a multicast group, and the address announces are sent to
+type group struct {
+	conn net.PacketConn
+	addr *net.UDPAddr
+}
+
+// New joins the IPv4 and IPv6 multicast groups. port is where we accept peers, and found is called
+// for every peer announcing one of the torrents. Only one of the groups needs to be joined for it to
+// succeed, as many networks don't route IPv6 multicast. Bad announces are logged to logger, if it
+// isn't nil.
+func New(port uint16, found func(infoHash [20]byte, peer client.Peer), logger *log.Logger) (*Service, error) {
+	groups := []group{}
+	errs := []string{}
+	for _, g := range []struct {
+		network string
+		addr    *net.UDPAddr
+	}{{"udp4", Group4}, {"udp6", Group6}} {
+		conn, err := net.ListenMulticastUDP(g.network, nil, g.addr)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		groups = append(groups, group{conn, g.addr})
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("error joining multicast groups: %s", strings.Join(errs, ", "))
+	}
+	s := newService(port, found, groups)
+	s.logger = logger
+	s.start()
+	return s, nil
+}
+
+func newService(port uint16, found func([20]byte, client.Peer), groups []group) *Service {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		found:    found,
+		groups:   groups,
+		lastSent: map[[20]byte]time.Time{},
+		lastSeen: map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// start listens for announces on every group
+func (s *Service) start() {
+	for _, g := range s.groups {
+		s.wg.Add(1)
+		go s.listen(g.conn)
+	}
+}
+
+// Announce tells the local network we have the torrents. Torrents announced within the last
+// MinInterval are left out, so it's safe to call as often as convenient. Private torrents mustn't be
+// announced.
+func (s *Service) Announce(infoHashes ...[20]byte) error {
+	s.mu.Lock()
+	now := s.now()
+	due := [][20]byte{}
+	for _, h := range infoHashes {
+		if now.Sub(s.lastSent[h]) >= MinInterval {
+			s.lastSent[h] = now
+			due = append(due, h)
+		}
+	}
+	s.mu.Unlock()
+	var firstErr error
+	for len(due) > 0 {
+		n := len(due)
+		if n > maxInfoHashes {
+			n = maxInfoHashes
+		}
+		for _, g := range s.groups {
+			msg := formatAnnounce(g.addr, s.port, due[:n], s.cookie)
+			if _, err := g.conn.WriteTo(msg, g.addr); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		due = due[n:]
+	}
+	return firstErr
+}
+
+// Close leaves the multicast groups
+func (s *Service) Close() error {
+	var firstErr error
+	for _, g := range s.groups {
+		if err := g.conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.wg.Wait()
+	return firstErr
+}
+
+func (s *Service) listen(conn net.PacketConn) {
+	defer s.wg.Done()
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		a, err := parseAnnounce(buf[:n])
+		if err != nil {
+			if s.logger != nil {
+				s.logger.Printf("%s: ignoring local peer announce: %v\n", addr, err)
+			}
+			continue
+		}
+		if a.cookie == s.cookie {
+			continue // our own announce coming back to us
+		}
+		peer := client.Peer{IP: udpAddr.IP, Port: a.port}
+		for _, h := range a.infoHashes {
+			if s.report(peer, h) {
+				s.found(h, peer)
+			}
+		}
+	}
+}
+
+// report decides whether a peer's announce is news, so a peer announcing too often can't flood the
+// torrent with duplicates
+func (s *Service) report(peer client.Peer, infoHash [20]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	key := peer.String() + string(infoHash[:])
+	if now.Sub(s.lastSeen[key]) < MinInterval {
+		return false
+	}
+	// forget peers we haven't heard from in a while so the map doesn't grow forever
+	for k, seen := range s.lastSeen {
+		if now.Sub(seen) >= MinInterval {
+			delete(s.lastSeen, k)
+		}
+	}
+	s.lastSeen[key] = now
+	return true
+}
+
+// announce is a parsed BT-SEARCH message
+type announce struct {
+	port       uint16
+	infoHashes [][20]byte
+	cookie     string
+}
+
+// formatAnnounce builds a BT-SEARCH message, which is laid out like an HTTP request:
+//
+//	BT-SEARCH * HTTP/1.1
+//	Host: 239.192.152.143:6771
+//	Port: 6881
+//	Infohash: <40 hex characters, repeated for each torrent>
+//	cookie: <opaque value to recognise our own announces>
+func formatAnnounce(to *net.UDPAddr, port uint16, infoHashes [][20]byte, cookie string) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buf.WriteString("Host: " + to.String() + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(int(port)) + "\r\n")
+	for _, h := range infoHashes {
+		buf.WriteString("Infohash: " + hex.EncodeToString(h[:]) + "\r\n")
+	}
+	buf.WriteString("cookie: " + cookie + "\r\n")
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func parseAnnounce(b []byte) (announce, error) {
+	a := announce{}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return a, err
+	}
+	if req.Method != "BT-SEARCH" {
+		return a, fmt.Errorf("unexpected method %q", req.Method)
+	}
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return a, errors.New("missing or invalid port")
+	}
+	a.port = uint16(port)
+	for _, v := range req.Header.Values("Infohash") {
+		h := [20]byte{}
+		if b, err := hex.DecodeString(v); err == nil && len(b) == len(h) {
+			copy(h[:], b)
+			a.infoHashes = append(a.infoHashes, h)
+		}
+	}
+	if len(a.infoHashes) == 0 {
+		return a, errors.New("no valid info hashes")
+	}
+	a.cookie = req.Header.Get("Cookie")
+	return a, nil
+}
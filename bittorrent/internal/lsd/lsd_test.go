@@ -0,0 +1,126 @@
+package lsd
+
+import (
+	"crypto/sha1"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+)
+
+func TestParseAnnounce(t *testing.T) {
+	hashes := [][20]byte{sha1.Sum([]byte("a")), sha1.Sum([]byte("b"))}
+	a, err := parseAnnounce(formatAnnounce(Group4, 6881, hashes, "abc"))
+	if err != nil {
+		t.Fatalf("unexpected error parsing announce: %v", err)
+	}
+	want := announce{port: 6881, infoHashes: hashes, cookie: "abc"}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("expected %+v, got %+v", want, a)
+	}
+
+	invalid := []string{
+		"GET / HTTP/1.1\r\nHost: x\r\nPort: 1\r\nInfohash: 86f7e437faa5a7fce15d1ddcb9eaeaea377667b8\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nInfohash: 86f7e437faa5a7fce15d1ddcb9eaeaea377667b8\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nHost: x\r\nPort: 1\r\nInfohash: 86f7e4\r\n\r\n",
+		"garbage",
+	}
+	for _, msg := range invalid {
+		if _, err := parseAnnounce([]byte(msg)); err == nil {
+			t.Errorf("expected an error parsing %q", msg)
+		}
+	}
+}
+
+// clock is a time that only moves when it's told to
+type clock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *clock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *clock) add(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// testService runs a service over a plain UDP socket on loopback, sending its announces to its own
+// address unless to is given
+func testService(t *testing.T, c *clock, port uint16, found func([20]byte, client.Peer), to *net.UDPAddr) (*Service, *net.UDPAddr) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	if to == nil {
+		to = addr
+	}
+	s := newService(port, found, []group{{conn, to}})
+	s.now = c.now
+	s.start()
+	return s, addr
+}
+
+func TestAnnounce(t *testing.T) {
+	infoHash := sha1.Sum([]byte("torrent"))
+	c := &clock{t: time.Now()}
+	found := make(chan client.Peer, 10)
+	receiver, addr := testService(t, c, 7000, func(h [20]byte, p client.Peer) {
+		if h == infoHash {
+			found <- p
+		}
+	}, nil)
+	defer receiver.Close()
+	sender, _ := testService(t, c, 6881, nil, addr)
+	defer sender.Close()
+
+	sender.Announce(infoHash)
+	select {
+	case p := <-found:
+		if !p.IP.Equal(net.IPv4(127, 0, 0, 1)) || p.Port != 6881 {
+			t.Errorf("expected peer 127.0.0.1:6881, got %s", p.String())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the announce to be received")
+	}
+
+	// announcing again straight away is suppressed by the sender, and reporting the peer again by
+	// the receiver
+	sender.Announce(infoHash)
+	sender.mu.Lock()
+	sender.lastSent = map[[20]byte]time.Time{}
+	sender.mu.Unlock()
+	sender.Announce(infoHash)
+	time.Sleep(50 * time.Millisecond)
+	if n := len(found); n != 0 {
+		t.Errorf("expected a repeated announce not to be reported, got %d reports", n)
+	}
+	c.add(MinInterval)
+	sender.Announce(infoHash)
+	select {
+	case <-found:
+	case <-time.After(time.Second):
+		t.Errorf("expected the peer to be reported again after MinInterval")
+	}
+}
+
+func TestIgnoreOwnAnnounce(t *testing.T) {
+	found := make(chan client.Peer, 1)
+	s, _ := testService(t, &clock{t: time.Now()}, 6881, func(h [20]byte, p client.Peer) { found <- p }, nil)
+	defer s.Close()
+	s.Announce(sha1.Sum([]byte("torrent")))
+	select {
+	case p := <-found:
+		t.Errorf("expected our own announce to be ignored, got peer %s", p.String())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
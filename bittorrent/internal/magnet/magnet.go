@@ -0,0 +1,105 @@
+// Package magnet parses magnet links, which identify a torrent by its info hash alone. The rest of
+// the torrent is fetched from peers (BEP 9).
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Magnet is what a magnet link tells us about a torrent
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string   // a name to show until the metadata arrives, may be empty
+	Trackers []string // tr
+	Peers    []string // x.pe, host:port of peers to try straight away
+	WebSeeds []string // ws
+}
+
+// Parse reads a magnet link. Only links with a v1 info hash (urn:btih) are supported, in hex or
+// base32.
+func Parse(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("not a magnet link: %q", uri)
+	}
+	q, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return Magnet{}, err
+	}
+	m := Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+		WebSeeds: q["ws"],
+	}
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		if m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:")); err != nil {
+			return Magnet{}, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return Magnet{}, errors.New("magnet link has no v1 info hash (xt=urn:btih:...)")
+	}
+	for _, pe := range q["x.pe"] {
+		host, port, err := net.SplitHostPort(pe)
+		if err != nil {
+			return Magnet{}, fmt.Errorf("invalid peer %q: %w", pe, err)
+		}
+		if _, err := strconv.ParseUint(port, 10, 16); err != nil || host == "" {
+			return Magnet{}, fmt.Errorf("invalid peer %q", pe)
+		}
+		m.Peers = append(m.Peers, pe)
+	}
+	return m, nil
+}
+
+// parseInfoHash accepts 40 hex digits, or 32 base32 characters as older clients use
+func parseInfoHash(s string) ([20]byte, error) {
+	infoHash := [20]byte{}
+	var b []byte
+	var err error
+	switch len(s) {
+	case 40:
+		b, err = hex.DecodeString(s)
+	case 32:
+		b, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = errors.New("wrong length")
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid info hash %q: %v", s, err)
+	}
+	copy(infoHash[:], b)
+	return infoHash, nil
+}
+
+// String returns the magnet link, with the info hash in hex
+func (m Magnet) String() string {
+	q := url.Values{}
+	if m.Name != "" {
+		q.Set("dn", m.Name)
+	}
+	q["tr"] = m.Trackers
+	q["ws"] = m.WebSeeds
+	q["x.pe"] = m.Peers
+	s := "magnet:?xt=urn:btih:" + hex.EncodeToString(m.InfoHash[:])
+	if enc := q.Encode(); enc != "" {
+		s += "&" + enc
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package magnet
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	uri := "magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&dn=Some+Name" +
+		"&tr=http%3A%2F%2Ftracker.example%2Fannounce&tr=udp%3A%2F%2Fother%3A80&x.pe=10.0.0.1:6881&x.pe=[::1]:51413"
+	m, err := Parse(uri)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := Magnet{
+		InfoHash: [20]byte{0xc9, 0xe1, 0x57, 0x63, 0xf7, 0x22, 0xf2, 0x3e, 0x98, 0xa2, 0x9d, 0xec, 0xdf, 0xae, 0x34, 0x1b, 0x98, 0xd5, 0x30, 0x56},
+		Name:     "Some Name",
+		Trackers: []string{"http://tracker.example/announce", "udp://other:80"},
+		Peers:    []string{"10.0.0.1:6881", "[::1]:51413"},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("expected %+v, got %+v", want, m)
+	}
+	again, err := Parse(m.String())
+	if err != nil || !reflect.DeepEqual(again, m) {
+		t.Errorf("expected %s to parse back to %+v, got %+v, %v", m.String(), m, again, err)
+	}
+}
+
+func TestParseBase32(t *testing.T) {
+	hexed, _ := Parse("magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056")
+	m, err := Parse("magnet:?xt=urn:btih:ZHQVOY7XELZD5GFCTXWN7LRUDOMNKMCW")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m.InfoHash != hexed.InfoHash {
+		t.Errorf("expected info hash %x, got %x", hexed.InfoHash, m.InfoHash)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, uri := range []string{
+		"http://example.com/?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056",
+		"magnet:?dn=no+hash",
+		"magnet:?xt=urn:btmh:1220caf1e1c30e81cb361b9ee167c4aa64228a7fa4fa9f6105232b28ad099f3a302e",
+		"magnet:?xt=urn:btih:c9e157",
+		"magnet:?xt=urn:btih:zz" + "e15763f722f23e98a29decdfae341b98d53056",
+		"magnet:?xt=urn:btih:c9e15763f722f23e98a29decdfae341b98d53056&x.pe=nope",
+	} {
+		if _, err := Parse(uri); err == nil {
+			t.Errorf("%s: expected an error", uri)
+		}
+	}
+}
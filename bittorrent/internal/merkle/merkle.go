@@ -0,0 +1,121 @@
+// Package merkle builds and checks the SHA-256 merkle trees v2 torrents use to verify their data
+// (BEP 52). The leaves are hashes of 16 KiB blocks, and trees are padded out to a power of two
+// leaves with zeros.
+package merkle
+
+import "crypto/sha256"
+
+// BlockSize is how much data each leaf covers
+const BlockSize = 16384
+
+// Leaves hashes each block of data. The last block may be short.
+func Leaves(data []byte) [][32]byte {
+	leaves := make([][32]byte, 0, (len(data)+BlockSize-1)/BlockSize)
+	for begin := 0; begin < len(data); begin += BlockSize {
+		end := begin + BlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		leaves = append(leaves, sha256.Sum256(data[begin:end]))
+	}
+	return leaves
+}
+
+// NextPow2 returns the smallest power of two that's at least n
+func NextPow2(n int) int {
+	p := 1
+	for p < n {
+		p *= 2
+	}
+	return p
+}
+
+// PadHash returns the root of a subtree of n zero leaves, where n is a power of two. It's what
+// pads out a layer above the leaves.
+func PadHash(n int) [32]byte {
+	h := [32]byte{}
+	for ; n > 1; n /= 2 {
+		h = pair(h, h)
+	}
+	return h
+}
+
+// Root returns the root of the tree whose bottom layer is hashes, padded out to width with pad.
+// width must be a power of two no smaller than len(hashes).
+func Root(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, len(hashes))
+	copy(layer, hashes)
+	for ; width > 1; width /= 2 {
+		if len(layer)%2 == 1 {
+			layer = append(layer, pad)
+		}
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = pair(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+		pad = pair(pad, pad)
+	}
+	if len(layer) == 0 {
+		return pad
+	}
+	return layer[0]
+}
+
+// Proof returns the uncle hashes, bottom first, needed to check hashes[index] against the root of
+// the tree Root would build from the same arguments
+func Proof(hashes [][32]byte, width int, pad [32]byte, index int) [][32]byte {
+	layer := make([][32]byte, len(hashes))
+	copy(layer, hashes)
+	proof := [][32]byte{}
+	for ; width > 1; width /= 2 {
+		if len(layer)%2 == 1 {
+			layer = append(layer, pad)
+		}
+		if sibling := index ^ 1; sibling < len(layer) {
+			proof = append(proof, layer[sibling])
+		} else {
+			proof = append(proof, pad)
+		}
+		next := make([][32]byte, len(layer)/2)
+		for i := range next {
+			next[i] = pair(layer[2*i], layer[2*i+1])
+		}
+		layer = next
+		pad = pair(pad, pad)
+		index /= 2
+	}
+	return proof
+}
+
+// Verify checks that node is at index in its layer of the tree with the given root, using the uncle
+// hashes from Proof
+func Verify(node [32]byte, index int, proof [][32]byte, root [32]byte) bool {
+	for _, uncle := range proof {
+		if index%2 == 0 {
+			node = pair(node, uncle)
+		} else {
+			node = pair(uncle, node)
+		}
+		index /= 2
+	}
+	return index == 0 && node == root
+}
+
+// VerifyRange checks a run of consecutive hashes from one layer of the tree, as sent in a hashes
+// message. len(hashes) must be a power of two and index a multiple of it. proof holds the uncles
+// from the layer above the hashes up to the root.
+func VerifyRange(hashes [][32]byte, index int, proof [][32]byte, root [32]byte) bool {
+	n := len(hashes)
+	if n == 0 || n != NextPow2(n) || index%n != 0 {
+		return false
+	}
+	return Verify(Root(hashes, n, [32]byte{}), index/n, proof, root)
+}
+
+func pair(a, b [32]byte) [32]byte {
+	buf := make([]byte, 64)
+	copy(buf, a[:])
+	copy(buf[32:], b[:])
+	return sha256.Sum256(buf)
+}
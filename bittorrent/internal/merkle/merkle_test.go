@@ -0,0 +1,70 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+func TestRoot(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 3*BlockSize+10)
+	leaves := Leaves(data)
+	if len(leaves) != 4 || leaves[3] != sha256.Sum256(data[3*BlockSize:]) {
+		t.Fatalf("unexpected leaves for %d bytes: %x", len(data), leaves)
+	}
+	// three leaves padded to four by hand
+	l := Leaves(data[:3*BlockSize])
+	want := pair(pair(l[0], l[1]), pair(l[2], [32]byte{}))
+	if have := Root(l, 4, [32]byte{}); have != want {
+		t.Errorf("expected root %x, got %x", want, have)
+	}
+	// a wider tree pads the upper layers with the hash of zero subtrees
+	want = pair(want, PadHash(4))
+	if have := Root(l, 8, [32]byte{}); have != want {
+		t.Errorf("expected root %x padded to 8 leaves, got %x", want, have)
+	}
+	if have := Root([][32]byte{want}, 1, [32]byte{}); have != want {
+		t.Errorf("expected a single node to be its own root")
+	}
+}
+
+func TestProof(t *testing.T) {
+	data := make([]byte, 35*BlockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	hashes := Leaves(data)
+	pad := PadHash(1)
+	root := Root(hashes, 64, pad)
+	for i := range hashes {
+		proof := Proof(hashes, 64, pad, i)
+		if len(proof) != 6 {
+			t.Fatalf("expected a proof of 6 uncles for a 64 leaf tree, got %d", len(proof))
+		}
+		if !Verify(hashes[i], i, proof, root) {
+			t.Errorf("expected leaf %d to verify", i)
+		}
+		if Verify(hashes[i], i^1, proof, root) {
+			t.Errorf("expected leaf %d not to verify at the wrong index", i)
+		}
+	}
+}
+
+func TestVerifyRange(t *testing.T) {
+	data := make([]byte, 8*BlockSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	hashes := Leaves(data)
+	root := Root(hashes, NextPow2(len(hashes)), [32]byte{})
+	// the second half of the layer, with the proof from the layer above it
+	half := len(hashes) / 2
+	subRoots := [][32]byte{Root(hashes[:half], half, [32]byte{}), Root(hashes[half:], half, [32]byte{})}
+	proof := Proof(subRoots, 2, [32]byte{}, 1)
+	if !VerifyRange(hashes[half:], half, proof, root) {
+		t.Errorf("expected range to verify")
+	}
+	if VerifyRange(hashes[:half], half, proof, root) {
+		t.Errorf("expected the wrong range not to verify")
+	}
+	if VerifyRange(hashes[:3], 0, nil, root) {
+		t.Errorf("expected a range that isn't a power of two to be rejected")
+	}
+}
@@ -0,0 +1,317 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+)
+
+// port: <len=0003><id=9><listen port>, for peers running a DHT node (BEP 5)
+const MsgPort messageID = 9
+
+// extended: <len=0002+X><id=20><extended ID><payload>, for the extension protocol (BEP 10)
+const MsgExtended messageID = 20
+
+// Typed is a message with its payload decoded into fields. Decode turns a Message into one and
+// Encode turns it back.
+type Typed interface {
+	MessageID() messageID
+	// appendPayload appends the encoded payload to buf
+	appendPayload(buf []byte) []byte
+}
+
+// KeepAlive is the empty message peers send to keep an idle connection open
+type KeepAlive struct{}
+
+type Choke struct{}
+type Unchoke struct{}
+type Interested struct{}
+type NotInterested struct{}
+
+type Have struct {
+	Index int
+}
+
+// Bitfield holds a bit for each piece, and aliases the payload it was decoded from
+type Bitfield struct {
+	Bits bitfield.Bitfield
+}
+
+type Cancel Request
+
+// Piece is a block of a piece. Block aliases the payload it was decoded from, and is written
+// straight from the caller's buffer by Writer, so blocks are never copied just to frame them.
+type Piece struct {
+	Index int
+	Begin int
+	Block []byte
+}
+
+type Port struct {
+	Port uint16
+}
+
+// Extended carries a message for one of the extension protocol's extensions (BEP 10). ID 0 is the
+// extension handshake; the rest are whatever IDs the receiver gave the extensions in its handshake.
+// Payload aliases the payload it was decoded from.
+type Extended struct {
+	ID      uint8
+	Payload []byte
+}
+
+// HashReject turns down a hash request
+type HashReject HashRequest
+
+// Hashes answers a hash request with the requested hashes followed by their proof
+type Hashes struct {
+	HashRequest
+	Hashes [][32]byte
+}
+
+func (KeepAlive) MessageID() messageID     { return 0 }
+func (Choke) MessageID() messageID         { return MsgChoke }
+func (Unchoke) MessageID() messageID       { return MsgUnchoke }
+func (Interested) MessageID() messageID    { return MsgInterested }
+func (NotInterested) MessageID() messageID { return MsgNotInterested }
+func (Have) MessageID() messageID          { return MsgHave }
+func (Bitfield) MessageID() messageID      { return MsgBitfield }
+func (Request) MessageID() messageID       { return MsgRequest }
+func (Piece) MessageID() messageID         { return MsgPiece }
+func (Cancel) MessageID() messageID        { return MsgCancel }
+func (Port) MessageID() messageID          { return MsgPort }
+func (Extended) MessageID() messageID      { return MsgExtended }
+func (HashRequest) MessageID() messageID   { return MsgHashRequest }
+func (Hashes) MessageID() messageID        { return MsgHashes }
+func (HashReject) MessageID() messageID    { return MsgHashReject }
+
+func (KeepAlive) appendPayload(buf []byte) []byte     { return buf }
+func (Choke) appendPayload(buf []byte) []byte         { return buf }
+func (Unchoke) appendPayload(buf []byte) []byte       { return buf }
+func (Interested) appendPayload(buf []byte) []byte    { return buf }
+func (NotInterested) appendPayload(buf []byte) []byte { return buf }
+
+func (m Have) appendPayload(buf []byte) []byte {
+	return appendUint32(buf, m.Index)
+}
+
+func (m Bitfield) appendPayload(buf []byte) []byte {
+	return append(buf, m.Bits...)
+}
+
+func (m Request) appendPayload(buf []byte) []byte {
+	return appendUint32(appendUint32(appendUint32(buf, m.Index), m.Begin), m.Length)
+}
+
+func (m Cancel) appendPayload(buf []byte) []byte {
+	return Request(m).appendPayload(buf)
+}
+
+func (m Piece) appendPayload(buf []byte) []byte {
+	return append(appendUint32(appendUint32(buf, m.Index), m.Begin), m.Block...)
+}
+
+func (m Port) appendPayload(buf []byte) []byte {
+	return append(buf, byte(m.Port>>8), byte(m.Port))
+}
+
+func (m Extended) appendPayload(buf []byte) []byte {
+	return append(append(buf, m.ID), m.Payload...)
+}
+
+func (m HashRequest) appendPayload(buf []byte) []byte {
+	buf = append(buf, m.PiecesRoot[:]...)
+	return appendUint32(appendUint32(appendUint32(appendUint32(buf, m.BaseLayer), m.Index), m.Length), m.ProofLayers)
+}
+
+func (m HashReject) appendPayload(buf []byte) []byte {
+	return HashRequest(m).appendPayload(buf)
+}
+
+func (m Hashes) appendPayload(buf []byte) []byte {
+	buf = m.HashRequest.appendPayload(buf)
+	for _, h := range m.Hashes {
+		buf = append(buf, h[:]...)
+	}
+	return buf
+}
+
+func appendUint32(buf []byte, v int) []byte {
+	return append(buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Append appends the message to buf as it's sent on the wire, length prefix and all
+func Append(buf []byte, m Typed) []byte {
+	start := len(buf)
+	buf = append(buf, 0, 0, 0, 0)
+	if _, ok := m.(KeepAlive); ok {
+		return buf
+	}
+	buf = m.appendPayload(append(buf, byte(m.MessageID())))
+	binary.BigEndian.PutUint32(buf[start:], uint32(len(buf)-start-4))
+	return buf
+}
+
+// Encode returns the untyped form of a message, which is nil for a keepalive
+func Encode(m Typed) *Message {
+	if _, ok := m.(KeepAlive); ok {
+		return nil
+	}
+	return &Message{ID: m.MessageID(), Payload: m.appendPayload(nil)}
+}
+
+// ErrUnknownID is returned by Decode for messages it has no type for
+var ErrUnknownID = errors.New("unknown message ID")
+
+// Decode returns the typed form of a message, checking its payload is the right length. Piece
+// indexes aren't checked against the torrent; ParseHave and friends do that. Bitfield and piece
+// blocks alias m's payload rather than being copied.
+func Decode(m *Message) (Typed, error) {
+	if m == nil {
+		return KeepAlive{}, nil
+	}
+	p := m.Payload
+	want := -1 // exact payload length, -1 if it varies
+	switch m.ID {
+	case MsgChoke, MsgUnchoke, MsgInterested, MsgNotInterested:
+		want = 0
+	case MsgHave:
+		want = 4
+	case MsgRequest, MsgCancel:
+		want = 12
+	case MsgPort:
+		want = 2
+	case MsgHashRequest, MsgHashReject:
+		want = hashRequestLen
+	}
+	if want != -1 && len(p) != want {
+		return nil, fmt.Errorf("expected payload of %d bytes for message ID %d, got %d", want, m.ID, len(p))
+	}
+	switch m.ID {
+	case MsgChoke:
+		return Choke{}, nil
+	case MsgUnchoke:
+		return Unchoke{}, nil
+	case MsgInterested:
+		return Interested{}, nil
+	case MsgNotInterested:
+		return NotInterested{}, nil
+	case MsgHave:
+		return Have{Index: int(binary.BigEndian.Uint32(p))}, nil
+	case MsgBitfield:
+		return Bitfield{Bits: bitfield.Bitfield(p)}, nil
+	case MsgRequest, MsgCancel:
+		r := Request{
+			Index:  int(binary.BigEndian.Uint32(p[0:4])),
+			Begin:  int(binary.BigEndian.Uint32(p[4:8])),
+			Length: int(binary.BigEndian.Uint32(p[8:12])),
+		}
+		if m.ID == MsgCancel {
+			return Cancel(r), nil
+		}
+		return r, nil
+	case MsgPiece:
+		if len(p) < 8 {
+			return nil, fmt.Errorf("piece payload too short, %d bytes", len(p))
+		}
+		return Piece{
+			Index: int(binary.BigEndian.Uint32(p[0:4])),
+			Begin: int(binary.BigEndian.Uint32(p[4:8])),
+			Block: p[8:],
+		}, nil
+	case MsgPort:
+		return Port{Port: binary.BigEndian.Uint16(p)}, nil
+	case MsgExtended:
+		if len(p) < 1 {
+			return nil, errors.New("extended message has no extended ID")
+		}
+		return Extended{ID: p[0], Payload: p[1:]}, nil
+	case MsgHashRequest, MsgHashReject:
+		r := parseHashRequest(p)
+		if m.ID == MsgHashReject {
+			return HashReject(r), nil
+		}
+		return r, nil
+	case MsgHashes:
+		return parseHashes(p)
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownID, m.ID)
+}
+
+// hash request: <len=0031><id=21><pieces root><base layer><index><length><proof layers>. p must
+// be at least hashRequestLen bytes.
+func parseHashRequest(p []byte) HashRequest {
+	r := HashRequest{}
+	copy(r.PiecesRoot[:], p)
+	r.BaseLayer = int(binary.BigEndian.Uint32(p[32:36]))
+	r.Index = int(binary.BigEndian.Uint32(p[36:40]))
+	r.Length = int(binary.BigEndian.Uint32(p[40:44]))
+	r.ProofLayers = int(binary.BigEndian.Uint32(p[44:48]))
+	return r
+}
+
+// hashes: <len=0031+32*X><id=22><hash request><hashes><uncle hashes>, where X is the number of
+// hashes sent, the requested ones followed by the proof
+func parseHashes(p []byte) (Hashes, error) {
+	if len(p) < hashRequestLen {
+		return Hashes{}, fmt.Errorf("hashes payload too short, %d bytes", len(p))
+	}
+	r := parseHashRequest(p)
+	rest := p[hashRequestLen:]
+	if len(rest)%32 != 0 || len(rest)/32 < r.Length {
+		return Hashes{}, fmt.Errorf("hashes message has %d bytes of hashes for %d requested", len(rest), r.Length)
+	}
+	hashes := make([][32]byte, len(rest)/32)
+	for i := range hashes {
+		copy(hashes[i][:], rest[32*i:])
+	}
+	return Hashes{HashRequest: r, Hashes: hashes}, nil
+}
+
+// Writer batches messages so a run of small ones, like a pipeline of requests, goes out in one
+// write. Nothing is sent until the buffer fills or Flush is called.
+type Writer struct {
+	w   *bufio.Writer
+	buf []byte // scratch space for encoding
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Write queues a message. A piece's block is written from the caller's buffer: if it doesn't fit
+// in what's left of ours, what's queued is flushed and the block goes straight to the underlying
+// writer, so the buffer must not be changed until Write returns.
+func (w *Writer) Write(m Typed) error {
+	p, ok := m.(Piece)
+	if !ok {
+		w.buf = Append(w.buf[:0], m)
+		_, err := w.w.Write(w.buf)
+		return err
+	}
+	w.buf = Append(w.buf[:0], Piece{Index: p.Index, Begin: p.Begin})
+	binary.BigEndian.PutUint32(w.buf, uint32(9+len(p.Block)))
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	if len(p.Block) > w.w.Available() {
+		if err := w.w.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err := w.w.Write(p.Block)
+	return err
+}
+
+// Flush sends everything queued
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Buffered returns how many bytes are waiting to be sent
+func (w *Writer) Buffered() int {
+	return w.w.Buffered()
+}
@@ -0,0 +1,152 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+)
+
+var typedMessages = []Typed{
+	KeepAlive{},
+	Choke{},
+	Unchoke{},
+	Interested{},
+	NotInterested{},
+	Have{Index: 7},
+	Bitfield{Bits: bitfield.Bitfield{0xa5, 0x80}},
+	Request{Index: 1, Begin: 16384, Length: 16384},
+	Piece{Index: 2, Begin: 32768, Block: []byte("block")},
+	Cancel{Index: 1, Begin: 16384, Length: 16384},
+	Port{Port: 6881},
+	Extended{ID: 0, Payload: []byte("d1:md11:ut_metadatai1eee")},
+	HashRequest{PiecesRoot: [32]byte{1}, BaseLayer: 0, Index: 4, Length: 2, ProofLayers: 3},
+	HashReject{PiecesRoot: [32]byte{2}, Length: 1},
+	Hashes{HashRequest: HashRequest{PiecesRoot: [32]byte{3}, Length: 1}, Hashes: [][32]byte{{4}, {5}}},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, want := range typedMessages {
+		b := Append(nil, want)
+		m, err := ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("%T: unexpected error reading message: %v", want, err)
+		}
+		if !bytes.Equal(m.Serialize(), Encode(want).Serialize()) {
+			t.Errorf("%T: expected to read %v, got %v", want, Encode(want), m)
+		}
+		have, err := Decode(m)
+		if err != nil {
+			t.Fatalf("%T: unexpected error decoding: %v", want, err)
+		}
+		if !reflect.DeepEqual(have, want) {
+			t.Errorf("expected %#v after a round trip, got %#v", want, have)
+		}
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	bad := []*Message{
+		{ID: MsgChoke, Payload: []byte{0}},
+		{ID: MsgHave, Payload: []byte{0, 0, 1}},
+		{ID: MsgRequest, Payload: make([]byte, 13)},
+		{ID: MsgPiece, Payload: make([]byte, 7)},
+		{ID: MsgPort, Payload: []byte{1}},
+		{ID: MsgExtended},
+		{ID: MsgHashes, Payload: make([]byte, hashRequestLen+1)},
+	}
+	for _, m := range bad {
+		if _, err := Decode(m); err == nil {
+			t.Errorf("expected an error decoding %v", m)
+		}
+	}
+	if _, err := Decode(&Message{ID: 30}); !errors.Is(err, ErrUnknownID) {
+		t.Errorf("expected ErrUnknownID, got %v", err)
+	}
+}
+
+// recorder keeps each write it's given without copying it
+type recorder struct {
+	writes [][]byte
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, p)
+	return len(p), nil
+}
+
+func TestWriterBatches(t *testing.T) {
+	r := &recorder{}
+	w := NewWriter(r)
+	want := []byte{}
+	for i := 0; i < 10; i++ {
+		m := Request{Index: i, Length: MaxBlockSize}
+		if err := w.Write(m); err != nil {
+			t.Fatal(err)
+		}
+		want = Append(want, m)
+	}
+	if len(r.writes) != 0 || w.Buffered() != len(want) {
+		t.Fatalf("expected requests to be queued until flushed, got %d writes", len(r.writes))
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.writes) != 1 || !bytes.Equal(r.writes[0], want) {
+		t.Errorf("expected the requests in a single write, got %d writes", len(r.writes))
+	}
+}
+
+func TestWriterPiece(t *testing.T) {
+	r := &recorder{}
+	w := NewWriter(r)
+	w.Write(Have{Index: 1})
+	block := bytes.Repeat([]byte{7}, 3*MaxBlockSize)
+	w.Write(Piece{Index: 1, Begin: 0, Block: block})
+	w.Flush()
+	if len(r.writes) != 2 || &r.writes[1][0] != &block[0] {
+		t.Fatalf("expected a large block to be written from the caller's buffer, got %d writes", len(r.writes))
+	}
+	all := append(append([]byte{}, r.writes[0]...), r.writes[1]...)
+	want := Append(Append(nil, Have{Index: 1}), Piece{Index: 1, Begin: 0, Block: block})
+	if !bytes.Equal(all, want) {
+		t.Errorf("piece didn't serialize as expected")
+	}
+
+	// small blocks are batched like anything else
+	r.writes = nil
+	w.Write(Piece{Index: 1, Begin: 5, Block: []byte("abc")})
+	w.Write(Have{Index: 2})
+	w.Flush()
+	want = Append(Append(nil, Piece{Index: 1, Begin: 5, Block: []byte("abc")}), Have{Index: 2})
+	if len(r.writes) != 1 || !bytes.Equal(r.writes[0], want) {
+		t.Errorf("expected a small block to be batched, got %d writes", len(r.writes))
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, m := range typedMessages {
+		f.Add(Append(nil, m))
+	}
+	f.Add([]byte{0, 0, 0, 1, 99})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m, err := ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			return
+		}
+		typed, err := Decode(m)
+		if err != nil {
+			return
+		}
+		// anything that decodes encodes back to the bytes it was read from
+		n := 4
+		if m != nil {
+			n += 1 + len(m.Payload)
+		}
+		if have := Append(nil, typed); !bytes.Equal(have, b[:n]) {
+			t.Errorf("expected %x to encode back to itself, got %x", b[:n], have)
+		}
+	})
+}
@@ -2,7 +2,11 @@ package message
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
 )
 
 type messageID uint8
@@ -17,6 +21,11 @@ const (
 	MsgRequest       messageID = 6
 	MsgPiece         messageID = 7
 	MsgCancel        messageID = 8
+
+	// v2 torrents (BEP 52)
+	MsgHashRequest messageID = 21
+	MsgHashes      messageID = 22
+	MsgHashReject  messageID = 23
 )
 
 // Message stores ID and payload of a message
@@ -40,6 +49,16 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
+// MaxLength is the longest message we'll accept, leaving room for a bitfield of a million pieces
+// as well as a full size block. A peer sending anything longer is broken or malicious.
+const MaxLength = 1 << 17
+
+// MaxBlockSize is the most a request may ask for
+const MaxBlockSize = 16384
+
+// ErrTooLong is returned by ReadMessage for messages longer than MaxLength
+var ErrTooLong = errors.New("message too long")
+
 // Read parses a message from a stream. Returns `nil` on keep-alive message
 func ReadMessage(r io.Reader) (*Message, error) {
 	buf := make([]byte, 4)
@@ -51,6 +70,9 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	if mLen == 0 {
 		return nil, nil
 	}
+	if mLen > MaxLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrTooLong, mLen)
+	}
 	buf = make([]byte, mLen)
 	_, err = io.ReadFull(r, buf)
 	if err != nil {
@@ -59,10 +81,116 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	return &Message{ID: messageID(buf[0]), Payload: buf[1:]}, nil
 }
 
-// piece: <len=0009+X><id=7><index><begin><block>, where X is the length of the block
-func ParsePiece(buf []byte, m *Message) int {
+// checkID makes sure a message is the kind its parser expects
+func checkID(m *Message, id messageID) error {
+	if m == nil {
+		return errors.New("expected a message, got a keepalive")
+	}
+	if m.ID != id {
+		return fmt.Errorf("expected message ID %d, got %d", id, m.ID)
+	}
+	return nil
+}
+
+// checkIndex makes sure a piece index is within a torrent of numPieces pieces
+func checkIndex(index uint32, numPieces int) error {
+	if uint64(index) >= uint64(numPieces) {
+		return fmt.Errorf("piece index %d out of range, torrent has %d pieces", index, numPieces)
+	}
+	return nil
+}
+
+// have: <len=0005><id=4><piece index>
+func ParseHave(m *Message, numPieces int) (int, error) {
+	if err := checkID(m, MsgHave); err != nil {
+		return 0, err
+	}
+	if len(m.Payload) != 4 {
+		return 0, fmt.Errorf("expected have payload of 4 bytes, got %d", len(m.Payload))
+	}
+	index := binary.BigEndian.Uint32(m.Payload)
+	if err := checkIndex(index, numPieces); err != nil {
+		return 0, err
+	}
+	return int(index), nil
+}
+
+// bitfield: <len=0001+X><id=5><bitfield>, where X is enough bytes for a bit per piece. The spare
+// bits at the end must be clear.
+func ParseBitfield(m *Message, numPieces int) (bitfield.Bitfield, error) {
+	if err := checkID(m, MsgBitfield); err != nil {
+		return nil, err
+	}
+	bf := bitfield.Bitfield(m.Payload)
+	if err := bf.Validate(numPieces); err != nil {
+		return nil, err
+	}
+	return bf, nil
+}
+
+// Request is what a request or cancel message asks for
+type Request struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// request: <len=0013><id=6><index><begin><length>, checked against the size of the piece it's for.
+// pieceLength returns the size of a piece given its index.
+func ParseRequest(m *Message, numPieces int, pieceLength func(index int) int) (Request, error) {
+	if m == nil || (m.ID != MsgRequest && m.ID != MsgCancel) {
+		return Request{}, errors.New("expected a request or cancel message")
+	}
+	if len(m.Payload) != 12 {
+		return Request{}, fmt.Errorf("expected request payload of 12 bytes, got %d", len(m.Payload))
+	}
+	index := binary.BigEndian.Uint32(m.Payload[0:4])
+	if err := checkIndex(index, numPieces); err != nil {
+		return Request{}, err
+	}
+	r := Request{
+		Index:  int(index),
+		Begin:  int(binary.BigEndian.Uint32(m.Payload[4:8])),
+		Length: int(binary.BigEndian.Uint32(m.Payload[8:12])),
+	}
+	if r.Length == 0 || r.Length > MaxBlockSize || r.Begin+r.Length > pieceLength(r.Index) {
+		return Request{}, fmt.Errorf("invalid request for %d bytes at %d of piece %d", r.Length, r.Begin, r.Index)
+	}
+	return r, nil
+}
+
+// piece: <len=0009+X><id=7><index><begin><block>, where X is the length of the block. The block is
+// copied into buf, the piece being downloaded, after checking it's for that piece and fits. Returns
+// where the block starts and how long it is.
+func ParsePiece(index int, buf []byte, m *Message) (int, int, error) {
+	if err := checkID(m, MsgPiece); err != nil {
+		return 0, 0, err
+	}
+	if len(m.Payload) < 8 {
+		return 0, 0, fmt.Errorf("piece payload too short, %d bytes", len(m.Payload))
+	}
+	parsedIndex := binary.BigEndian.Uint32(m.Payload[0:4])
+	if uint64(parsedIndex) != uint64(index) {
+		return 0, 0, fmt.Errorf("expected piece %d, got %d", index, parsedIndex)
+	}
 	begin := binary.BigEndian.Uint32(m.Payload[4:8])
 	block := m.Payload[8:]
+	if uint64(begin) >= uint64(len(buf)) || uint64(begin)+uint64(len(block)) > uint64(len(buf)) {
+		return 0, 0, fmt.Errorf("block of %d bytes at %d doesn't fit in piece of %d", len(block), begin, len(buf))
+	}
 	n := copy(buf[begin:], block)
-	return n
+	return int(begin), n, nil
 }
+
+// HashRequest asks for a run of hashes from one layer of a file's merkle tree, along with the proof
+// needed to check them against the file's pieces root. It's the payload of hash request and hash
+// reject messages, and starts the payload of hashes messages.
+type HashRequest struct {
+	PiecesRoot  [32]byte
+	BaseLayer   int // 0 for the leaves
+	Index       int // of the first hash in the base layer, a multiple of Length
+	Length      int // number of hashes, a power of two
+	ProofLayers int // how many layers of uncle hashes to include
+}
+
+const hashRequestLen = 32 + 4*4
@@ -2,12 +2,14 @@ package message
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"testing"
 )
 
 func TestSerializeKeepalive(t *testing.T) {
 	var m *Message
-	want := []byte{0,0,0,0}
+	want := []byte{0, 0, 0, 0}
 	have := m.Serialize()
 	if !bytes.Equal(have, want) {
 		t.Errorf("expected %v when serialised keepalive, got %v", want, have)
@@ -15,7 +17,7 @@ func TestSerializeKeepalive(t *testing.T) {
 }
 
 func TestSerializeNoPayload(t *testing.T) {
-	m1 := Message{ ID: MsgChoke }
+	m1 := Message{ID: MsgChoke}
 	r := bytes.NewReader(m1.Serialize())
 	m2, err := ReadMessage(r)
 	if err != nil {
@@ -27,4 +29,137 @@ func TestSerializeNoPayload(t *testing.T) {
 	if len(m2.Payload) != 0 {
 		t.Errorf("expected no payload, got %v", m2.Payload)
 	}
-}
\ No newline at end of file
+}
+
+func TestHashes(t *testing.T) {
+	r := HashRequest{PiecesRoot: [32]byte{1, 2, 3}, BaseLayer: 2, Index: 4, Length: 2, ProofLayers: 3}
+	hashes := [][32]byte{{1}, {2}, {3}}
+	typed, err := Decode(Encode(Hashes{HashRequest: r, Hashes: hashes}))
+	if err != nil {
+		t.Fatalf("unexpected error decoding hashes: %v", err)
+	}
+	got, ok := typed.(Hashes)
+	if !ok || got.HashRequest != r || len(got.Hashes) != 3 || got.Hashes[2] != hashes[2] {
+		t.Errorf("expected %+v with %v, got %+v", r, hashes, typed)
+	}
+
+	if _, err := Decode(Encode(Hashes{HashRequest: r, Hashes: hashes[:1]})); err == nil {
+		t.Errorf("expected an error for fewer hashes than requested")
+	}
+	if _, err := Decode(&Message{ID: MsgHashes, Payload: make([]byte, hashRequestLen-1)}); err == nil {
+		t.Errorf("expected an error for a hashes message too short to hold its request")
+	}
+}
+
+func TestReadMessageTooLong(t *testing.T) {
+	buf := []byte{0xff, 0xff, 0xff, 0xff, byte(MsgPiece)}
+	if _, err := ReadMessage(bytes.NewReader(buf)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("expected ErrTooLong, got %v", err)
+	}
+}
+
+func TestParseHave(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		want    int
+		ok      bool
+	}{
+		{[]byte{0, 0, 0, 4}, 4, true},
+		{[]byte{0, 0, 0, 10}, 0, false}, // past the last piece
+		{[]byte{0xff, 0xff, 0xff, 0xff}, 0, false},
+		{[]byte{0, 0, 4}, 0, false},
+	}
+	for _, tt := range tests {
+		index, err := ParseHave(&Message{ID: MsgHave, Payload: tt.payload}, 10)
+		if (err == nil) != tt.ok || index != tt.want {
+			t.Errorf("ParseHave(%v) = %d, %v, want %d (ok %v)", tt.payload, index, err, tt.want, tt.ok)
+		}
+	}
+	if _, err := ParseHave(&Message{ID: MsgBitfield, Payload: []byte{0, 0, 0, 1}}, 10); err == nil {
+		t.Errorf("expected an error parsing the wrong message type")
+	}
+	if _, err := ParseHave(nil, 10); err == nil {
+		t.Errorf("expected an error parsing a keepalive")
+	}
+}
+
+func TestParseBitfield(t *testing.T) {
+	tests := []struct {
+		payload []byte
+		ok      bool
+	}{
+		{[]byte{0xff, 0xc0}, true},
+		{[]byte{0xff, 0xe0}, false}, // spare bit set
+		{[]byte{0xff}, false},
+		{[]byte{0xff, 0xc0, 0}, false},
+	}
+	for _, tt := range tests {
+		_, err := ParseBitfield(&Message{ID: MsgBitfield, Payload: tt.payload}, 10)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseBitfield(%x) returned %v, want ok %v", tt.payload, err, tt.ok)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	pieceLength := func(index int) int {
+		if index == 3 {
+			return 100
+		}
+		return 32768
+	}
+	request := func(index, begin, length uint32) *Message {
+		p := make([]byte, 12)
+		binary.BigEndian.PutUint32(p[0:4], index)
+		binary.BigEndian.PutUint32(p[4:8], begin)
+		binary.BigEndian.PutUint32(p[8:12], length)
+		return &Message{ID: MsgRequest, Payload: p}
+	}
+	tests := []struct {
+		m  *Message
+		ok bool
+	}{
+		{request(0, 16384, 16384), true},
+		{request(3, 0, 100), true},
+		{request(3, 50, 100), false}, // past the end of the short last piece
+		{request(4, 0, 100), false},
+		{request(0, 0, 32768), false}, // bigger than a block
+		{request(0, 0, 0), false},
+		{request(0, 0xffffffff, 16384), false},
+		{&Message{ID: MsgRequest, Payload: []byte{0}}, false},
+	}
+	for i, tt := range tests {
+		_, err := ParseRequest(tt.m, 4, pieceLength)
+		if (err == nil) != tt.ok {
+			t.Errorf("request %d: got %v, want ok %v", i, err, tt.ok)
+		}
+	}
+}
+
+func TestParsePiece(t *testing.T) {
+	piece := func(index, begin uint32, block []byte) *Message {
+		p := make([]byte, 8+len(block))
+		binary.BigEndian.PutUint32(p[0:4], index)
+		binary.BigEndian.PutUint32(p[4:8], begin)
+		copy(p[8:], block)
+		return &Message{ID: MsgPiece, Payload: p}
+	}
+	buf := make([]byte, 10)
+	begin, n, err := ParsePiece(4, buf, piece(4, 2, []byte("abc")))
+	if err != nil || begin != 2 || n != 3 || string(buf[2:5]) != "abc" {
+		t.Errorf("expected abc copied at 2, got %d bytes at %d (%v), buf %q", n, begin, err, buf)
+	}
+	bad := []*Message{
+		piece(5, 0, []byte("abc")),          // wrong piece
+		piece(4, 10, []byte("abc")),         // starts past the end
+		piece(4, 8, []byte("abc")),          // runs past the end
+		piece(4, 0xfffffffe, []byte("abc")), // overflows
+		{ID: MsgPiece, Payload: []byte{0, 0, 0, 4}},
+		{ID: MsgHave, Payload: []byte{0, 0, 0, 4}},
+	}
+	for i, m := range bad {
+		if _, _, err := ParsePiece(4, buf, m); err == nil {
+			t.Errorf("bad piece %d: expected an error", i)
+		}
+	}
+}
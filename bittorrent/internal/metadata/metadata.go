@@ -0,0 +1,374 @@
+// Package metadata exchanges torrents' info dicts with peers, using the extension protocol (BEP 10)
+// and its ut_metadata extension (BEP 9). It's how a torrent added from a magnet link finds out what
+// it's downloading.
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/message"
+)
+
+const (
+	// BlockSize is how much of the metadata goes in each message
+	BlockSize = 16 << 10
+
+	// MaxSize is the largest info dict we'll fetch
+	MaxSize = 32 << 20
+
+	// UTMetadataID is the extended message ID peers should send ut_metadata messages to us with
+	UTMetadataID = 1
+
+	// FetchTimeout is how long a peer gets to send us the whole of the metadata
+	FetchTimeout = 30 * time.Second
+
+	// MaxFetchers is how many peers are asked for the metadata at once
+	MaxFetchers = 4
+
+	// HangUpTimeout is how long a peer that's sent us the metadata gets to close its side of the
+	// connection
+	HangUpTimeout = time.Second
+)
+
+// ut_metadata message types
+const (
+	msgRequest = 0
+	msgData    = 1
+	msgReject  = 2
+)
+
+// messageLimits bound the bencoded part of the messages we're sent
+var messageLimits = bencodecustom.Options{MaxStringLen: 1 << 10, MaxDepth: 4, MaxSize: 64 << 10}
+
+// Handshake is the extension handshake (BEP 10), which is extended message 0
+type Handshake struct {
+	// Extensions maps the name of each extension the sender supports to the ID it wants messages
+	// for it sent with
+	Extensions   map[string]int
+	MetadataSize int // size of the info dict, 0 if the sender doesn't have it
+}
+
+// Message returns the handshake ready to send
+func (h Handshake) Message() message.Extended {
+	m := map[string]any{}
+	for name, id := range h.Extensions {
+		m[name] = id
+	}
+	d := map[string]any{"m": m}
+	if h.MetadataSize > 0 {
+		d["metadata_size"] = h.MetadataSize
+	}
+	payload, _ := bencodecustom.Marshal(d)
+	return message.Extended{ID: 0, Payload: payload}
+}
+
+// ParseHandshake reads an extension handshake's payload. Extensions the sender has turned off, with
+// ID 0, are left out.
+func ParseHandshake(payload []byte) (Handshake, error) {
+	v, err := bencodecustom.ParseWithOptions(bufio.NewReader(bytes.NewReader(payload)), messageLimits)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("error parsing extension handshake: %w", err)
+	}
+	d, ok := v.(map[string]any)
+	if !ok {
+		return Handshake{}, errors.New("extension handshake isn't a dict")
+	}
+	h := Handshake{Extensions: map[string]int{}}
+	m, _ := d["m"].(map[string]any)
+	for name, id := range m {
+		if id, ok := id.(int); ok && id > 0 && id < 256 {
+			h.Extensions[name] = id
+		}
+	}
+	if size, ok := d["metadata_size"].(int); ok && size > 0 {
+		h.MetadataSize = size
+	}
+	return h, nil
+}
+
+// msg is a ut_metadata message. Data messages have the piece of metadata appended after the
+// bencoded dict.
+type msg struct {
+	Type      int
+	Piece     int
+	TotalSize int
+	Data      []byte
+}
+
+func (m msg) extended(id int) message.Extended {
+	d := map[string]any{"msg_type": m.Type, "piece": m.Piece}
+	if m.Type == msgData {
+		d["total_size"] = m.TotalSize
+	}
+	payload, _ := bencodecustom.Marshal(d)
+	return message.Extended{ID: uint8(id), Payload: append(payload, m.Data...)}
+}
+
+func parseMsg(payload []byte) (msg, error) {
+	r := bytes.NewReader(payload)
+	dec := bencodecustom.NewDecoderWithOptions(r, messageLimits)
+	var d map[string]any
+	if err := dec.Decode(&d); err != nil {
+		return msg{}, fmt.Errorf("error parsing ut_metadata message: %w", err)
+	}
+	m := msg{}
+	var ok bool
+	if m.Type, ok = d["msg_type"].(int); !ok {
+		return msg{}, errors.New("ut_metadata message has no type")
+	}
+	if m.Piece, ok = d["piece"].(int); !ok || m.Piece < 0 {
+		return msg{}, errors.New("ut_metadata message has missing or invalid piece")
+	}
+	m.TotalSize, _ = d["total_size"].(int)
+	m.Data, _ = io.ReadAll(io.MultiReader(dec.Buffered(), r))
+	return m, nil
+}
+
+// numPieces is how many blocks metadata of size bytes is sent in
+func numPieces(size int) int {
+	return (size + BlockSize - 1) / BlockSize
+}
+
+// Fetch gets the info dict for infoHash from whichever of the peers sends it first, asking a few
+// at a time. Peers that fail are logged to logger, if it isn't nil.
+func Fetch(ctx context.Context, infoHash [20]byte, peers []client.Peer, logger *log.Logger) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	todo := make(chan client.Peer)
+	results := make(chan []byte, 1)
+	wg := sync.WaitGroup{}
+	for i := 0; i < MaxFetchers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for peer := range todo {
+				info, err := FetchFrom(ctx, peer, infoHash, logger)
+				if err != nil {
+					if logger != nil {
+						logger.Printf("%s: error fetching metadata: %v\n", peer.String(), err)
+					}
+					continue
+				}
+				select {
+				case results <- info:
+					cancel() // the rest can give up
+				default:
+				}
+			}
+		}()
+	}
+	go func() {
+		defer close(todo)
+		for _, peer := range peers {
+			select {
+			case todo <- peer:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	info, ok := <-results
+	cancel()
+	for range results {
+	}
+	if ok {
+		return info, nil
+	}
+	if ctx.Err() != nil && len(peers) > 0 {
+		return nil, ctx.Err()
+	}
+	return nil, fmt.Errorf("none of %d peers sent the metadata", len(peers))
+}
+
+// FetchFrom connects to a peer and asks it for the info dict. Diagnostics about the peer go to
+// logger, which may be nil.
+func FetchFrom(ctx context.Context, peer client.Peer, infoHash [20]byte, logger *log.Logger) ([]byte, error) {
+	c, err := client.NewClient(peer, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	c.Logger = logger
+	defer c.Conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Conn.Close()
+		case <-done:
+		}
+	}()
+	c.Conn.SetDeadline(time.Now().Add(FetchTimeout))
+	info, err := fetch(c, infoHash)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	if err == nil {
+		hangUp(c.Conn)
+	}
+	return info, err
+}
+
+// hangUp closes our side of the connection and waits a moment for the peer to close theirs. We're
+// likely to connect again straight away to download the torrent, which the peer would refuse as a
+// duplicate if it hadn't noticed this connection was gone.
+func hangUp(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.CloseWrite()
+	tc.SetReadDeadline(time.Now().Add(HangUpTimeout))
+	io.Copy(io.Discard, tc)
+}
+
+// fetch asks a peer we've handshaken with for the info dict, and checks it against the info hash
+func fetch(c *client.Client, infoHash [20]byte) ([]byte, error) {
+	if !c.Capabilities.Has(client.CapExtensions) {
+		return nil, errors.New("peer doesn't support the extension protocol")
+	}
+	ours := Handshake{Extensions: map[string]int{"ut_metadata": UTMetadataID}}
+	if err := c.Send(ours.Message()); err != nil {
+		return nil, err
+	}
+	var info []byte
+	var got []bool
+	remaining := 0
+	for {
+		m, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if m == nil || m.ID != message.MsgExtended {
+			continue
+		}
+		typed, err := message.Decode(m)
+		if err != nil {
+			return nil, err
+		}
+		ext := typed.(message.Extended)
+		switch ext.ID {
+		case 0:
+			if info != nil {
+				continue // already asked for everything
+			}
+			h, err := ParseHandshake(ext.Payload)
+			if err != nil {
+				return nil, err
+			}
+			id := h.Extensions["ut_metadata"]
+			if id == 0 {
+				return nil, errors.New("peer doesn't support ut_metadata")
+			}
+			if h.MetadataSize == 0 || h.MetadataSize > MaxSize {
+				return nil, fmt.Errorf("peer has metadata of unusable size %d", h.MetadataSize)
+			}
+			info = make([]byte, h.MetadataSize)
+			remaining = numPieces(h.MetadataSize)
+			got = make([]bool, remaining)
+			for i := 0; i < remaining; i++ {
+				if err := c.Queue(msg{Type: msgRequest, Piece: i}.extended(id)); err != nil {
+					return nil, err
+				}
+			}
+			if err := c.Flush(); err != nil {
+				return nil, err
+			}
+		case UTMetadataID:
+			if info == nil {
+				return nil, errors.New("peer sent metadata before its extension handshake")
+			}
+			md, err := parseMsg(ext.Payload)
+			if err != nil {
+				return nil, err
+			}
+			if md.Type == msgReject {
+				return nil, fmt.Errorf("peer rejected request for metadata piece %d", md.Piece)
+			}
+			if md.Type != msgData {
+				continue // we have nothing to give, and peers mustn't count on an answer
+			}
+			begin := md.Piece * BlockSize
+			end := begin + BlockSize
+			if end > len(info) {
+				end = len(info)
+			}
+			if md.Piece >= len(got) || md.TotalSize != len(info) || len(md.Data) != end-begin {
+				return nil, fmt.Errorf("peer sent malformed metadata piece %d", md.Piece)
+			}
+			if !got[md.Piece] {
+				copy(info[begin:end], md.Data)
+				got[md.Piece] = true
+				remaining--
+			}
+			if remaining == 0 {
+				if sha1.Sum(info) != infoHash {
+					return nil, errors.New("metadata doesn't match the info hash")
+				}
+				return info, nil
+			}
+		}
+	}
+}
+
+// Responder answers one peer's requests for the metadata of a torrent we have
+type Responder struct {
+	info    []byte
+	theirID int // ID the peer wants ut_metadata messages sent with, 0 until it says
+}
+
+func NewResponder(info []byte) *Responder {
+	return &Responder{info: info}
+}
+
+// Handshake is our extension handshake, offering the metadata
+func (r *Responder) Handshake() message.Extended {
+	return Handshake{Extensions: map[string]int{"ut_metadata": UTMetadataID}, MetadataSize: len(r.info)}.Message()
+}
+
+// Handle deals with an extended message from the peer, sending it any metadata it asks for
+func (r *Responder) Handle(c *client.Client, ext message.Extended) error {
+	switch ext.ID {
+	case 0:
+		h, err := ParseHandshake(ext.Payload)
+		if err != nil {
+			return err
+		}
+		r.theirID = h.Extensions["ut_metadata"]
+	case UTMetadataID:
+		m, err := parseMsg(ext.Payload)
+		if err != nil {
+			return err
+		}
+		if m.Type != msgRequest || r.theirID == 0 {
+			return nil
+		}
+		if m.Piece >= numPieces(len(r.info)) {
+			return c.Send(msg{Type: msgReject, Piece: m.Piece}.extended(r.theirID))
+		}
+		begin := m.Piece * BlockSize
+		end := begin + BlockSize
+		if end > len(r.info) {
+			end = len(r.info)
+		}
+		data := msg{Type: msgData, Piece: m.Piece, TotalSize: len(r.info), Data: r.info[begin:end]}
+		return c.Send(data.extended(r.theirID))
+	}
+	return nil
+}
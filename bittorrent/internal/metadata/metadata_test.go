@@ -0,0 +1,206 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/message"
+)
+
+func TestHandshake(t *testing.T) {
+	h := Handshake{Extensions: map[string]int{"ut_metadata": 3, "ut_pex": 1}, MetadataSize: 12345}
+	have, err := ParseHandshake(h.Message().Payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(have, h) {
+		t.Errorf("expected %+v after a round trip, got %+v", h, have)
+	}
+	// extensions turned off with ID 0 are left out
+	have, err = ParseHandshake([]byte("d1:md11:ut_metadatai0e6:ut_pexi2eee"))
+	if err != nil || !reflect.DeepEqual(have.Extensions, map[string]int{"ut_pex": 2}) {
+		t.Errorf("unexpected handshake %+v, %v", have, err)
+	}
+	if _, err := ParseHandshake([]byte("i1e")); err == nil {
+		t.Errorf("expected an error for a handshake that isn't a dict")
+	}
+}
+
+func TestMsg(t *testing.T) {
+	m := msg{Type: msgData, Piece: 2, TotalSize: 40000, Data: []byte("some data e")}
+	have, err := parseMsg(m.extended(3).Payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(have, m) {
+		t.Errorf("expected %+v after a round trip, got %+v", m, have)
+	}
+}
+
+func randomInfo(n int) []byte {
+	info := make([]byte, n)
+	rand.New(rand.NewSource(1)).Read(info)
+	return info
+}
+
+// servePeer plays a peer offering info over conn, advertising size bytes of it
+func servePeer(conn net.Conn, info []byte, size int) {
+	defer conn.Close()
+	c := &client.Client{Conn: conn, Capabilities: client.Supported}
+	r := NewResponder(info)
+	h := Handshake{Extensions: map[string]int{"ut_metadata": UTMetadataID}, MetadataSize: size}
+	c.Send(message.Bitfield{Bits: []byte{0xff}}) // which the fetcher should ignore
+	c.Send(h.Message())
+	for {
+		m, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		typed, err := message.Decode(m)
+		if err != nil {
+			return
+		}
+		if ext, ok := typed.(message.Extended); ok {
+			if err := r.Handle(c, ext); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// tcpPipe returns both ends of a loopback connection. Unlike net.Pipe its writes are buffered, so
+// both ends can send their handshakes at once.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	a, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func fetchOverPipe(t *testing.T, infoHash [20]byte, info []byte, size int) ([]byte, error) {
+	a, b := tcpPipe(t)
+	defer a.Close()
+	go servePeer(b, info, size)
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	return fetch(&client.Client{Conn: a, Capabilities: client.Supported}, infoHash)
+}
+
+func TestFetch(t *testing.T) {
+	info := randomInfo(2*BlockSize + 1000)
+	have, err := fetchOverPipe(t, sha1.Sum(info), info, len(info))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(have, info) {
+		t.Errorf("fetched metadata doesn't match")
+	}
+}
+
+func TestFetchErrors(t *testing.T) {
+	info := randomInfo(BlockSize + 1)
+	tests := []struct {
+		name     string
+		infoHash [20]byte
+		size     int
+		want     string
+	}{
+		{"wrong hash", sha1.Sum([]byte("other")), len(info), "doesn't match"},
+		{"wrong size", sha1.Sum(info), len(info) + BlockSize, "malformed"},
+		{"too big", sha1.Sum(info), MaxSize + 1, "size"},
+	}
+	for _, tt := range tests {
+		_, err := fetchOverPipe(t, tt.infoHash, info, tt.size)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestResponderReject(t *testing.T) {
+	a, b := tcpPipe(t)
+	defer a.Close()
+	defer b.Close()
+	r := NewResponder(randomInfo(BlockSize))
+	c := &client.Client{Conn: b}
+	theirs := Handshake{Extensions: map[string]int{"ut_metadata": 5}}.Message()
+	if err := r.Handle(c, theirs); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := r.Handle(c, msg{Type: msgRequest, Piece: 1}.extended(UTMetadataID)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m, err := message.ReadMessage(a)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	typed, err := message.Decode(m)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ext := typed.(message.Extended)
+	got, err := parseMsg(ext.Payload)
+	if err != nil || ext.ID != 5 || got.Type != msgReject || got.Piece != 1 {
+		t.Errorf("expected a reject for piece 1 with ID 5, got ID %d %+v, %v", ext.ID, got, err)
+	}
+}
+
+func TestFetchFromPeers(t *testing.T) {
+	info := randomInfo(3 * BlockSize)
+	infoHash := sha1.Sum(info)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if _, _, err := client.Accept(conn, func([20]byte) bool { return true }); err != nil {
+				conn.Close()
+				continue
+			}
+			go servePeer(conn, info, len(info))
+		}
+	}()
+	// a peer that isn't there comes first
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead.Close()
+	peers := []client.Peer{}
+	for _, l := range []net.Listener{dead, ln} {
+		addr := l.Addr().(*net.TCPAddr)
+		peers = append(peers, client.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	have, err := Fetch(ctx, infoHash, peers, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(have, info) {
+		t.Errorf("fetched metadata doesn't match")
+	}
+	if _, err := Fetch(ctx, infoHash, peers[:1], nil); err == nil {
+		t.Errorf("expected an error when no peer has the metadata")
+	}
+}
@@ -0,0 +1,130 @@
+// Package ratelimit throttles how fast bytes move over peer connections. A Limiter can be shared by
+// any number of connections, so one limit covers every torrent in a session.
+package ratelimit
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at a fixed number of bytes per second. A nil *Limiter doesn't
+// limit anything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second, 0 for unlimited
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing bytesPerSec bytes per second, or unlimited if it's 0
+func NewLimiter(bytesPerSec int) *Limiter {
+	l := &Limiter{}
+	l.SetRate(bytesPerSec)
+	return l
+}
+
+// SetRate changes the limit, taking effect for the next bytes through the limiter
+func (l *Limiter) SetRate(bytesPerSec int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(bytesPerSec)
+	l.tokens = 0
+	l.last = time.Now()
+}
+
+// chunk is the most we let through in a single read or write, so one connection can't take a whole
+// second's worth of the rate at once
+func (l *Limiter) chunk(n int) int {
+	if l == nil {
+		return n
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return n
+	}
+	max := int(l.rate / 10)
+	if max < 1 {
+		max = 1
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// reserve takes n bytes from the bucket, which may leave it in debt, and returns how long the caller
+// has to wait before the debt is paid off
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate // don't save up more than a second's worth
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Conn throttles reads and writes on a connection. Either limiter may be nil.
+type Conn struct {
+	net.Conn
+	read, write *Limiter
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func NewConn(conn net.Conn, read, write *Limiter) *Conn {
+	return &Conn{Conn: conn, read: read, write: write, closed: make(chan struct{})}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b[:c.read.chunk(len(b))])
+	c.wait(c.read.reserve(n))
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n := c.write.chunk(len(b) - written)
+		c.wait(c.write.reserve(n))
+		n, err := c.Conn.Write(b[written : written+n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close also cuts short any wait for the limiter, so closing a throttled connection is prompt
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *Conn) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-c.closed:
+	}
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSharedLimit(t *testing.T) {
+	l := NewLimiter(100000)
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		go io.Copy(io.Discard, c2)
+		conn := NewConn(c1, nil, l)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if _, err := conn.Write(make([]byte, 25000)); err != nil {
+				t.Errorf("unexpected error writing: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	// 50KB at 100KB/s, minus the first chunk that goes straight through
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("expected writes to be throttled to at least 400ms, took %v", elapsed)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	var l *Limiter
+	if n := l.chunk(1 << 20); n != 1<<20 {
+		t.Errorf("expected a nil limiter not to split writes, got chunk of %d", n)
+	}
+	if d := l.reserve(1 << 20); d != 0 {
+		t.Errorf("expected a nil limiter never to wait, got %v", d)
+	}
+	if d := NewLimiter(0).reserve(1 << 20); d != 0 {
+		t.Errorf("expected a zero rate limiter never to wait, got %v", d)
+	}
+}
+
+func TestCloseInterruptsWait(t *testing.T) {
+	c1, c2 := net.Pipe()
+	go io.Copy(io.Discard, c2)
+	conn := NewConn(c1, nil, NewLimiter(10))
+	done := make(chan struct{})
+	go func() {
+		conn.Write(make([]byte, 1000)) // would take 100s at this rate
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected close to interrupt a throttled write")
+	}
+}
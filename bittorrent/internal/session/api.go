@@ -0,0 +1,214 @@
+package session
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/torrent"
+)
+
+// Handler returns the JSON control API for the session:
+//
+//	GET    /torrents                  list every torrent
+//	POST   /torrents                  add the torrent file or magnet link in the request body
+//	GET    /torrents/{hash}           status of one torrent
+//	DELETE /torrents/{hash}           remove a torrent, keeping its data
+//	POST   /torrents/{hash}/pause     stop downloading
+//	POST   /torrents/{hash}/resume    start downloading again
+//	POST   /torrents/{hash}/recheck   hash the data on disk again
+//	POST   /torrents/{hash}/priority  set a file's priority, body {"file": 0, "priority": "skip"}
+//
+// where {hash} is the hex encoded info hash. Requests must be addressed to a loopback host, and
+// anything but a GET must carry the APIHeader header.
+func (s *Session) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/torrents", s.handleTorrents)
+	mux.HandleFunc("/torrents/", s.handleTorrent)
+	return guard(mux)
+}
+
+// APIHeader has to be set, to any value, on requests that change the session. Browsers won't send
+// a custom header to another origin without asking first, which the API never allows, so a web
+// page can't use a visitor's browser to add or remove torrents.
+const APIHeader = "X-Bittorrent-Api"
+
+// guard refuses requests a web page could have made through a browser. Checking the Host stops a
+// page whose domain has been rebound to 127.0.0.1 from reading or changing the session as if it
+// were the same origin.
+func guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loopbackHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q is not a loopback address", r.Host))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Header.Get(APIHeader) == "" {
+			writeError(w, http.StatusForbidden, fmt.Errorf("missing %s header", APIHeader))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loopbackHost reports whether a Host header, with or without a port, names this machine
+func loopbackHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.Trim(hostport, "[]")
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ServeAPI serves the control API on addr until ctx is cancelled. Anything that can reach the API
+// can control the session, so addr has to be a loopback address.
+func (s *Session) ServeAPI(ctx context.Context, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("refusing to serve control API on non-loopback address %s", addr)
+	}
+	srv := &http.Server{Addr: addr, Handler: s.Handler()}
+	errs := make(chan error, 1)
+	go func() { errs <- srv.ListenAndServe() }()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
+
+// maxTorrentFileSize bounds how much of an add request we'll read
+const maxTorrentFileSize = 10 << 20
+
+func (s *Session) handleTorrents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.List())
+	case http.MethodPost:
+		body := bufio.NewReader(http.MaxBytesReader(w, r.Body, maxTorrentFileSize))
+		var st Status
+		var err error
+		if prefix, _ := body.Peek(len("magnet:")); string(prefix) == "magnet:" {
+			var uri []byte
+			if uri, err = io.ReadAll(body); err == nil {
+				st, err = s.AddMagnet(strings.TrimSpace(string(uri)))
+			}
+		} else {
+			st, err = s.Add(body)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, st)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+func (s *Session) handleTorrent(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/torrents/"), "/")
+	if len(parts) > 2 {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path %s", r.URL.Path))
+		return
+	}
+	infoHash, err := parseInfoHash(parts[0])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	action := ""
+	if len(parts) == 2 {
+		action = parts[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+	case action == "" && r.Method == http.MethodDelete:
+		err = s.Remove(infoHash)
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	case action == "pause" && r.Method == http.MethodPost:
+		err = s.Pause(infoHash)
+	case action == "resume" && r.Method == http.MethodPost:
+		err = s.Resume(infoHash)
+	case action == "recheck" && r.Method == http.MethodPost:
+		err = s.Recheck(infoHash)
+	case action == "priority" && r.Method == http.MethodPost:
+		req := struct {
+			File     int    `json:"file"`
+			Priority string `json:"priority"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		p, perr := torrent.ParsePriority(req.Priority)
+		if perr != nil {
+			writeError(w, http.StatusBadRequest, perr)
+			return
+		}
+		err = s.SetFilePriority(infoHash, req.File, p)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown action %s %s", r.Method, r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	st, err := s.Status(infoHash)
+	if err != nil {
+		writeError(w, errorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
+
+func parseInfoHash(s string) ([20]byte, error) {
+	infoHash := [20]byte{}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(infoHash) {
+		return infoHash, fmt.Errorf("invalid info hash %q", s)
+	}
+	copy(infoHash[:], b)
+	return infoHash, nil
+}
+
+func errorStatus(err error) int {
+	if errors.Is(err, ErrNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, ErrNoMetadata) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
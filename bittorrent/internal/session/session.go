@@ -0,0 +1,754 @@
+// Package session runs several torrents side by side. They share a listen port, so incoming peers
+// are routed to the torrent they ask for, along with a connection budget and rate limits.
+package session
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/connmgr"
+	"go-bt-learning.brk3.github.io/internal/lsd"
+	"go-bt-learning.brk3.github.io/internal/magnet"
+	"go-bt-learning.brk3.github.io/internal/metadata"
+	"go-bt-learning.brk3.github.io/internal/ratelimit"
+	"go-bt-learning.brk3.github.io/internal/storage"
+	"go-bt-learning.brk3.github.io/internal/torrent"
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// Config is shared by every torrent in the session
+type Config struct {
+	Port         uint16 // port we accept peers on, 0 to pick any free port
+	DataDir      string // where torrent data is written
+	MaxConns     int    // connections across all torrents
+	MaxDials     int
+	MaxHalfOpen  int
+	DownloadRate int // bytes per second across all torrents, 0 for unlimited
+	UploadRate   int
+
+	// IdleTimeout is how long a peer can stay silent, or keep us choked with nothing we want,
+	// before it's disconnected
+	IdleTimeout time.Duration
+
+	// Storage chooses how torrent data is laid out on disk
+	Storage storage.Options
+
+	// LocalDiscovery finds peers on the local network (BEP 14). Private torrents are never
+	// announced or given local peers.
+	LocalDiscovery bool
+
+	// Seed keeps serving torrents to peers once they're complete. With SuperSeed set peers are
+	// offered one piece at a time (BEP 16), for when we're a torrent's only seeder.
+	Seed      bool
+	SuperSeed bool
+
+	// Logger gets the session's diagnostics, and those of its torrents, which are discarded if
+	// it's nil
+	Logger *log.Logger
+}
+
+var DefaultConfig = Config{
+	Port:        6881,
+	DataDir:     ".",
+	MaxConns:    200,
+	MaxDials:    20,
+	MaxHalfOpen: 8,
+	IdleTimeout: client.DefaultIdleTimeout,
+
+	LocalDiscovery: true,
+}
+
+// State is what a torrent in the session is currently doing
+type State string
+
+const (
+	StateMetadata    State = "metadata" // fetching a magnet link's metadata from peers
+	StateChecking    State = "checking"
+	StateDownloading State = "downloading"
+	StatePaused      State = "paused"
+	StateSeeding     State = "seeding"
+	StateComplete    State = "complete"
+	StateError       State = "error"
+)
+
+var ErrNotFound = errors.New("torrent not found")
+
+// ErrNoMetadata is returned for torrents added from magnet links that are still fetching their
+// metadata, which can't be changed until it arrives
+var ErrNoMetadata = errors.New("torrent metadata not fetched yet")
+
+// Status is a snapshot of a torrent in the session
+type Status struct {
+	InfoHash  string  `json:"info_hash"`
+	Name      string  `json:"name"`
+	State     State   `json:"state"`
+	Pieces    int     `json:"pieces"`
+	Completed int     `json:"completed"`
+	Peers     int     `json:"peers"`
+	Private   bool    `json:"private"`
+	Uploaded  int64   `json:"uploaded"`
+	SeedRatio float64 `json:"seed_ratio"` // bytes uploaded for each distinct byte uploaded
+	Error     string  `json:"error,omitempty"`
+	Files     []File  `json:"files"`
+}
+
+// EventType says what happened to a torrent
+type EventType string
+
+const (
+	EventAdded    EventType = "added"
+	EventState    EventType = "state"    // the torrent's state changed, to StateError if it failed
+	EventMetadata EventType = "metadata" // a magnet link's metadata arrived
+	EventRemoved  EventType = "removed"
+)
+
+// Event is something that happened to a torrent, with its status just after
+type Event struct {
+	Type   EventType `json:"type"`
+	Status Status    `json:"status"`
+}
+
+// EventBuffer is how many events a subscriber can fall behind by before it misses some
+const EventBuffer = 64
+
+// File is the status of one of a torrent's files
+type File struct {
+	Path     string `json:"path"`
+	Length   int    `json:"length"`
+	Priority string `json:"priority"`
+}
+
+type Session struct {
+	cfg    Config
+	ln     net.Listener
+	limits *connmgr.Limits
+	down   *ratelimit.Limiter
+	up     *ratelimit.Limiter
+	lsd    *lsd.Service // nil if local discovery is off or unavailable
+	quit   chan struct{}
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*handle
+	aliases  map[[20]byte][20]byte // a hybrid torrent's v2 swarm hash to its info hash
+	subs     map[chan Event]bool
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// handle is the session's bookkeeping for one torrent. Torrents added from magnet links have no
+// torrent or storage until their metadata arrives.
+type handle struct {
+	t       *torrent.Torrent
+	storage *storage.Files
+	magnet  *magnet.Magnet // the link the torrent was added from, if it was
+	state   State
+	err     error
+	recheck bool               // hash existing data before the next download starts
+	cancel  context.CancelFunc // stops the running download, nil if it isn't running
+	done    chan struct{}      // closed once the running download has returned
+}
+
+// New starts a session listening for peers on cfg.Port
+func New(cfg Config) (*Session, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Port))
+	if err != nil {
+		return nil, fmt.Errorf("error listening for peers: %w", err)
+	}
+	s := &Session{
+		cfg:      cfg,
+		ln:       ln,
+		limits:   connmgr.NewLimits(cfg.MaxConns, cfg.MaxDials, cfg.MaxHalfOpen),
+		down:     ratelimit.NewLimiter(cfg.DownloadRate),
+		up:       ratelimit.NewLimiter(cfg.UploadRate),
+		torrents: map[[20]byte]*handle{},
+		aliases:  map[[20]byte][20]byte{},
+		subs:     map[chan Event]bool{},
+		quit:     make(chan struct{}),
+	}
+	if cfg.LocalDiscovery {
+		svc, err := lsd.New(s.Port(), s.foundLocalPeer, cfg.Logger)
+		if err != nil {
+			s.logf("local peer discovery disabled: %v\n", err)
+		} else {
+			s.lsd = svc
+			s.wg.Add(1)
+			go s.announceLocal()
+		}
+	}
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Port returns the port we're accepting peers on
+func (s *Session) Port() uint16 {
+	return uint16(s.ln.Addr().(*net.TCPAddr).Port)
+}
+
+// SetRates changes the session's download and upload limits in bytes per second, 0 for unlimited
+func (s *Session) SetRates(download, upload int) {
+	s.down.SetRate(download)
+	s.up.SetRate(upload)
+}
+
+// Add parses a torrent file and starts downloading it. If its data already exists in the data
+// directory it's rechecked first so only the missing pieces are fetched.
+func (s *Session) Add(r io.Reader) (Status, error) {
+	tf, err := torrentfile.NewTorrentFile(r)
+	if err != nil {
+		return Status{}, fmt.Errorf("error loading torrent file: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return Status{}, errors.New("session is closed")
+	}
+	for _, infoHash := range tf.SwarmHashes() {
+		if _, err := s.lookup(infoHash); err == nil {
+			return Status{}, fmt.Errorf("torrent %x already added", infoHash)
+		}
+	}
+	files, err := storage.NewFiles(s.cfg.DataDir, tf, s.cfg.Storage)
+	if err != nil {
+		return Status{}, err
+	}
+	h := &handle{t: s.newTorrent(tf, files), storage: files, recheck: files.HasData()}
+	s.torrents[tf.InfoHash] = h
+	for _, alias := range tf.SwarmHashes()[1:] {
+		s.aliases[alias] = tf.InfoHash
+	}
+	s.emit(EventAdded, h)
+	s.start(h)
+	return h.status(), nil
+}
+
+// AddMagnet adds a torrent from a magnet link. Its metadata is fetched from peers the link and its
+// trackers give us, then it's downloaded as if it had been added from a torrent file.
+func (s *Session) AddMagnet(uri string) (Status, error) {
+	m, err := magnet.Parse(uri)
+	if err != nil {
+		return Status{}, fmt.Errorf("error parsing magnet link: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return Status{}, errors.New("session is closed")
+	}
+	if _, err := s.lookup(m.InfoHash); err == nil {
+		return Status{}, fmt.Errorf("torrent %x already added", m.InfoHash)
+	}
+	h := &handle{magnet: &m}
+	s.torrents[m.InfoHash] = h
+	s.emit(EventAdded, h)
+	s.start(h)
+	return h.status(), nil
+}
+
+// logf logs to the session's Logger, if it has one
+func (s *Session) logf(format string, args ...any) {
+	if s.cfg.Logger != nil {
+		s.cfg.Logger.Printf(format, args...)
+	}
+}
+
+// newTorrent sets up a torrent to run in the session
+func (s *Session) newTorrent(tf torrentfile.TorrentFile, files *storage.Files) *torrent.Torrent {
+	t := torrent.NewTorrent(tf)
+	t.Storage = files
+	t.Limits = s.limits
+	t.DownLimit = s.down
+	t.UpLimit = s.up
+	t.Listening = true
+	t.SuperSeed = s.cfg.SuperSeed
+	t.Conns.IdleTimeout = s.cfg.IdleTimeout
+	t.Logger = s.cfg.Logger
+	return t
+}
+
+// Remove stops a torrent and drops it from the session, leaving its data on disk
+func (s *Session) Remove(infoHash [20]byte) error {
+	s.mu.Lock()
+	h, err := s.lookup(infoHash)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, infoHash := range h.swarmHashes() {
+		delete(s.torrents, infoHash)
+		delete(s.aliases, infoHash)
+	}
+	s.emit(EventRemoved, h)
+	s.mu.Unlock()
+	s.stop(h)
+	return h.close()
+}
+
+// Pause stops a torrent's download, keeping the pieces it has
+func (s *Session) Pause(infoHash [20]byte) error {
+	h, err := s.get(infoHash)
+	if err != nil {
+		return err
+	}
+	s.stop(h)
+	return nil
+}
+
+// Resume restarts a paused or failed torrent
+func (s *Session) Resume(infoHash [20]byte) error {
+	h, err := s.get(infoHash)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h.cancel == nil {
+		s.start(h)
+	}
+	return nil
+}
+
+// Recheck hashes a torrent's data on disk again, then carries on where the check leaves it
+func (s *Session) Recheck(infoHash [20]byte) error {
+	h, err := s.get(infoHash)
+	if err != nil {
+		return err
+	}
+	s.stop(h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.recheck = true
+	s.start(h)
+	return nil
+}
+
+// SetFilePriority changes the priority of one of a torrent's files. A running download picks up the
+// change straight away; a torrent that had finished is restarted if the file is no longer skipped.
+func (s *Session) SetFilePriority(infoHash [20]byte, file int, p torrent.Priority) error {
+	h, t, err := s.getTorrent(infoHash)
+	if err != nil {
+		return err
+	}
+	if err := t.SetFilePriority(file, p); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h.state == StateComplete && t.Remaining() > 0 {
+		s.start(h)
+	}
+	return nil
+}
+
+// Status returns a snapshot of one torrent
+func (s *Session) Status(infoHash [20]byte) (Status, error) {
+	h, err := s.get(infoHash)
+	if err != nil {
+		return Status{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return h.status(), nil
+}
+
+// List returns a snapshot of every torrent in the session
+func (s *Session) List() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]Status, 0, len(s.torrents))
+	for _, h := range s.torrents {
+		res = append(res, h.status())
+	}
+	return res
+}
+
+// Subscribe returns a channel of events from every torrent in the session, and a function that
+// stops them and closes the channel. Events are dropped rather than holding up the session if the
+// subscriber falls more than EventBuffer behind.
+func (s *Session) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, EventBuffer)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	s.subs[ch] = true
+	return ch, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.subs[ch] {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// emit sends an event to every subscriber. Must be called with s.mu held.
+func (s *Session) emit(typ EventType, h *handle) {
+	if len(s.subs) == 0 {
+		return
+	}
+	e := Event{Type: typ, Status: h.status()}
+	for ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// setState must be called with s.mu held
+func (s *Session) setState(h *handle, state State) {
+	h.state = state
+	s.emit(EventState, h)
+}
+
+// Close stops every torrent and stops accepting peers. Subscribers' channels are closed once every
+// torrent has stopped.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	handles := make([]*handle, 0, len(s.torrents))
+	for _, h := range s.torrents {
+		handles = append(handles, h)
+	}
+	s.mu.Unlock()
+	close(s.quit)
+	err := s.ln.Close()
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+	for _, h := range handles {
+		s.stop(h)
+		s.mu.Lock()
+		h.close()
+		s.mu.Unlock()
+	}
+	s.wg.Wait()
+	s.mu.Lock()
+	for ch := range s.subs {
+		delete(s.subs, ch)
+		close(ch)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// get finds a torrent by its info hash or, for hybrid torrents, its v2 swarm hash
+func (s *Session) get(infoHash [20]byte) (*handle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(infoHash)
+}
+
+// lookup must be called with s.mu held
+func (s *Session) lookup(infoHash [20]byte) (*handle, error) {
+	if alias, ok := s.aliases[infoHash]; ok {
+		infoHash = alias
+	}
+	h, ok := s.torrents[infoHash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return h, nil
+}
+
+// getTorrent is get for when the torrent itself is needed, returning ErrNoMetadata if it's still
+// being fetched
+func (s *Session) getTorrent(infoHash [20]byte) (*handle, *torrent.Torrent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.lookup(infoHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.t == nil {
+		return nil, nil, ErrNoMetadata
+	}
+	return h, h.t, nil
+}
+
+// start runs the torrent's download in the background. Must be called with s.mu held.
+func (s *Session) start(h *handle) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	h.done = make(chan struct{})
+	h.err = nil
+	switch {
+	case h.t == nil:
+		s.setState(h, StateMetadata)
+	case h.recheck:
+		s.setState(h, StateChecking)
+	default:
+		s.setState(h, StateDownloading)
+	}
+	s.wg.Add(1)
+	go s.run(ctx, h)
+	if s.lsd != nil && h.t != nil && !h.t.File.Private {
+		s.lsd.Announce(h.t.File.SwarmHashes()...)
+	}
+}
+
+func (s *Session) run(ctx context.Context, h *handle) {
+	defer s.wg.Done()
+	defer close(h.done)
+	err := s.download(ctx, h)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.cancel = nil
+	switch {
+	case err == nil:
+		s.setState(h, StateComplete)
+	case ctx.Err() != nil:
+		s.setState(h, StatePaused)
+	default:
+		h.err = err
+		s.setState(h, StateError)
+	}
+}
+
+func (s *Session) download(ctx context.Context, h *handle) error {
+	s.mu.Lock()
+	t, recheck := h.t, h.recheck
+	s.mu.Unlock()
+	if t == nil {
+		var err error
+		if t, err = s.fetchMetadata(ctx, h); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		recheck = h.recheck
+		if recheck {
+			s.setState(h, StateChecking)
+		} else {
+			s.setState(h, StateDownloading)
+		}
+		s.mu.Unlock()
+	}
+	if recheck {
+		if err := t.Recheck(); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		h.recheck = false
+		s.setState(h, StateDownloading)
+		s.mu.Unlock()
+	}
+	if t.Remaining() > 0 {
+		if err := s.announce(ctx, h); err != nil {
+			return err
+		}
+		if err := t.Download(ctx); err != nil {
+			return err
+		}
+	}
+	if !s.cfg.Seed {
+		return nil
+	}
+	s.mu.Lock()
+	s.setState(h, StateSeeding)
+	s.mu.Unlock()
+	if err := s.announce(ctx, h); err != nil {
+		return err
+	}
+	return t.Seed(ctx)
+}
+
+// announce gets the torrent its peers: from its tracker, if it has one, and from the magnet link it
+// was added from. Must be called from the torrent's download.
+func (s *Session) announce(ctx context.Context, h *handle) error {
+	if h.t.File.Announce != "" {
+		if err := h.t.Announce(ctx, client.PeerID, s.Port()); err != nil {
+			return fmt.Errorf("error announcing to tracker: %w", err)
+		}
+	}
+	if h.magnet != nil {
+		h.t.AddPeers(s.resolvePeers(h.magnet.Peers), torrent.SourceMagnet)
+	}
+	return nil
+}
+
+// fetchMetadata gets the info dict of a torrent added from a magnet link, from the peers its
+// trackers and the link itself give us, then sets the torrent up as Add would
+func (s *Session) fetchMetadata(ctx context.Context, h *handle) (*torrent.Torrent, error) {
+	m := h.magnet
+	peers := s.resolvePeers(m.Peers)
+	for _, tr := range m.Trackers {
+		found, err := torrent.AnnounceInfoHash(ctx, tr, m.InfoHash, client.PeerID, s.Port())
+		if err != nil {
+			s.logf("error announcing to tracker %s: %v\n", tr, err)
+			continue
+		}
+		peers = append(peers, found...)
+	}
+	info, err := metadata.Fetch(ctx, m.InfoHash, peers, s.cfg.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching metadata: %w", err)
+	}
+	announce := ""
+	if len(m.Trackers) > 0 {
+		announce = m.Trackers[0]
+	}
+	tf, err := torrentfile.FromInfo(info, announce)
+	if err != nil {
+		return nil, fmt.Errorf("error loading metadata: %w", err)
+	}
+	tf.URLList = append(tf.URLList, m.WebSeeds...)
+	files, err := storage.NewFiles(s.cfg.DataDir, tf, s.cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	t := s.newTorrent(tf, files)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h.t, h.storage, h.recheck = t, files, files.HasData()
+	s.emit(EventMetadata, h)
+	if s.lsd != nil && !tf.Private {
+		s.lsd.Announce(tf.SwarmHashes()...)
+	}
+	return t, nil
+}
+
+// resolvePeers looks up peers' host:port addresses, skipping any that don't resolve
+func (s *Session) resolvePeers(addrs []string) []client.Peer {
+	peers := []client.Peer{}
+	for _, addr := range addrs {
+		a, err := net.ResolveTCPAddr("tcp", addr)
+		if err != nil {
+			s.logf("%s: error resolving peer: %v\n", addr, err)
+			continue
+		}
+		peers = append(peers, client.Peer{IP: a.IP, Port: uint16(a.Port)})
+	}
+	return peers
+}
+
+// stop cancels the torrent's download, if it's running, and waits for it to return
+func (s *Session) stop(h *handle) {
+	s.mu.Lock()
+	cancel, done := h.cancel, h.done
+	s.mu.Unlock()
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+}
+
+// swarmHashes must be called with s.mu held
+func (h *handle) swarmHashes() [][20]byte {
+	if h.t == nil {
+		return [][20]byte{h.magnet.InfoHash}
+	}
+	return h.t.File.SwarmHashes()
+}
+
+// close must be called with s.mu held, once the torrent has stopped
+func (h *handle) close() error {
+	if h.storage == nil {
+		return nil
+	}
+	return h.storage.Close()
+}
+
+// status must be called with s.mu held
+func (h *handle) status() Status {
+	st := Status{State: h.state}
+	if h.err != nil {
+		st.Error = h.err.Error()
+	}
+	if h.t == nil {
+		st.InfoHash = hex.EncodeToString(h.magnet.InfoHash[:])
+		st.Name = h.magnet.Name
+		return st
+	}
+	st.InfoHash = hex.EncodeToString(h.t.File.InfoHash[:])
+	st.Name = h.t.File.Name
+	st.Pieces = h.t.File.NumPieces()
+	st.Completed = h.t.Completed()
+	st.Peers = h.t.NumPeers()
+	st.Private = h.t.File.Private
+	st.Uploaded = h.t.Uploaded()
+	st.SeedRatio = h.t.SeedRatio()
+	priorities := h.t.FilePriorities()
+	for i, f := range h.t.File.Files {
+		st.Files = append(st.Files, File{Path: f.Path, Length: f.Length, Priority: priorities[i].String()})
+	}
+	return st
+}
+
+// accept routes peers that connect to us to the torrent they ask for
+func (s *Session) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+func (s *Session) handleConn(conn net.Conn) {
+	c, infoHash, err := client.Accept(conn, func(infoHash [20]byte) bool {
+		_, _, err := s.getTorrent(infoHash)
+		return err == nil
+	})
+	if err != nil {
+		s.logf("%s: error accepting peer: %v\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	c.Logger = s.cfg.Logger
+	_, t, err := s.getTorrent(infoHash)
+	if err != nil || !t.AddConn(c) {
+		conn.Close()
+	}
+}
+
+// announceLocal keeps the local network told about our public torrents
+func (s *Session) announceLocal() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(lsd.AnnounceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.quit:
+			return
+		}
+		s.mu.Lock()
+		infoHashes := [][20]byte{}
+		for _, h := range s.torrents {
+			if h.cancel != nil && h.t != nil && !h.t.File.Private {
+				infoHashes = append(infoHashes, h.t.File.SwarmHashes()...)
+			}
+		}
+		s.mu.Unlock()
+		if err := s.lsd.Announce(infoHashes...); err != nil {
+			s.logf("error announcing to local peers: %v\n", err)
+		}
+	}
+}
+
+// foundLocalPeer hands a peer found on the local network to its torrent, which drops it if the
+// torrent is private
+func (s *Session) foundLocalPeer(infoHash [20]byte, peer client.Peer) {
+	_, t, err := s.getTorrent(infoHash)
+	if err != nil {
+		return
+	}
+	t.AddPeers([]client.Peer{peer}, torrent.SourceLSD)
+}
@@ -0,0 +1,401 @@
+package session
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+)
+
+// testTorrent returns a bencoded torrent file for data, along with its info hash
+func testTorrent(announce, name string, data []byte, pieceLength int) ([]byte, [20]byte) {
+	pieces := []byte{}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		end := begin + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		h := sha1.Sum(data[begin:end])
+		pieces = append(pieces, h[:]...)
+	}
+	info := fmt.Sprintf("d6:lengthi%de4:name%d:%s12:piece lengthi%de6:pieces%d:%se",
+		len(data), len(name), name, pieceLength, len(pieces), pieces)
+	f := fmt.Sprintf("d8:announce%d:%s4:info%se", len(announce), announce, info)
+	return []byte(f), sha1.Sum([]byte(info))
+}
+
+// emptyTracker has no peers to give out
+func emptyTracker() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "d8:intervali1800e5:peers0:e")
+	}))
+}
+
+func newTestSession(t *testing.T) *Session {
+	cfg := DefaultConfig
+	cfg.Port = 0
+	cfg.DataDir = t.TempDir()
+	cfg.LocalDiscovery = false // keep tests from finding each other
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatalf("error creating session: %v", err)
+	}
+	return s
+}
+
+// logLines gets each line logged to it
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+// TestLoggerPerSession checks each session's diagnostics go to its own logger
+func TestLoggerPerSession(t *testing.T) {
+	logs := []logLines{make(logLines, 16), make(logLines, 16)}
+	sessions := []*Session{}
+	for _, l := range logs {
+		cfg := DefaultConfig
+		cfg.Port = 0
+		cfg.DataDir = t.TempDir()
+		cfg.LocalDiscovery = false
+		cfg.Logger = log.New(l, "", 0)
+		s, err := New(cfg)
+		if err != nil {
+			t.Fatalf("error creating session: %v", err)
+		}
+		defer s.Close()
+		sessions = append(sessions, s)
+	}
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", sessions[0].Port()))
+	if err != nil {
+		t.Fatalf("error connecting to session: %v", err)
+	}
+	conn.Write(bytes.Repeat([]byte{0xff}, 68)) // not a handshake
+	conn.Close()
+	select {
+	case line := <-logs[0]:
+		if !strings.Contains(line, "error accepting peer") {
+			t.Errorf("expected the bad handshake to be logged, got %q", line)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the bad handshake to be logged")
+	}
+	select {
+	case line := <-logs[1]:
+		t.Errorf("expected nothing logged by the other session, got %q", line)
+	default:
+	}
+}
+
+func waitForState(t *testing.T, s *Session, infoHash [20]byte, want State) Status {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		st, err := s.Status(infoHash)
+		if err != nil {
+			t.Fatalf("unexpected error getting status: %v", err)
+		}
+		if st.State == want {
+			return st
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected state %s, got %+v", want, st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAPI(t *testing.T) {
+	tracker := emptyTracker()
+	defer tracker.Close()
+	s := newTestSession(t)
+	defer s.Close()
+	api := httptest.NewServer(s.Handler())
+	defer api.Close()
+
+	tf, infoHash := testTorrent(tracker.URL, "data", make([]byte, 1000), 256)
+	res, err := apiRequest(http.MethodPost, api.URL+"/torrents", bytes.NewReader(tf))
+	if err != nil {
+		t.Fatalf("unexpected error adding torrent: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("expected status %d adding torrent, got %d", http.StatusCreated, res.StatusCode)
+	}
+	waitForState(t, s, infoHash, StateDownloading)
+
+	hash := hex.EncodeToString(infoHash[:])
+	post := func(action string) Status {
+		t.Helper()
+		res, err := apiRequest(http.MethodPost, api.URL+"/torrents/"+hash+"/"+action, nil)
+		if err != nil {
+			t.Fatalf("unexpected error on %s: %v", action, err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("expected status %d on %s, got %d", http.StatusOK, action, res.StatusCode)
+		}
+		st := Status{}
+		json.NewDecoder(res.Body).Decode(&st)
+		return st
+	}
+	if st := post("pause"); st.State != StatePaused {
+		t.Errorf("expected torrent to be paused, got %s", st.State)
+	}
+	post("resume")
+	waitForState(t, s, infoHash, StateDownloading)
+
+	res, err = http.Get(api.URL + "/torrents")
+	if err != nil {
+		t.Fatalf("unexpected error listing torrents: %v", err)
+	}
+	list := []Status{}
+	json.NewDecoder(res.Body).Decode(&list)
+	res.Body.Close()
+	if len(list) != 1 || list[0].InfoHash != hash || list[0].Pieces != 4 {
+		t.Errorf("unexpected torrent list %+v", list)
+	}
+
+	res, err = apiRequest(http.MethodDelete, api.URL+"/torrents/"+hash, nil)
+	if err != nil {
+		t.Fatalf("unexpected error removing torrent: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected status %d removing torrent, got %d", http.StatusNoContent, res.StatusCode)
+	}
+	res, err = http.Get(api.URL + "/torrents/" + hash)
+	if err != nil {
+		t.Fatalf("unexpected error getting torrent: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected status %d for removed torrent, got %d", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+// apiRequest makes a request to the control API the way a local client would
+func apiRequest(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(APIHeader, "1")
+	return http.DefaultClient.Do(req)
+}
+
+// TestAPIRefusesBrowserRequests checks the requests a web page could get a browser to make, either
+// cross-origin or after rebinding its domain to 127.0.0.1, are refused
+func TestAPIRefusesBrowserRequests(t *testing.T) {
+	s := newTestSession(t)
+	defer s.Close()
+	api := httptest.NewServer(s.Handler())
+	defer api.Close()
+
+	magnetURI := "magnet:?xt=urn:btih:" + strings.Repeat("ab", 20)
+	res, err := http.Post(api.URL+"/torrents", "text/plain", strings.NewReader(magnetURI))
+	if err != nil {
+		t.Fatalf("unexpected error adding magnet: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d for a post without the API header, got %d", http.StatusForbidden, res.StatusCode)
+	}
+	if len(s.List()) != 0 {
+		t.Errorf("expected the magnet not to be added, got %+v", s.List())
+	}
+	res, err = http.Post(api.URL+"/torrents/"+strings.Repeat("ab", 20)+"/pause", "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error pausing: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d pausing without the API header, got %d", http.StatusForbidden, res.StatusCode)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, api.URL+"/torrents", nil)
+	req.Host = "attacker.example:80"
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("unexpected error listing torrents: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("expected status %d for a non-loopback host, got %d", http.StatusForbidden, res.StatusCode)
+	}
+	for _, host := range []string{"localhost:6880", "127.0.0.1", "[::1]:6880"} {
+		if !loopbackHost(host) {
+			t.Errorf("expected %s to be accepted as a loopback host", host)
+		}
+	}
+}
+
+func TestRecheckExistingData(t *testing.T) {
+	tracker := emptyTracker()
+	defer tracker.Close()
+	s := newTestSession(t)
+	defer s.Close()
+	data := bytes.Repeat([]byte("abcdefg"), 200)
+	if err := os.WriteFile(filepath.Join(s.cfg.DataDir, "data"), data, 0644); err != nil {
+		t.Fatalf("error writing existing data: %v", err)
+	}
+	tf, infoHash := testTorrent(tracker.URL, "data", data, 256)
+	if _, err := s.Add(bytes.NewReader(tf)); err != nil {
+		t.Fatalf("unexpected error adding torrent: %v", err)
+	}
+	st := waitForState(t, s, infoHash, StateComplete)
+	if st.Completed != st.Pieces {
+		t.Errorf("expected all %d pieces to pass recheck, got %d", st.Pieces, st.Completed)
+	}
+}
+
+func TestIncomingPeersRouted(t *testing.T) {
+	tracker := emptyTracker()
+	defer tracker.Close()
+	s := newTestSession(t)
+	defer s.Close()
+	tf, infoHash := testTorrent(tracker.URL, "data", make([]byte, 1000), 256)
+	if _, err := s.Add(bytes.NewReader(tf)); err != nil {
+		t.Fatalf("unexpected error adding torrent: %v", err)
+	}
+	waitForState(t, s, infoHash, StateDownloading)
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Port())
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to session: %v", err)
+	}
+	defer conn.Close()
+	h := client.Handshake{Pstr: "BitTorrent protocol", InfoHash: infoHash}
+	copy(h.PeerID[:], "incoming-test-peer..")
+	conn.Write(h.Serialize())
+	buf := make([]byte, 68)
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("expected a handshake in reply, got error: %v", err)
+	}
+	hr := client.Handshake{}
+	if err := hr.Deserialize(buf); err != nil {
+		t.Fatalf("unexpected error parsing handshake: %v", err)
+	}
+	if hr.InfoHash != infoHash {
+		t.Errorf("expected reply for info hash %x, got %x", infoHash, hr.InfoHash)
+	}
+
+	other, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("error connecting to session: %v", err)
+	}
+	defer other.Close()
+	h.InfoHash = sha1.Sum([]byte("unknown"))
+	other.Write(h.Serialize())
+	other.SetDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(other, buf); err == nil {
+		t.Errorf("expected connection for unknown torrent to be closed")
+	}
+}
+
+func TestAddMagnet(t *testing.T) {
+	tracker := emptyTracker()
+	defer tracker.Close()
+	data := bytes.Repeat([]byte("abcdefg"), 2000)
+	tf, infoHash := testTorrent(tracker.URL, "data", data, 4096)
+
+	seeder := newTestSession(t)
+	defer seeder.Close()
+	seeder.cfg.Seed = true
+	if err := os.WriteFile(filepath.Join(seeder.cfg.DataDir, "data"), data, 0644); err != nil {
+		t.Fatalf("error writing seeder's data: %v", err)
+	}
+	if _, err := seeder.Add(bytes.NewReader(tf)); err != nil {
+		t.Fatalf("unexpected error adding torrent: %v", err)
+	}
+	waitForState(t, seeder, infoHash, StateSeeding)
+
+	s := newTestSession(t)
+	defer s.Close()
+	events, unsubscribe := s.Subscribe()
+	defer unsubscribe()
+	uri := fmt.Sprintf("magnet:?xt=urn:btih:%x&dn=data&x.pe=127.0.0.1:%d", infoHash, seeder.Port())
+	st, err := s.AddMagnet(uri)
+	if err != nil {
+		t.Fatalf("unexpected error adding magnet: %v", err)
+	}
+	if st.State != StateMetadata || st.Name != "data" || st.InfoHash != hex.EncodeToString(infoHash[:]) {
+		t.Errorf("unexpected status before metadata %+v", st)
+	}
+	if _, err := s.AddMagnet(uri); err == nil {
+		t.Errorf("expected an error adding the same magnet twice")
+	}
+
+	want := []struct {
+		typ   EventType
+		state State
+	}{
+		{EventAdded, ""},
+		{EventState, StateMetadata},
+		{EventMetadata, StateMetadata},
+		{EventState, StateDownloading},
+		{EventState, StateComplete},
+	}
+	timeout := time.After(10 * time.Second)
+	for _, w := range want {
+		select {
+		case e := <-events:
+			if e.Type != w.typ || (w.state != "" && e.Status.State != w.state) {
+				t.Fatalf("expected a %s event in state %s, got %s in %+v", w.typ, w.state, e.Type, e.Status)
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for a %s event", w.typ)
+		}
+	}
+	have, err := os.ReadFile(filepath.Join(s.cfg.DataDir, "data"))
+	if err != nil || !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match, %v", err)
+	}
+
+	if err := s.Remove(infoHash); err != nil {
+		t.Fatalf("unexpected error removing torrent: %v", err)
+	}
+	if e := <-events; e.Type != EventRemoved {
+		t.Errorf("expected a removed event, got %+v", e)
+	}
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Errorf("expected events to be closed once unsubscribed")
+	}
+}
+
+func TestAddMagnetNoPeers(t *testing.T) {
+	s := newTestSession(t)
+	defer s.Close()
+	infoHash := sha1.Sum([]byte("nobody has this"))
+	if _, err := s.AddMagnet(fmt.Sprintf("magnet:?xt=urn:btih:%x", infoHash)); err != nil {
+		t.Fatalf("unexpected error adding magnet: %v", err)
+	}
+	st := waitForState(t, s, infoHash, StateError)
+	if st.Error == "" {
+		t.Errorf("expected the failure to be reported, got %+v", st)
+	}
+	if err := s.SetFilePriority(infoHash, 0, 0); err != ErrNoMetadata {
+		t.Errorf("expected ErrNoMetadata changing a file's priority, got %v", err)
+	}
+	if _, err := s.AddMagnet("magnet:?dn=nothing"); err == nil {
+		t.Errorf("expected an error for a magnet without an info hash")
+	}
+}
@@ -0,0 +1,303 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// Files lays a torrent's data out as the files it describes. Files that are skipped aren't
+// created; the parts of pieces we download that fall in them go to a parts file instead, so the
+// pieces can still be verified and served.
+type Files struct {
+	dir   string
+	opts  Options
+	files []storageFile
+
+	mu        sync.Mutex
+	parts     *os.File // opened on first use
+	partsPath string
+}
+
+type storageFile struct {
+	torrentfile.File
+	f       handle // nil until the file is first written or unskipped
+	skipped bool
+}
+
+// handle is an open file of the torrent's, read and written at offsets within the file
+type handle interface {
+	readerWriterAt
+	Sync() error
+	Close() error
+}
+
+// NewFiles returns storage for tf's files under dir. Nothing is created until it's written.
+func NewFiles(dir string, tf torrentfile.TorrentFile, opts Options) (*Files, error) {
+	switch opts.Backend {
+	case "", BackendFile:
+	case BackendMmap:
+		if !mmapSupported {
+			return nil, fmt.Errorf("%s storage isn't supported on this platform", opts.Backend)
+		}
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", opts.Backend)
+	}
+	s := &Files{
+		dir:       dir,
+		opts:      opts,
+		partsPath: filepath.Join(dir, "."+tf.Name+".parts"),
+	}
+	for _, f := range tf.Files {
+		s.files = append(s.files, storageFile{File: f})
+	}
+	return s, nil
+}
+
+// HasData reports whether any of the torrent's files already exist with something in them
+func (s *Files) HasData() bool {
+	for _, f := range s.files {
+		if info, err := os.Stat(filepath.Join(s.dir, f.Path)); err == nil && info.Size() > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetSkipped changes whether a file is skipped. A file that's no longer skipped is created and
+// given whatever of its data is in the parts file. A file that's already been created stays on
+// disk if it's skipped again.
+func (s *Files) SetSkipped(index int, skipped bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sf := &s.files[index]
+	sf.skipped = skipped
+	if skipped || sf.f != nil || sf.Padding {
+		return nil
+	}
+	f, err := s.open(sf)
+	if err != nil {
+		return err
+	}
+	if s.parts == nil {
+		if _, err := os.Stat(s.partsPath); err != nil {
+			return nil // nothing was ever put aside
+		}
+		if s.parts, err = os.OpenFile(s.partsPath, os.O_RDWR, 0644); err != nil {
+			return err
+		}
+	}
+	buf := make([]byte, 1<<16)
+	for done := 0; done < sf.Length; {
+		n := len(buf)
+		if sf.Length-done < n {
+			n = sf.Length - done
+		}
+		n, err := s.parts.ReadAt(buf[:n], int64(sf.Offset+done))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n == 0 {
+			break // the rest of the parts file was never written
+		}
+		if _, err := f.WriteAt(buf[:n], int64(done)); err != nil {
+			return err
+		}
+		done += n
+	}
+	return nil
+}
+
+func (s *Files) WriteAt(p []byte, off int64) (int, error) {
+	return s.each(p, off, func(w readerWriterAt, b []byte, off int64) (int, error) {
+		return w.WriteAt(b, off)
+	}, true)
+}
+
+// ReadAt reads the torrent's data, treating anything that hasn't been written as zeros
+func (s *Files) ReadAt(p []byte, off int64) (int, error) {
+	return s.each(p, off, func(r readerWriterAt, b []byte, off int64) (int, error) {
+		n, err := r.ReadAt(b, off)
+		if err == io.EOF {
+			for i := n; i < len(b); i++ {
+				b[i] = 0
+			}
+			return len(b), nil
+		}
+		return n, err
+	}, false)
+}
+
+func (s *Files) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sf := range s.files {
+		if sf.f != nil {
+			if err := sf.f.Sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if s.parts != nil {
+		return s.parts.Sync()
+	}
+	return nil
+}
+
+func (s *Files) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var firstErr error
+	for i := range s.files {
+		if s.files[i].f != nil {
+			if err := s.files[i].f.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			s.files[i].f = nil
+		}
+	}
+	if s.parts != nil {
+		if err := s.parts.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.parts = nil
+	}
+	return firstErr
+}
+
+// each splits an operation on the torrent's data into operations on the files it spans. Skipped
+// files that haven't been created are served by the parts file, which holds each byte at its offset
+// in the torrent. If create is false, files that don't exist yet are read as zeros. Padding files
+// always read as zeros and drop whatever is written to them.
+func (s *Files) each(p []byte, off int64, op func(readerWriterAt, []byte, int64) (int, error), create bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	done := 0
+	for i := range s.files {
+		sf := &s.files[i]
+		start, end := int64(sf.Offset), int64(sf.Offset+sf.Length)
+		pos := off + int64(done)
+		if done == len(p) {
+			break
+		}
+		if pos < start || pos >= end {
+			continue
+		}
+		n := int(end - pos)
+		if n > len(p)-done {
+			n = len(p) - done
+		}
+		chunk := p[done : done+n]
+		var w readerWriterAt
+		var at int64
+		switch {
+		case sf.Padding:
+			w = zeros{} // padding files are never stored
+		case sf.f != nil:
+			w, at = sf.f, pos-start
+		case sf.skipped:
+			if s.parts == nil {
+				f, err := s.openParts(create)
+				if err != nil {
+					return done, err
+				}
+				if f == nil {
+					w = zeros{}
+					break
+				}
+				s.parts = f
+			}
+			w, at = s.parts, pos
+		default:
+			if !create {
+				if _, err := os.Stat(filepath.Join(s.dir, sf.Path)); err != nil {
+					w = zeros{}
+					break
+				}
+			}
+			f, err := s.open(sf)
+			if err != nil {
+				return done, err
+			}
+			w, at = f, pos-start
+		}
+		if _, err := op(w, chunk, at); err != nil {
+			return done, err
+		}
+		done += n
+	}
+	if done < len(p) {
+		return done, io.EOF
+	}
+	return done, nil
+}
+
+// open opens a file with the configured backend, preallocating it if asked to. Must be called with
+// s.mu held.
+func (s *Files) open(sf *storageFile) (handle, error) {
+	path := filepath.Join(s.dir, sf.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	var h handle = f
+	if s.opts.Preallocate {
+		err = preallocate(f, int64(sf.Length))
+	}
+	if err == nil && s.opts.Backend == BackendMmap && sf.Length > 0 {
+		h, err = mapFile(f, sf.Length)
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error opening %s: %w", path, err)
+	}
+	sf.f = h
+	return h, nil
+}
+
+// openParts opens the parts file, returning nil if it doesn't exist and create is false. Must be
+// called with s.mu held.
+func (s *Files) openParts(create bool) (*os.File, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	f, err := os.OpenFile(s.partsPath, flags, 0644)
+	if os.IsNotExist(err) && !create {
+		return nil, nil
+	}
+	return f, err
+}
+
+// growTo extends f to length bytes if it's shorter
+func growTo(f *os.File, length int64) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() >= length {
+		return err
+	}
+	return f.Truncate(length)
+}
+
+type readerWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// zeros reads as zeros, for data that was never written
+type zeros struct{}
+
+func (zeros) WriteAt(p []byte, off int64) (int, error) { return len(p), nil }
+
+func (zeros) ReadAt(p []byte, off int64) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestPreallocate checks preallocated files take up their full size on disk while sparse ones only
+// take up what's been written
+func TestPreallocate(t *testing.T) {
+	for _, prealloc := range []bool{false, true} {
+		dir := t.TempDir()
+		tf := testTorrent(1 << 20)
+		s := newTestFiles(t, dir, tf, Options{Backend: BackendMmap, Preallocate: prealloc})
+		if _, err := s.WriteAt([]byte("x"), 0); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		s.Close()
+		info, err := os.Stat(filepath.Join(dir, tf.Files[0].Path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		onDisk := info.Sys().(*syscall.Stat_t).Blocks * 512
+		if info.Size() != 1<<20 {
+			t.Errorf("expected a file of %d bytes, got %d", 1<<20, info.Size())
+		}
+		if prealloc && onDisk < 1<<20 {
+			t.Errorf("expected the preallocated file to take up its full size, got %d bytes on disk", onDisk)
+		}
+		if !prealloc && onDisk >= 1<<20 {
+			t.Errorf("expected a sparse file, got %d bytes on disk", onDisk)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// testTorrent returns a torrent of files of the given lengths
+func testTorrent(lengths ...int) torrentfile.TorrentFile {
+	tf := torrentfile.TorrentFile{Name: "test", PieceLength: 10}
+	for i, l := range lengths {
+		path := filepath.Join(tf.Name, string(rune('a'+i)))
+		tf.Files = append(tf.Files, torrentfile.File{Path: path, Length: l, Offset: tf.Length})
+		tf.Length += l
+	}
+	return tf
+}
+
+func newTestFiles(t *testing.T, dir string, tf torrentfile.TorrentFile, opts Options) *Files {
+	s, err := NewFiles(dir, tf, opts)
+	if err != nil {
+		t.Fatalf("unexpected error creating storage: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestFilesParts(t *testing.T) {
+	dir := t.TempDir()
+	tf := testTorrent(10, 10, 10)
+	s := newTestFiles(t, dir, tf, Options{})
+	s.SetSkipped(1, true)
+	data := bytes.Repeat([]byte("0123456789"), 3)
+	if _, err := s.WriteAt(data[5:25], 5); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tf.Files[1].Path)); !os.IsNotExist(err) {
+		t.Errorf("expected skipped file not to be created, stat returned %v", err)
+	}
+	have := make([]byte, 20)
+	if _, err := s.ReadAt(have, 5); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if !bytes.Equal(have, data[5:25]) {
+		t.Errorf("expected to read back %q, got %q", data[5:25], have)
+	}
+	if err := s.SetSkipped(1, false); err != nil {
+		t.Fatalf("unexpected error unskipping: %v", err)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, tf.Files[1].Path))
+	if err != nil || !bytes.Equal(b, data[10:20]) {
+		t.Errorf("expected unskipped file to hold %q from the parts file, got %q (%v)", data[10:20], b, err)
+	}
+}
+
+func TestFilesPadding(t *testing.T) {
+	dir := t.TempDir()
+	tf := testTorrent(5, 5, 20)
+	tf.Files[1].Padding = true
+	s := newTestFiles(t, dir, tf, Options{})
+	data := []byte("01234xxxxx0123456789abcdefghij")
+	if _, err := s.WriteAt(data, 0); err != nil {
+		t.Fatalf("unexpected error writing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tf.Files[1].Path)); !os.IsNotExist(err) {
+		t.Errorf("expected padding file not to be created, stat returned %v", err)
+	}
+	have := make([]byte, 30)
+	if _, err := s.ReadAt(have, 0); err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if want := "01234\x00\x00\x00\x00\x000123456789abcdefghij"; string(have) != want {
+		t.Errorf("expected padding to read as zeros, got %q", have)
+	}
+}
+
+// TestBackends writes the same data with each backend, with and without preallocation
+func TestBackends(t *testing.T) {
+	backends := []Backend{BackendFile}
+	if mmapSupported {
+		backends = append(backends, BackendMmap)
+	}
+	data := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	for _, backend := range backends {
+		for _, prealloc := range []bool{false, true} {
+			dir := t.TempDir()
+			tf := testTorrent(12, 0, 4096, 20)
+			s := newTestFiles(t, dir, tf, Options{Backend: backend, Preallocate: prealloc})
+			// the middle of the big file is never written
+			if _, err := s.WriteAt(data[:20], 2); err != nil {
+				t.Fatalf("%s: unexpected error writing: %v", backend, err)
+			}
+			if _, err := s.WriteAt(data[20:], int64(tf.Length-16)); err != nil {
+				t.Fatalf("%s: unexpected error writing: %v", backend, err)
+			}
+			if err := s.Sync(); err != nil {
+				t.Fatalf("%s: unexpected error syncing: %v", backend, err)
+			}
+			have := make([]byte, tf.Length)
+			if _, err := s.ReadAt(have, 0); err != nil {
+				t.Fatalf("%s: unexpected error reading: %v", backend, err)
+			}
+			want := make([]byte, tf.Length)
+			copy(want[2:], data[:20])
+			copy(want[tf.Length-16:], data[20:])
+			if !bytes.Equal(have, want) {
+				t.Errorf("%s: expected to read back what was written", backend)
+			}
+			s.Close()
+			b, _ := os.ReadFile(filepath.Join(dir, tf.Files[3].Path))
+			if !bytes.Equal(b, want[tf.Files[3].Offset:]) {
+				t.Errorf("%s: expected the last file to hold %q, got %q", backend, want[tf.Files[3].Offset:], b)
+			}
+
+			info, err := os.Stat(filepath.Join(dir, tf.Files[2].Path))
+			if err != nil || ((prealloc || backend == BackendMmap) && info.Size() != 4096) {
+				t.Errorf("%s: expected the file to be sized up front, got %v (%v)", backend, info.Size(), err)
+			}
+		}
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := NewFiles(t.TempDir(), testTorrent(10), Options{Backend: "tape"}); err == nil {
+		t.Errorf("expected an error for an unknown backend")
+	}
+}
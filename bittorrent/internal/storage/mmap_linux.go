@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const mmapSupported = true
+
+// mmapFile is a file mapped into memory
+type mmapFile struct {
+	f    *os.File
+	data []byte
+}
+
+// mapFile maps the first length bytes of f, growing it to length first if it's shorter. Growing
+// it this way leaves a sparse file unless it was preallocated.
+func mapFile(f *os.File, length int) (*mmapFile, error) {
+	if err := growTo(f, int64(length)); err != nil {
+		return nil, err
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapFile{f: f, data: data}, nil
+}
+
+func (m *mmapFile) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *mmapFile) WriteAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > int64(len(m.data)) {
+		return 0, io.ErrShortWrite
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *mmapFile) Sync() error {
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&m.data[0])), uintptr(len(m.data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (m *mmapFile) Close() error {
+	err := syscall.Munmap(m.data)
+	if cerr := m.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+func mapFile(f *os.File, length int) (handle, error) {
+	return nil, errors.New("mmap isn't supported on this platform")
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves length bytes on disk for f with fallocate. Filesystems that can't do that
+// get a sparse file of the right size instead.
+func preallocate(f *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, length)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return growTo(f, length)
+	}
+	return err
+}
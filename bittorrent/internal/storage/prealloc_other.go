@@ -0,0 +1,10 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// preallocate sizes f to length bytes. Without fallocate the filesystem may leave it sparse.
+func preallocate(f *os.File, length int64) error {
+	return growTo(f, length)
+}
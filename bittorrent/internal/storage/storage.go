@@ -0,0 +1,41 @@
+// Package storage puts a torrent's data on disk. The torrent package only needs a Storage, so
+// anything addressed by offset into the torrent will do; Files lays the data out as the torrent's
+// files, backed by plain reads and writes or by memory mapping.
+package storage
+
+import "io"
+
+// Storage is where a torrent's data is written, addressed as though its files were laid end to end.
+// *os.File satisfies it for single file torrents.
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+}
+
+// Skipper is implemented by storage that can avoid creating the files we aren't downloading
+type Skipper interface {
+	SetSkipped(index int, skipped bool) error
+}
+
+// Backend is how Files reads and writes each file
+type Backend string
+
+const (
+	// BackendFile uses ordinary reads and writes
+	BackendFile Backend = "file"
+
+	// BackendMmap maps each file into memory, which makes the small random reads of seeding
+	// cheap. Files are sized to their full length when they're opened.
+	BackendMmap Backend = "mmap"
+)
+
+// Options controls how Files lays data out on disk
+type Options struct {
+	Backend Backend // BackendFile if empty
+
+	// Preallocate reserves each file's full size on disk when it's created, which avoids
+	// fragmentation as pieces arrive out of order. Otherwise files are sparse and only take up the
+	// space that's been written.
+	Preallocate bool
+}
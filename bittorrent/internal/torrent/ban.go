@@ -0,0 +1,129 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"sync"
+)
+
+// MaxHashFailures is how many pieces a peer can send us that fail their hash check before we ban it
+const MaxHashFailures = 3
+
+// blockRecord is what we keep of a block from a piece that failed its hash check, so the sender can
+// be identified once we have a good copy of the piece to compare against
+type blockRecord struct {
+	block int
+	ip    string
+	hash  [20]byte
+}
+
+// peerScores attributes hash failures to the peers whose blocks made up the bad piece, and decides
+// which of them to ban. Peers are tracked by IP so reconnecting on another port doesn't help.
+type peerScores struct {
+	mu       sync.Mutex
+	failures map[string]int
+	banned   map[string]bool
+	suspects map[int][]blockRecord // blocks of failed pieces that came from more than one peer
+	logf     func(format string, args ...any)
+}
+
+// newPeerScores returns scores that report bans through logf
+func newPeerScores(logf func(format string, args ...any)) *peerScores {
+	return &peerScores{
+		logf:     logf,
+		failures: map[string]int{},
+		banned:   map[string]bool{},
+		suspects: map[int][]blockRecord{},
+	}
+}
+
+// pieceFailed records a piece that failed its hash check. sources holds the IP that sent each block.
+// If a single peer sent the whole piece it takes the blame, otherwise the blocks are kept until a
+// good copy of the piece arrives and piecePassed can tell who sent the bad ones. Returns any IPs
+// that are newly banned.
+func (s *peerScores) pieceFailed(index int, buf []byte, sources []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !severalSources(sources) {
+		ip := sources[0]
+		s.failures[ip]++
+		if s.failures[ip] >= MaxHashFailures {
+			return s.ban(ip, fmt.Sprintf("sent %d pieces that failed hash checks", s.failures[ip]))
+		}
+		return nil
+	}
+	for i, ip := range sources {
+		s.suspects[index] = append(s.suspects[index], blockRecord{
+			block: i,
+			ip:    ip,
+			hash:  sha1.Sum(blockOf(buf, i)),
+		})
+	}
+	return nil
+}
+
+// piecePassed re-verifies the blocks kept from earlier failed copies of the piece against the good
+// copy, banning any peer whose block differs. Returns any IPs that are newly banned.
+func (s *peerScores) piecePassed(index int, buf []byte) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	suspects, ok := s.suspects[index]
+	if !ok {
+		return nil
+	}
+	delete(s.suspects, index)
+	banned := []string{}
+	for _, r := range suspects {
+		if sha1.Sum(blockOf(buf, r.block)) != r.hash {
+			banned = append(banned, s.ban(r.ip, fmt.Sprintf("sent a bad block in piece %d", index))...)
+		}
+	}
+	return banned
+}
+
+func (s *peerScores) isBanned(ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.banned[ip]
+}
+
+// bannedIPs returns every IP banned so far
+func (s *peerScores) bannedIPs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ips := make([]string, 0, len(s.banned))
+	for ip := range s.banned {
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// ban must be called with s.mu held
+func (s *peerScores) ban(ip, reason string) []string {
+	if s.banned[ip] {
+		return nil
+	}
+	s.logf("%s: banning peer, %s\n", ip, reason)
+	s.banned[ip] = true
+	return []string{ip}
+}
+
+// severalSources reports whether a piece's blocks came from more than one peer
+func severalSources(sources []string) bool {
+	for _, ip := range sources {
+		if ip != sources[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// blockOf returns the i'th block of a piece
+func blockOf(buf []byte, i int) []byte {
+	begin := i * MaxBlockSize
+	end := begin + MaxBlockSize
+	if end > len(buf) {
+		end = len(buf)
+	}
+	return buf[begin:end]
+}
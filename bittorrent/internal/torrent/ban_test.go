@@ -0,0 +1,46 @@
+package torrent
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSoleSourceBannedAfterRepeatedFailures(t *testing.T) {
+	s := newPeerScores(t.Logf)
+	buf := make([]byte, MaxBlockSize*2)
+	sources := []string{"10.0.0.1", "10.0.0.1"}
+	for i := 0; i < MaxHashFailures-1; i++ {
+		if banned := s.pieceFailed(0, buf, sources); len(banned) != 0 {
+			t.Fatalf("expected no ban after %d failures, got %v", i+1, banned)
+		}
+	}
+	banned := s.pieceFailed(0, buf, sources)
+	if len(banned) != 1 || banned[0] != "10.0.0.1" {
+		t.Errorf("expected 10.0.0.1 to be banned, got %v", banned)
+	}
+	if !s.isBanned("10.0.0.1") {
+		t.Errorf("expected 10.0.0.1 to be reported as banned")
+	}
+}
+
+func TestSmartBan(t *testing.T) {
+	s := newPeerScores(t.Logf)
+	good := bytes.Repeat([]byte{1}, MaxBlockSize*3)
+	bad := make([]byte, len(good))
+	copy(bad, good)
+	bad[MaxBlockSize+7] = 0 // poison the second block
+	sources := []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}
+	if banned := s.pieceFailed(4, bad, sources); len(banned) != 0 {
+		t.Fatalf("expected no ban until the piece is re-verified, got %v", banned)
+	}
+	banned := s.piecePassed(4, good)
+	if len(banned) != 1 || banned[0] != "10.0.0.2" {
+		t.Errorf("expected only 10.0.0.2 to be banned, got %v", banned)
+	}
+	if s.isBanned("10.0.0.1") || s.isBanned("10.0.0.3") {
+		t.Errorf("expected peers that sent good blocks not to be banned")
+	}
+	if banned := s.piecePassed(4, good); len(banned) != 0 {
+		t.Errorf("expected suspects to be cleared after re-verification, got %v", banned)
+	}
+}
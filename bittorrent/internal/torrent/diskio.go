@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+	"go-bt-learning.brk3.github.io/internal/client"
+)
+
+// NumHashers is how many pieces are hashed at once
+var NumHashers = runtime.NumCPU()
+
+// MaxQueuedPieces is how many downloaded pieces can wait to be hashed, and how many more can wait
+// to be written. Once both queues are full download workers stop reading from their peers, which
+// slows the peers down through TCP flow control rather than buffering without limit when the disk
+// falls behind.
+const MaxQueuedPieces = 16
+
+// ReadCacheSize is how many bytes of recently requested pieces a seeder keeps in memory
+const ReadCacheSize = 16 << 20
+
+// hashJob is a downloaded piece waiting to be verified
+type hashJob struct {
+	index   int
+	buf     []byte
+	sources []string       // the IP that sent each block
+	c       *client.Client // the peer that sent the last block
+	told    *toldPieces
+}
+
+// hashPool verifies downloaded pieces off the download workers, so a slow hash doesn't stall
+// reading from the peer. Pieces that pass go on to the disk queue.
+type hashPool struct {
+	jobs chan hashJob
+	wg   sync.WaitGroup
+}
+
+func (t *Torrent) startHashers(ctx context.Context, picker *piecePicker, resQueue chan pieceResult) *hashPool {
+	h := &hashPool{jobs: make(chan hashJob, MaxQueuedPieces)}
+	for i := 0; i < NumHashers; i++ {
+		h.wg.Add(1)
+		go func() {
+			defer h.wg.Done()
+			for job := range h.jobs {
+				t.verify(ctx, job, picker, resQueue)
+			}
+		}()
+	}
+	return h
+}
+
+// submit queues a piece to be verified, blocking while the queue is full. It returns false if ctx
+// is cancelled first.
+func (h *hashPool) submit(ctx context.Context, job hashJob) bool {
+	select {
+	case h.jobs <- job:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// close waits for queued pieces to be dealt with. Nothing may be submitted once it's called.
+func (h *hashPool) close() {
+	close(h.jobs)
+	h.wg.Wait()
+}
+
+// verify checks a piece and passes it on to be written, or puts it back to be downloaded again and
+// holds the peers that sent it to account if it's corrupt
+func (t *Torrent) verify(ctx context.Context, job hashJob, picker *piecePicker, resQueue chan pieceResult) {
+	peer := job.c.Peer
+	if err := t.checkIntegrity(job.index, job.buf); err != nil {
+		t.logf("%s: piece #%d failed integrity check, requeueing\n", peer.String(), job.index)
+		if severalSources(job.sources) {
+			picker.abortSolo(job.index)
+		} else {
+			picker.abort(job.index)
+		}
+		t.ban(t.scores.pieceFailed(job.index, job.buf, job.sources)) // which disconnects them
+		return
+	}
+	t.ban(t.scores.piecePassed(job.index, job.buf))
+	select {
+	case resQueue <- pieceResult{index: job.index, buf: job.buf}:
+	case <-ctx.Done():
+		picker.abort(job.index)
+		return
+	}
+	// the peer hears about the piece straight away, rather than once it's been written
+	piece := bitfield.New(t.File.NumPieces())
+	piece.SetPiece(job.index)
+	if err := job.told.tell(job.c, piece); err != nil {
+		t.logf("%s: error sending have message: %v\n", peer.String(), err)
+	}
+}
+
+// toldPieces tracks which of our pieces a peer has been told we have, or doesn't need to be. Both
+// the peer's worker and the hashers tell it about pieces, so it's locked.
+type toldPieces struct {
+	mu sync.Mutex
+	bf bitfield.Bitfield
+}
+
+// tell sends a have message for each of the pieces the peer hasn't been told about
+func (tp *toldPieces) tell(c *client.Client, pieces bitfield.Bitfield) error {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	news := pieces.AndNot(tp.bf)
+	for i := news.NextSet(0); i != -1; i = news.NextSet(i + 1) {
+		tp.bf.SetPiece(i)
+		if err := c.SendHave(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writePieces writes verified pieces to storage. Runs of consecutive pieces are coalesced into one
+// write, as they're next to each other in the torrent's data.
+func (t *Torrent) writePieces(batch []pieceResult) error {
+	sort.Slice(batch, func(i, j int) bool { return batch[i].index < batch[j].index })
+	for start := 0; start < len(batch); {
+		end := start + 1
+		for end < len(batch) && batch[end].index == batch[end-1].index+1 {
+			end++
+		}
+		buf := batch[start].buf
+		if end-start > 1 {
+			buf = nil
+			for _, res := range batch[start:end] {
+				buf = append(buf, res.buf...)
+			}
+		}
+		begin, _ := t.calculateBoundsForPiece(batch[start].index)
+		if _, err := t.Storage.WriteAt(buf, int64(begin)); err != nil {
+			return fmt.Errorf("error writing pieces %d to %d: %w", batch[start].index, batch[end-1].index, err)
+		}
+		start = end
+	}
+	return nil
+}
+
+// readCache keeps the pieces peers have asked for most recently in memory, so serving a piece a
+// block at a time reads it from disk once
+type readCache struct {
+	mu     sync.Mutex
+	max    int // bytes
+	size   int
+	lru    *list.List // of *cachedPiece, most recently used first
+	pieces map[int]*list.Element
+}
+
+type cachedPiece struct {
+	index int
+	buf   []byte
+}
+
+func newReadCache(max int) *readCache {
+	return &readCache{max: max, lru: list.New(), pieces: map[int]*list.Element{}}
+}
+
+// get returns a piece from the cache, or loads it if it isn't there. The piece mustn't be
+// modified.
+func (rc *readCache) get(index int, load func() ([]byte, error)) ([]byte, error) {
+	rc.mu.Lock()
+	if e, ok := rc.pieces[index]; ok {
+		rc.lru.MoveToFront(e)
+		rc.mu.Unlock()
+		return e.Value.(*cachedPiece).buf, nil
+	}
+	rc.mu.Unlock()
+	buf, err := load()
+	if err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if _, ok := rc.pieces[index]; !ok {
+		rc.pieces[index] = rc.lru.PushFront(&cachedPiece{index, buf})
+		rc.size += len(buf)
+	}
+	for rc.size > rc.max && rc.lru.Len() > 1 {
+		oldest := rc.lru.Remove(rc.lru.Back()).(*cachedPiece)
+		delete(rc.pieces, oldest.index)
+		rc.size -= len(oldest.buf)
+	}
+	return buf, nil
+}
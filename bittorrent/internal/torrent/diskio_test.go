@@ -0,0 +1,124 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+	"go-bt-learning.brk3.github.io/internal/client"
+)
+
+// countingStorage records the writes made to it
+type countingStorage struct {
+	*os.File
+	writes []int64
+}
+
+func (s *countingStorage) WriteAt(p []byte, off int64) (int, error) {
+	s.writes = append(s.writes, off)
+	return s.File.WriteAt(p, off)
+}
+
+func TestWritePiecesCoalesces(t *testing.T) {
+	tf, data := testTorrentFile(100000, 16384)
+	to := NewTorrent(tf)
+	storage := &countingStorage{File: newTestStorage(t)}
+	to.Storage = storage
+	batch := []pieceResult{}
+	for _, index := range []int{3, 0, 1, 5, 4} {
+		begin, end := to.calculateBoundsForPiece(index)
+		batch = append(batch, pieceResult{index: index, buf: data[begin:end]})
+	}
+	if err := to.writePieces(batch); err != nil {
+		t.Fatalf("unexpected error writing pieces: %v", err)
+	}
+	if want := []int64{0, 3 * 16384}; fmt.Sprint(storage.writes) != fmt.Sprint(want) {
+		t.Errorf("expected pieces 0-1 and 3-5 written at offsets %v, got %v", want, storage.writes)
+	}
+	have := make([]byte, 6*16384)
+	storage.ReadAt(have, 0)
+	copy(have[2*16384:3*16384], data[2*16384:]) // never written
+	if !bytes.Equal(have, data[:6*16384]) {
+		t.Errorf("written pieces don't match")
+	}
+}
+
+func TestReadCache(t *testing.T) {
+	rc := newReadCache(20)
+	loads := 0
+	load := func(n int) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			loads++
+			return make([]byte, n), nil
+		}
+	}
+	rc.get(0, load(10))
+	rc.get(1, load(10))
+	rc.get(0, load(10)) // now the most recently used
+	if loads != 2 {
+		t.Errorf("expected a cached piece not to be loaded again, got %d loads", loads)
+	}
+	rc.get(2, load(10)) // evicts 1
+	rc.get(0, load(10))
+	if loads != 3 {
+		t.Errorf("expected the most recently used piece to stay cached, got %d loads", loads)
+	}
+	rc.get(1, load(10))
+	if loads != 4 || rc.size != 20 {
+		t.Errorf("expected the least recently used piece to be evicted, got %d loads and %d bytes cached", loads, rc.size)
+	}
+}
+
+// BenchmarkDownload measures download throughput from a swarm of local seeders
+func BenchmarkDownload(b *testing.B) {
+	tf, data := testTorrentFile(8<<20, 256<<10)
+	for _, numPeers := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("peers=%d", numPeers), func(b *testing.B) {
+			peers := []client.Peer{}
+			for i := 0; i < numPeers; i++ {
+				s := newFakeSeeder(b, tf, data, true)
+				defer s.close()
+				peers = append(peers, s.peer())
+			}
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				to := NewTorrent(tf)
+				to.Storage = newTestStorage(b)
+				to.Peers = peers
+				if err := to.Download(context.Background()); err != nil {
+					b.Fatalf("unexpected error downloading: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSeed measures how fast a seeder serves a whole torrent to one peer
+func BenchmarkSeed(b *testing.B) {
+	tf, data := testTorrentFile(8<<20, 256<<10)
+	storage := newTestStorage(b)
+	storage.WriteAt(data, 0)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		seeder := NewTorrent(tf)
+		seeder.Storage = storage
+		seeder.Bitfield = bitfield.Full(tf.NumPieces())
+		peer, stop := seedTo(b, seeder)
+		to := NewTorrent(tf)
+		to.Storage = newTestStorage(b)
+		to.Peers = []client.Peer{peer}
+		b.StartTimer()
+		if err := to.Download(context.Background()); err != nil {
+			b.Fatalf("unexpected error downloading: %v", err)
+		}
+		b.StopTimer()
+		stop()
+		b.StartTimer()
+	}
+}
@@ -0,0 +1,655 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/merkle"
+	"go-bt-learning.brk3.github.io/internal/message"
+	"go-bt-learning.brk3.github.io/internal/storage"
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+	"go-bt-learning.brk3.github.io/internal/tracker"
+)
+
+// testTorrentFile builds a torrent file describing random data of the given length
+func testTorrentFile(length, pieceLength int) (torrentfile.TorrentFile, []byte) {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(1)).Read(data)
+	tf := torrentfile.TorrentFile{
+		InfoHash:    sha1.Sum([]byte("test torrent")),
+		PieceLength: pieceLength,
+		Length:      length,
+		Name:        "test",
+	}
+	for begin := 0; begin < length; begin += pieceLength {
+		end := begin + pieceLength
+		if end > length {
+			end = length
+		}
+		tf.PieceHashes = append(tf.PieceHashes, sha1.Sum(data[begin:end]))
+	}
+	return tf, data
+}
+
+// hybridTorrentFile adds v2 hashes to a test torrent file, as if it were a hybrid torrent
+func hybridTorrentFile(tf torrentfile.TorrentFile, data []byte) torrentfile.TorrentFile {
+	tf.MetaVersion = 2
+	tf.InfoHashV2 = sha256.Sum256([]byte("test torrent v2"))
+	leaves := tf.PieceLength / merkle.BlockSize
+	for begin := 0; begin < tf.Length; begin += tf.PieceLength {
+		end := begin + tf.PieceLength
+		if end > tf.Length {
+			end = tf.Length
+		}
+		hash := merkle.Root(merkle.Leaves(data[begin:end]), leaves, [32]byte{})
+		tf.PiecesV2 = append(tf.PiecesV2, torrentfile.V2Piece{Hash: hash, Length: end - begin, Leaves: leaves})
+	}
+	return tf
+}
+
+// fakeSeeder serves data to anyone that connects, misbehaving as its faults say
+type fakeSeeder struct {
+	ln     net.Listener
+	id     [20]byte
+	tf     torrentfile.TorrentFile
+	data   []byte
+	faults faults
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  []net.Conn
+	rand   *rand.Rand
+	served int // blocks sent
+}
+
+// faults are ways a fake seeder can make downloading from it harder
+type faults struct {
+	choke   bool          // never let anyone download
+	silent  bool          // unchoke, then never answer a request
+	answer  int           // if set, how many requests to answer before going silent
+	latency time.Duration // delay before sending each block
+	loss    float64       // chance of dropping the connection instead of sending a block
+	corrupt map[int]bool  // pieces sent with a byte flipped
+}
+
+// seederIDs numbers fake seeders, so each has its own peer id and isn't taken for a duplicate of
+// another
+var seederIDs int32
+
+// newFakeSeeder starts a well behaved seeder, or one that never unchokes if unchoke is false
+func newFakeSeeder(t testing.TB, tf torrentfile.TorrentFile, data []byte, unchoke bool) *fakeSeeder {
+	return newFaultySeeder(t, "127.0.0.1", tf, data, faults{choke: !unchoke})
+}
+
+// newFaultySeeder starts a seeder listening on ip
+func newFaultySeeder(t testing.TB, ip string, tf torrentfile.TorrentFile, data []byte, f faults) *fakeSeeder {
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	s := &fakeSeeder{ln: ln, tf: tf, data: data, faults: f, rand: rand.New(rand.NewSource(1))}
+	copy(s.id[:], fmt.Sprintf("fakeseeder-%09d", atomic.AddInt32(&seederIDs, 1)))
+	s.wg.Add(1)
+	go s.accept()
+	return s
+}
+
+func (s *fakeSeeder) peer() client.Peer {
+	addr := s.ln.Addr().(*net.TCPAddr)
+	return client.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func (s *fakeSeeder) close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *fakeSeeder) accept() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serve(conn)
+	}
+}
+
+func (s *fakeSeeder) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	buf := make([]byte, 68)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	h := client.Handshake{Pstr: "BitTorrent protocol", InfoHash: s.tf.InfoHash, PeerID: s.id}
+	conn.Write(h.Serialize())
+	bf := make([]byte, (s.tf.NumPieces()+7)/8)
+	for i := 0; i < s.tf.NumPieces(); i++ {
+		bf[i/8] |= 1 << (7 - i%8)
+	}
+	conn.Write((&message.Message{ID: message.MsgBitfield, Payload: bf}).Serialize())
+	if !s.faults.choke {
+		conn.Write((&message.Message{ID: message.MsgUnchoke}).Serialize())
+	}
+	for {
+		msg, err := message.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgRequest || s.faults.silent {
+			continue
+		}
+		index := int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+		length := int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+		offset := index*s.tf.PieceLength + begin
+		payload := make([]byte, 8+length)
+		copy(payload, msg.Payload[:8])
+		copy(payload[8:], s.data[offset:offset+length])
+		time.Sleep(s.faults.latency)
+		s.mu.Lock()
+		if s.faults.answer > 0 && s.served >= s.faults.answer {
+			s.mu.Unlock()
+			continue
+		}
+		lost := s.rand.Float64() < s.faults.loss
+		if !lost {
+			s.served++
+		}
+		s.mu.Unlock()
+		if lost {
+			return
+		}
+		if s.faults.corrupt[index] {
+			payload[8] ^= 0xff
+		}
+		conn.Write((&message.Message{ID: message.MsgPiece, Payload: payload}).Serialize())
+	}
+}
+
+// fakeTracker hands out a fixed set of peers and records the events it's sent
+type fakeTracker struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []string
+}
+
+func newFakeTracker(peers ...client.Peer) *fakeTracker {
+	ft := &fakeTracker{}
+	compact := []byte{}
+	for _, p := range peers {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, p.Port)
+		compact = append(compact, p.IP.To4()...)
+		compact = append(compact, port...)
+	}
+	ft.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ft.mu.Lock()
+		ft.events = append(ft.events, r.URL.Query().Get("event"))
+		ft.mu.Unlock()
+		io.WriteString(w, "d8:intervali1800e5:peers"+strconv.Itoa(len(compact))+":"+string(compact)+"e")
+	}))
+	return ft
+}
+
+// checkGoroutines fails the test if more goroutines are running when the returned function is
+// called than when checkGoroutines was
+func checkGoroutines(t *testing.T) func() {
+	before := runtime.NumGoroutine()
+	return func() {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for runtime.NumGoroutine() > before {
+			if time.Now().After(deadline) {
+				buf := make([]byte, 1<<16)
+				n := runtime.Stack(buf, true)
+				t.Fatalf("leaked goroutines: %d before, %d after\n%s", before, runtime.NumGoroutine(), buf[:n])
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func newTestStorage(t testing.TB) *os.File {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatalf("error creating storage: %v", err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// newFileStorage lays tf's files out under dir, closing them when the test ends
+func newFileStorage(t testing.TB, dir string, tf torrentfile.TorrentFile) *storage.Files {
+	files, err := storage.NewFiles(dir, tf, storage.Options{})
+	if err != nil {
+		t.Fatalf("error creating storage: %v", err)
+	}
+	t.Cleanup(func() { files.Close() })
+	return files
+}
+
+func TestDownload(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 32768)
+	// slow enough that neither seeder is done before the other connects
+	s1 := newFaultySeeder(t, "127.0.0.1", tf, data, faults{latency: 5 * time.Millisecond})
+	s2 := newFaultySeeder(t, "127.0.0.1", tf, data, faults{latency: 5 * time.Millisecond})
+	tracker := newFakeTracker(s1.peer(), s2.peer())
+	tf.Announce = tracker.URL + "/announce"
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	if err := to.Announce(context.Background(), client.PeerID, 6881); err != nil {
+		t.Fatalf("unexpected error announcing: %v", err)
+	}
+	if err := to.Download(context.Background()); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	s1.close()
+	s2.close()
+	tracker.Close()
+	leaks()
+
+	have, err := os.ReadFile(to.Storage.(*os.File).Name())
+	if err != nil {
+		t.Fatalf("error reading downloaded data: %v", err)
+	}
+	if !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+	if s1.served == 0 || s2.served == 0 {
+		t.Errorf("expected both seeders to be downloaded from, got %d and %d blocks", s1.served, s2.served)
+	}
+	if want := []string{"started", "stopped"}; strings.Join(tracker.events, ",") != strings.Join(want, ",") {
+		t.Errorf("expected tracker events %v, got %v", want, tracker.events)
+	}
+}
+
+// TestDownloadCancelledWhileAddingPeers stops a download while local peer discovery is still
+// adding peers, checking the stopped announce doesn't race with it or forget the tracker's peers
+func TestDownloadCancelledWhileAddingPeers(t *testing.T) {
+	tf, data := testTorrentFile(100000, 32768)
+	seeder := newFakeSeeder(t, tf, data, false)
+	defer seeder.close()
+	tracker := newFakeTracker(seeder.peer())
+	defer tracker.Close()
+	tf.Announce = tracker.URL + "/announce"
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	if err := to.Announce(context.Background(), client.PeerID, 6881); err != nil {
+		t.Fatalf("unexpected error announcing: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	added := make(chan struct{})
+	go func() {
+		defer close(added)
+		lsdPeer := client.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			to.AddPeers([]client.Peer{lsdPeer}, SourceLSD)
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	err := to.Download(ctx)
+	close(done)
+	<-added
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected the download to be cancelled, got %v", err)
+	}
+	found := false
+	for _, p := range to.Peers {
+		found = found || p.Port == seeder.peer().Port
+	}
+	if !found {
+		t.Errorf("expected the tracker's peer to be kept after stopping, got %v", to.Peers)
+	}
+}
+
+// TestDownloadWithTracker runs a whole swarm locally, with the seeder found through our own tracker
+func TestDownloadWithTracker(t *testing.T) {
+	tf, data := testTorrentFile(100000, 32768)
+	seeder := newFakeSeeder(t, tf, data, true)
+	defer seeder.close()
+	srv := httptest.NewServer(tracker.NewServer(time.Minute).Handler())
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+
+	seed := tf
+	seed.Length = 0 // nothing left to download
+	u, err := seed.BuildTrackerURL("fake-seeder-peer-id.", seeder.peer().Port, "started")
+	if err != nil {
+		t.Fatalf("error building tracker url: %v", err)
+	}
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("error announcing seeder: %v", err)
+	}
+	res.Body.Close()
+
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	if err := to.Announce(context.Background(), client.PeerID, 6881); err != nil {
+		t.Fatalf("unexpected error announcing: %v", err)
+	}
+	if len(to.Peers) != 1 || to.Peers[0].Port != seeder.peer().Port {
+		t.Fatalf("expected the tracker to hand out the seeder, got %v", to.Peers)
+	}
+	if err := to.Download(context.Background()); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	have, _ := os.ReadFile(to.Storage.(*os.File).Name())
+	if !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+	scrape, err := to.Scrape(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error scraping: %v", err)
+	}
+	if want := (ScrapeResult{Seeders: 1}); scrape != want {
+		t.Errorf("expected only the seeder left once we stopped, got %+v", scrape)
+	}
+}
+
+func TestAnnounceInfoHash(t *testing.T) {
+	srv := httptest.NewServer(tracker.NewServer(time.Minute).Handler())
+	defer srv.Close()
+	tf, _ := testTorrentFile(100000, 32768)
+	tf.Announce = srv.URL + "/announce"
+	tf.Length = 0
+	u, err := tf.BuildTrackerURL("fake-seeder-peer-id.", 7000, "started")
+	if err != nil {
+		t.Fatalf("error building tracker url: %v", err)
+	}
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("error announcing seeder: %v", err)
+	}
+	res.Body.Close()
+
+	// the tracker only hands out the seeder if it thinks we're a leecher
+	peers, err := AnnounceInfoHash(context.Background(), tf.Announce, tf.InfoHash, client.PeerID, 6881)
+	if err != nil {
+		t.Fatalf("unexpected error announcing: %v", err)
+	}
+	if len(peers) != 1 || peers[0].Port != 7000 {
+		t.Errorf("expected the tracker to hand out the seeder, got %v", peers)
+	}
+}
+
+func TestDownloadCancel(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 32768)
+	s := newFakeSeeder(t, tf, data, false) // never unchokes, so the download can't finish
+	tracker := newFakeTracker(s.peer())
+	tf.Announce = tracker.URL + "/announce"
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	if err := to.Announce(context.Background(), client.PeerID, 6881); err != nil {
+		t.Fatalf("unexpected error announcing: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := to.Download(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+	s.close()
+	tracker.Close()
+	leaks()
+	if tracker.events[len(tracker.events)-1] != "stopped" {
+		t.Errorf("expected a stopped announce on cancel, got events %v", tracker.events)
+	}
+}
+
+// TestDownloadCancelMidPiece checks cancelling stops a download that's waiting on blocks from a
+// peer that's gone quiet
+func TestDownloadCancelMidPiece(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 32768)
+	s := newFaultySeeder(t, "127.0.0.1", tf, data, faults{silent: true})
+	tracker := newFakeTracker(s.peer())
+	tf.Announce = tracker.URL + "/announce"
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	if err := to.Announce(context.Background(), client.PeerID, 6881); err != nil {
+		t.Fatalf("unexpected error announcing: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := to.Download(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded error, got %v", err)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Errorf("expected the download to stop promptly once cancelled, took %v", took)
+	}
+	s.close()
+	tracker.Close()
+	leaks()
+}
+
+// TestDownloadBansCorruptSeeder checks a seeder sending nothing but bad pieces is banned, while the
+// download carries on from an honest one
+func TestDownloadBansCorruptSeeder(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(8*32768, 32768)
+	allPieces := map[int]bool{}
+	for i := 0; i < tf.NumPieces(); i++ {
+		allPieces[i] = true
+	}
+	badIP, goodIP := loopbackIP(t, 2), loopbackIP(t, 3)
+	bad := newFaultySeeder(t, badIP, tf, data, faults{corrupt: allPieces})
+	// slow enough that the corrupt seeder fails several pieces before the download is done
+	good := newFaultySeeder(t, goodIP, tf, data, faults{latency: 5 * time.Millisecond})
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	to.Peers = []client.Peer{bad.peer(), good.peer()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := to.Download(ctx); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	bad.close()
+	good.close()
+	leaks()
+
+	have, _ := os.ReadFile(to.Storage.(*os.File).Name())
+	if !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+	if !to.scores.isBanned(badIP) || to.scores.isBanned(goodIP) {
+		t.Errorf("expected only the corrupt seeder to be banned, got %v", to.scores.banned)
+	}
+}
+
+// TestBanOutlivesDownload checks a peer banned while no download was running is still refused by
+// the next one
+func TestBanOutlivesDownload(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(4*32768, 32768)
+	badIP, goodIP := loopbackIP(t, 2), loopbackIP(t, 3)
+	bad := newFaultySeeder(t, badIP, tf, data, faults{})
+	good := newFaultySeeder(t, goodIP, tf, data, faults{})
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	for i := 0; i < MaxHashFailures; i++ {
+		to.ban(to.scores.pieceFailed(0, nil, []string{badIP}))
+	}
+	to.Peers = []client.Peer{bad.peer(), good.peer()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := to.Download(ctx); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	bad.close()
+	good.close()
+	leaks()
+
+	have, _ := os.ReadFile(to.Storage.(*os.File).Name())
+	if !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+	if bad.served != 0 {
+		t.Errorf("expected nothing to be downloaded from the banned peer, got %d blocks", bad.served)
+	}
+}
+
+// TestDownloadSmartBan checks a piece assembled from two peers in endgame, where only one of them
+// sent bad blocks, gets the bad peer banned and not the good one
+func TestDownloadSmartBan(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(8*MaxBlockSize, 8*MaxBlockSize)
+	badIP, goodIP := loopbackIP(t, 2), loopbackIP(t, 3)
+	// the bad seeder sends a couple of blocks and leaves the good one to send the rest
+	bad := newFaultySeeder(t, badIP, tf, data, faults{answer: 2, corrupt: map[int]bool{0: true}})
+	good := newFaultySeeder(t, goodIP, tf, data, faults{latency: 20 * time.Millisecond})
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	to.Peers = []client.Peer{bad.peer(), good.peer()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := to.Download(ctx); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	bad.close()
+	good.close()
+	leaks()
+
+	have, _ := os.ReadFile(to.Storage.(*os.File).Name())
+	if !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+	if !to.scores.isBanned(badIP) || to.scores.isBanned(goodIP) {
+		t.Errorf("expected only the seeder that sent bad blocks to be banned, got %v", to.scores.banned)
+	}
+	if to.scores.failures[badIP] != 0 {
+		t.Errorf("expected the bad seeder to be caught by comparing blocks, not by counting failures")
+	}
+}
+
+// TestDownloadHybrid checks a hybrid torrent downloads from its v2 swarm, whose peers only know
+// the torrent by its v2 info hash
+func TestDownloadHybrid(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 32768)
+	tf = hybridTorrentFile(tf, data)
+	v1 := newFakeSeeder(t, tf, data, false) // never unchokes, so only the v2 swarm can finish it
+	v2tf := tf
+	v2tf.InfoHash = tf.SwarmHashes()[1]
+	v2 := newFakeSeeder(t, v2tf, data, true)
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	to.Peers = []client.Peer{v1.peer()}
+	to.PeersV2 = []client.Peer{v2.peer()}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := to.Download(ctx); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	v1.close()
+	v2.close()
+	leaks()
+	have, _ := os.ReadFile(to.Storage.(*os.File).Name())
+	if !bytes.Equal(have, data) {
+		t.Errorf("downloaded data doesn't match")
+	}
+}
+
+func TestCheckIntegrityV2(t *testing.T) {
+	tf, data := testTorrentFile(100000, 32768)
+	to := NewTorrent(hybridTorrentFile(tf, data))
+	piece := append([]byte{}, data[32768:65536]...)
+	if err := to.checkIntegrity(1, piece); err != nil {
+		t.Errorf("unexpected error checking a good piece: %v", err)
+	}
+	// a piece that passes SHA-1 but not its merkle tree still fails
+	to.File.PiecesV2[1].Hash[0] ^= 1
+	if err := to.checkIntegrity(1, piece); err == nil {
+		t.Errorf("expected a piece with a bad merkle tree to fail")
+	}
+	if err := to.checkIntegrity(tf.NumPieces(), piece); err == nil {
+		t.Errorf("expected a piece past the end of the torrent to fail")
+	}
+}
+
+func TestPrivatePeerSources(t *testing.T) {
+	tf, _ := testTorrentFile(1000, 256)
+	tf.Private = true
+	to := NewTorrent(tf)
+	peer := client.Peer{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+	for _, source := range []PeerSource{SourceDHT, SourcePEX, SourceLSD} {
+		if to.AddPeers([]client.Peer{peer}, source) {
+			t.Errorf("expected private torrent to refuse peers from %s", source)
+		}
+	}
+	if !to.AddPeers([]client.Peer{peer}, SourceTracker) {
+		t.Errorf("expected private torrent to accept peers from the tracker")
+	}
+	if len(to.Peers) != 1 {
+		t.Errorf("expected only the tracker's peer to be kept, got %v", to.Peers)
+	}
+
+	tf.Private = false
+	to = NewTorrent(tf)
+	if !to.AddPeers([]client.Peer{peer}, SourceLSD) {
+		t.Errorf("expected public torrent to accept peers from lsd")
+	}
+}
+
+// TestDownloadEvictsChokingPeer checks a peer that never unchokes us is dropped rather than held
+// onto forever
+func TestDownloadEvictsChokingPeer(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 32768)
+	s := newFakeSeeder(t, tf, data, false)
+	to := NewTorrent(tf)
+	to.Storage = newTestStorage(t)
+	to.Peers = []client.Peer{s.peer()}
+	to.Conns.IdleTimeout = 100 * time.Millisecond
+	to.Conns.BackoffBase = time.Millisecond
+	to.Conns.MaxAttempts = 2
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := to.Download(ctx); !errors.Is(err, errNoPeers) {
+		t.Errorf("expected to run out of peers, got %v", err)
+	}
+	s.close()
+	leaks()
+}
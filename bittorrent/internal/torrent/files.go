@@ -0,0 +1,84 @@
+package torrent
+
+import (
+	"fmt"
+
+	"go-bt-learning.brk3.github.io/internal/storage"
+)
+
+// FilePriorities returns the priority of each of the torrent's files
+func (t *Torrent) FilePriorities() []Priority {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Priority{}, t.filePriorities...)
+}
+
+// SetFilePriority changes a file's priority. If a download is running it picks up the change
+// straight away, so skipping a file stops any more of its pieces being fetched.
+func (t *Torrent) SetFilePriority(index int, p Priority) error {
+	if index < 0 || index >= len(t.File.Files) {
+		return fmt.Errorf("file index %d out of range, torrent has %d files", index, len(t.File.Files))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.filePriorities[index] = p
+	if s, ok := t.Storage.(storage.Skipper); ok {
+		if err := s.SetSkipped(index, p == PrioritySkip); err != nil {
+			return err
+		}
+	}
+	if t.picker != nil {
+		t.picker.setPriorities(t.piecePriorities())
+	}
+	return nil
+}
+
+// piecePriorities gives each piece the highest priority of the files it overlaps. Must be called
+// with t.mu held.
+func (t *Torrent) piecePriorities() []Priority {
+	res := make([]Priority, t.File.NumPieces())
+	file := 0
+	for index := range res {
+		begin, end := t.calculateBoundsForPiece(index)
+		// skip files that end before this piece, including empty ones
+		for file < len(t.File.Files) && t.File.Files[file].Offset+t.File.Files[file].Length <= begin {
+			file++
+		}
+		for f := file; f < len(t.File.Files) && t.File.Files[f].Offset < end; f++ {
+			if !t.File.Files[f].Padding && t.filePriorities[f] > res[index] {
+				res[index] = t.filePriorities[f]
+			}
+		}
+	}
+	return res
+}
+
+// applySkipped tells storage which files are skipped before a download starts. Must be called with
+// t.mu held.
+func (t *Torrent) applySkipped() error {
+	s, ok := t.Storage.(storage.Skipper)
+	if !ok {
+		return nil
+	}
+	for index, p := range t.filePriorities {
+		if p == PrioritySkip {
+			if err := s.SetSkipped(index, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Remaining returns how many pieces we want but don't have yet
+func (t *Torrent) Remaining() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for index, p := range t.piecePriorities() {
+		if p != PrioritySkip && !t.Bitfield.HasPiece(index) {
+			n++
+		}
+	}
+	return n
+}
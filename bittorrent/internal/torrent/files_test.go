@@ -0,0 +1,116 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// multiFile splits tf into files of the given lengths
+func multiFile(tf torrentfile.TorrentFile, lengths ...int) torrentfile.TorrentFile {
+	offset := 0
+	for i, l := range lengths {
+		path := filepath.Join(tf.Name, string(rune('a'+i)))
+		tf.Files = append(tf.Files, torrentfile.File{Path: path, Length: l, Offset: offset})
+		offset += l
+	}
+	return tf
+}
+
+func TestPiecePriorities(t *testing.T) {
+	tf, _ := testTorrentFile(100, 10)
+	to := NewTorrent(multiFile(tf, 25, 0, 30, 45))
+	to.SetFilePriority(0, PrioritySkip)
+	to.SetFilePriority(2, PriorityHigh)
+	want := []Priority{
+		PrioritySkip, PrioritySkip, // only file a
+		PriorityHigh, PriorityHigh, PriorityHigh, PriorityHigh, // file c, shared with a and d at the ends
+		PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal, // file d
+	}
+	to.mu.Lock()
+	have := to.piecePriorities()
+	to.mu.Unlock()
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("expected piece priorities %v, got %v", want, have)
+	}
+}
+
+func TestPickerOrder(t *testing.T) {
+	p := newPiecePicker([]Priority{PriorityNormal, PrioritySkip, PriorityHigh, PriorityNormal}, make(bitfield.Bitfield, 1))
+	all := bitfield.Bitfield{0xff}
+	want := []int{2, 0, 3}
+	for _, w := range want {
+		index, ok, _ := p.pick(all)
+		if !ok || index != w {
+			t.Fatalf("expected to pick piece %d, got %d (ok %v)", w, index, ok)
+		}
+	}
+	_, ok, wait := p.pick(all)
+	if ok {
+		t.Fatalf("expected nothing left to pick")
+	}
+	p.abort(3)
+	select {
+	case <-wait:
+	default:
+		t.Errorf("expected aborting a piece to wake waiting workers")
+	}
+	if index, ok, _ := p.pick(all); !ok || index != 3 {
+		t.Errorf("expected aborted piece 3 to be picked again, got %d (ok %v)", index, ok)
+	}
+}
+
+func TestPickerInteresting(t *testing.T) {
+	p := newPiecePicker([]Priority{PriorityNormal, PrioritySkip, PriorityNormal}, bitfield.Bitfield{0x80})
+	if p.interesting(bitfield.Bitfield{0xc0}) {
+		t.Errorf("expected a peer with only pieces we have or skip to be uninteresting")
+	}
+	if !p.interesting(bitfield.Bitfield{0x20}) || p.remaining() != 1 {
+		t.Errorf("expected piece 2 to be the only one we need")
+	}
+	p.finish(2)
+	if p.interesting(bitfield.Bitfield{0x20}) || p.remaining() != 0 {
+		t.Errorf("expected nothing left to need once piece 2 is done")
+	}
+}
+
+func TestDownloadSkippedFile(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 16384)
+	tf = multiFile(tf, 40000, 40000, 20000)
+	seeder := newFakeSeeder(t, tf, data, true)
+	dir := t.TempDir()
+	to := NewTorrent(tf)
+	files := newFileStorage(t, dir, tf)
+	to.Storage = files
+	to.Peers = []client.Peer{seeder.peer()}
+	to.SetFilePriority(1, PrioritySkip)
+	if err := to.Download(context.Background()); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	files.Close()
+	seeder.close()
+	leaks()
+
+	if _, err := os.Stat(filepath.Join(dir, tf.Files[1].Path)); !os.IsNotExist(err) {
+		t.Errorf("expected skipped file not to be created, stat returned %v", err)
+	}
+	for _, i := range []int{0, 2} {
+		f := tf.Files[i]
+		b, err := os.ReadFile(filepath.Join(dir, f.Path))
+		if err != nil || !bytes.Equal(b, data[f.Offset:f.Offset+f.Length]) {
+			t.Errorf("file %d doesn't match the torrent's data (%v)", i, err)
+		}
+	}
+	// pieces 2 and 4 overlap the skipped file so were downloaded, the one entirely inside it wasn't
+	if to.Bitfield.HasPiece(3) || !to.Bitfield.HasPiece(2) || !to.Bitfield.HasPiece(4) {
+		t.Errorf("unexpected pieces downloaded: %08b", to.Bitfield)
+	}
+}
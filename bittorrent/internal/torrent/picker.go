@@ -0,0 +1,315 @@
+package torrent
+
+import (
+	"fmt"
+	"sync"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+)
+
+// Priority decides whether and how soon a file or piece is downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority is the inverse of Priority.String
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range []Priority{PrioritySkip, PriorityNormal, PriorityHigh} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+// window is a range of pieces a reader is about to need, from start up to but not including end
+type window struct {
+	start, end int
+}
+
+// piecePicker hands out pieces to download workers, making sure no two workers are given the same
+// piece. Pieces in a reader's window come first, closest to the reader first, then the rest highest
+// priority first and in order within a priority. Once there's nothing left to hand out, workers can
+// join pieces already being downloaded and fetch the blocks still missing (endgame).
+type piecePicker struct {
+	mu         sync.Mutex
+	windows    []window
+	priorities []Priority
+	have       bitfield.Bitfield
+	want       bitfield.Bitfield // pieces we don't have that aren't skipped
+	inProgress bitfield.Bitfield
+	partial    map[int]*partialPiece // pieces peers are sending us block by block
+	solo       bitfield.Bitfield     // pieces to fetch from a single peer, as a mixed copy failed
+	wake       chan struct{}         // closed and replaced whenever more pieces might be available
+}
+
+// partialPiece is a piece being downloaded. Each block is kept from whichever peer sends it first,
+// along with who sent it, so a piece assembled from several peers can still be blamed on the right
+// one if it fails its hash check. Guarded by the picker's mu.
+type partialPiece struct {
+	index    int
+	buf      []byte
+	sources  []string // the IP that sent each block, empty until it arrives
+	requests []int    // how many workers have asked for each block
+	received int
+	workers  int
+	done     bool // every block has arrived
+}
+
+func newPiecePicker(priorities []Priority, have bitfield.Bitfield) *piecePicker {
+	p := &piecePicker{
+		have:       bitfield.New(len(priorities)),
+		inProgress: bitfield.New(len(priorities)),
+		partial:    map[int]*partialPiece{},
+		solo:       bitfield.New(len(priorities)),
+		wake:       make(chan struct{}),
+	}
+	copy(p.have, have)
+	p.setWant(priorities)
+	return p
+}
+
+// setWant must be called with p.mu held
+func (p *piecePicker) setWant(priorities []Priority) {
+	p.priorities = priorities
+	p.want = bitfield.New(len(priorities))
+	for i, prio := range priorities {
+		if prio != PrioritySkip && !p.have.HasPiece(i) {
+			p.want.SetPiece(i)
+		}
+	}
+}
+
+// pick returns the most important piece the peer has that we still need. If there isn't one it
+// returns false along with a channel that's closed when it's worth trying again.
+func (p *piecePicker) pick(peer bitfield.Bitfield) (int, bool, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	best := -1
+	bestDistance := 0
+	for _, w := range p.windows {
+		for i := w.start; i < w.end; i++ {
+			if p.wanted(i, peer) && (best == -1 || i-w.start < bestDistance) {
+				best, bestDistance = i, i-w.start
+				break
+			}
+		}
+	}
+	if best == -1 {
+		free := p.needed(peer).AndNot(p.inProgress)
+		for i := free.NextSet(0); i != -1; i = free.NextSet(i + 1) {
+			if best == -1 || p.priorities[i] > p.priorities[best] {
+				best = i
+			}
+		}
+	}
+	if best == -1 {
+		return 0, false, p.wake
+	}
+	p.inProgress.SetPiece(best)
+	return best, true, nil
+}
+
+// wanted reports whether the piece is one we could download from the peer right now. Must be called
+// with p.mu held.
+func (p *piecePicker) wanted(index int, peer bitfield.Bitfield) bool {
+	return p.want.HasPiece(index) && !p.inProgress.HasPiece(index) && peer.HasPiece(index)
+}
+
+// needed returns the pieces the peer has that we still want. Must be called with p.mu held.
+func (p *piecePicker) needed(peer bitfield.Bitfield) bitfield.Bitfield {
+	return p.want.And(peer)
+}
+
+// setWindows replaces the ranges of pieces readers are waiting on
+func (p *piecePicker) setWindows(windows []window) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.windows = windows
+	p.notify()
+}
+
+// abort puts a piece back to be picked again
+func (p *piecePicker) abort(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inProgress.ClearPiece(index)
+	p.notify()
+}
+
+// abortSolo puts a piece back to be picked again by a single peer, so if the next copy is bad too
+// there's only the one peer to blame
+func (p *piecePicker) abortSolo(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.solo.SetPiece(index)
+	p.inProgress.ClearPiece(index)
+	p.notify()
+}
+
+// finish marks a piece as downloaded. Workers waiting on it wake up, as the peer they're waiting on
+// may have nothing else we want.
+func (p *piecePicker) finish(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inProgress.ClearPiece(index)
+	p.solo.ClearPiece(index)
+	p.have.SetPiece(index)
+	p.want.ClearPiece(index)
+	p.notify()
+}
+
+// setPriorities replaces every piece's priority
+func (p *piecePicker) setPriorities(priorities []Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.setWant(priorities)
+	p.notify()
+}
+
+// remaining returns how many pieces we still want
+func (p *piecePicker) remaining() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.want.Count()
+}
+
+// interesting reports whether the peer has any piece we still want, even if someone else is
+// already downloading it
+func (p *piecePicker) interesting(peer bitfield.Bitfield) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.needed(peer).NextSet(0) != -1
+}
+
+// notify must be called with p.mu held
+func (p *piecePicker) notify() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// start begins downloading a piece handed out by pick. Workers waiting for something to do wake up,
+// as they may be able to help with it.
+func (p *piecePicker) start(pw pieceWork) *partialPiece {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	blocks := (pw.length + MaxBlockSize - 1) / MaxBlockSize
+	pp := &partialPiece{
+		index:    pw.index,
+		buf:      make([]byte, pw.length),
+		sources:  make([]string, blocks),
+		requests: make([]int, blocks),
+		workers:  1,
+	}
+	p.partial[pw.index] = pp
+	p.notify()
+	return pp
+}
+
+// join returns a piece being downloaded from someone else that the peer could help finish, the one
+// with the fewest workers on it, or nil if there isn't one
+func (p *piecePicker) join(peer bitfield.Bitfield) *partialPiece {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var best *partialPiece
+	for index, pp := range p.partial {
+		if !peer.HasPiece(index) || p.solo.HasPiece(index) {
+			continue
+		}
+		if best == nil || pp.workers < best.workers {
+			best = pp
+		}
+	}
+	if best != nil {
+		best.workers++
+	}
+	return best
+}
+
+// nextBlock returns a missing block of the piece for a worker to request, preferring blocks nobody
+// has asked for yet. mine holds the blocks the worker has already asked for. Returns -1 if there's
+// nothing left to ask for.
+func (p *piecePicker) nextBlock(pp *partialPiece, mine []bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pp.done {
+		return -1
+	}
+	next := -1
+	for i, ip := range pp.sources {
+		if ip != "" || mine[i] {
+			continue
+		}
+		if pp.requests[i] == 0 {
+			next = i
+			break
+		}
+		if next == -1 {
+			next = i
+		}
+	}
+	if next != -1 {
+		pp.requests[next]++
+	}
+	return next
+}
+
+// put stores a block from ip unless another peer got there first. Returns true if it was the last
+// block the piece needed, in which case the caller is the one to pass the piece on.
+func (p *piecePicker) put(pp *partialPiece, begin int, block []byte, ip string) (bool, error) {
+	i := begin / MaxBlockSize
+	if begin%MaxBlockSize != 0 || i >= len(pp.sources) || len(block) != len(blockOf(pp.buf, i)) {
+		return false, fmt.Errorf("block of %d bytes at %d doesn't fit in piece of %d", len(block), begin, len(pp.buf))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pp.done || pp.sources[i] != "" {
+		return false, nil
+	}
+	copy(pp.buf[begin:], block)
+	pp.sources[i] = ip
+	pp.received++
+	if pp.received < len(pp.sources) {
+		return false, nil
+	}
+	pp.done = true
+	delete(p.partial, pp.index)
+	return true, nil
+}
+
+// isDone reports whether every block of the piece has arrived
+func (p *piecePicker) isDone(pp *partialPiece) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return pp.done
+}
+
+// leave is called by a worker that's stopped fetching blocks of the piece. If it was the last one
+// and the piece is incomplete, the piece is put back to be picked again.
+func (p *piecePicker) leave(pp *partialPiece) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pp.workers--
+	if pp.workers > 0 || pp.done {
+		return
+	}
+	delete(p.partial, pp.index)
+	p.inProgress.ClearPiece(pp.index)
+	p.notify()
+}
@@ -0,0 +1,246 @@
+package torrent
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+)
+
+// ScrapeResult is what a tracker knows about a torrent's swarm
+type ScrapeResult struct {
+	Seeders   int `json:"seeders"`
+	Leechers  int `json:"leechers"`
+	Completed int `json:"completed"` // how many times the torrent has been downloaded in full
+}
+
+const (
+	// udpProtocolID starts every UDP tracker connect request (BEP 15)
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect = 0
+	udpActionScrape  = 2
+	udpActionError   = 3
+
+	// udpTimeout is how long we wait for the first reply from a UDP tracker, doubling on each retry
+	udpTimeout = 5 * time.Second
+	udpRetries = 3
+)
+
+// Scrape asks the torrent's tracker how many peers are seeding and downloading it
+func (t *Torrent) Scrape(ctx context.Context) (ScrapeResult, error) {
+	res, err := Scrape(ctx, t.File.Announce, t.File.InfoHash)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	r, ok := res[t.File.InfoHash]
+	if !ok {
+		return ScrapeResult{}, errors.New("tracker doesn't know about the torrent")
+	}
+	return r, nil
+}
+
+// Scrape asks the tracker with the given announce url about any number of torrents at once. Torrents
+// the tracker doesn't know about are missing from the result. Both http and udp trackers are
+// supported.
+func Scrape(ctx context.Context, announce string, infoHashes ...[20]byte) (map[[20]byte]ScrapeResult, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(ctx, announce, infoHashes)
+	case "udp":
+		return scrapeUDP(ctx, u.Host, infoHashes)
+	}
+	return nil, fmt.Errorf("unsupported tracker scheme %q", u.Scheme)
+}
+
+// ScrapeURL derives a tracker's scrape url from its announce url, by convention the same url with
+// the "announce" at the start of the last path element replaced by "scrape" (BEP 48). Trackers
+// whose announce url doesn't follow the convention don't support scraping.
+func ScrapeURL(announce string) (string, error) {
+	u, err := url.Parse(announce)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(u.Path, "/")
+	if i == -1 || !strings.HasPrefix(u.Path[i+1:], "announce") {
+		return "", fmt.Errorf("tracker %s doesn't support scrape", announce)
+	}
+	u.Path = u.Path[:i+1] + "scrape" + strings.TrimPrefix(u.Path[i+1:], "announce")
+	return u.String(), nil
+}
+
+func scrapeHTTP(ctx context.Context, announce string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	su, err := ScrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(su)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for _, h := range infoHashes {
+		params.Add("info_hash", string(h[:]))
+	}
+	u.RawQuery = params.Encode()
+	c := &http.Client{
+		Timeout: 5 * time.Second,
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("tracker returned non-200 status: %d", res.StatusCode)
+	}
+	val, err := bencodecustom.Parse(bufio.NewReader(res.Body))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding scrape response: %w", err)
+	}
+	rawMap, ok := val.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("error converting scrape response to map[string]any")
+	}
+	if reason, err := safeGet[string](rawMap, "failure reason"); err == nil {
+		return nil, fmt.Errorf("tracker failed: %s", reason)
+	}
+	files, err := safeGet[map[string]any](rawMap, "files")
+	if err != nil {
+		return nil, err
+	}
+	results := map[[20]byte]ScrapeResult{}
+	for hash, val := range files {
+		stats, ok := val.(map[string]any)
+		if len(hash) != 20 || !ok {
+			continue
+		}
+		r := ScrapeResult{}
+		// trackers are meant to send all three, but make do with what's there
+		r.Seeders, _ = safeGet[int](stats, "complete")
+		r.Leechers, _ = safeGet[int](stats, "incomplete")
+		r.Completed, _ = safeGet[int](stats, "downloaded")
+		infoHash := [20]byte{}
+		copy(infoHash[:], hash)
+		results[infoHash] = r
+	}
+	return results, nil
+}
+
+// scrapeUDP scrapes a tracker over the UDP tracker protocol (BEP 15), which needs a connection id
+// from a connect request first
+func scrapeUDP(ctx context.Context, host string, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, error) {
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, "udp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// unblock reads if we're cancelled
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConnect)
+	res, err := udpRoundTrip(ctx, conn, req, 16)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to tracker: %w", err)
+	}
+	connID := binary.BigEndian.Uint64(res[8:16])
+
+	req = make([]byte, 16, 16+20*len(infoHashes))
+	binary.BigEndian.PutUint64(req[0:8], connID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+	for _, h := range infoHashes {
+		req = append(req, h[:]...)
+	}
+	res, err = udpRoundTrip(ctx, conn, req, 8+12*len(infoHashes))
+	if err != nil {
+		return nil, fmt.Errorf("error scraping tracker: %w", err)
+	}
+	results := map[[20]byte]ScrapeResult{}
+	for i, h := range infoHashes {
+		stats := res[8+12*i:]
+		results[h] = ScrapeResult{
+			Seeders:   int(binary.BigEndian.Uint32(stats[0:4])),
+			Completed: int(binary.BigEndian.Uint32(stats[4:8])),
+			Leechers:  int(binary.BigEndian.Uint32(stats[8:12])),
+		}
+	}
+	return results, nil
+}
+
+// udpRoundTrip sends req, filling in a fresh transaction id at bytes 12-16, and waits for a reply
+// with the same action and transaction id that's at least n bytes long. Requests are resent with a
+// growing timeout in case either packet was lost.
+func udpRoundTrip(ctx context.Context, conn net.Conn, req []byte, n int) ([]byte, error) {
+	action := binary.BigEndian.Uint32(req[8:12])
+	tid := rand.Uint32()
+	binary.BigEndian.PutUint32(req[12:16], tid)
+	buf := make([]byte, 2048)
+	timeout := udpTimeout
+	for attempt := 0; attempt < udpRetries; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		timeout *= 2
+		for {
+			read, err := conn.Read(buf)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break // try again
+			}
+			if err != nil {
+				return nil, err
+			}
+			res := buf[:read]
+			if read < 8 || binary.BigEndian.Uint32(res[4:8]) != tid {
+				continue // not a reply to this request
+			}
+			switch binary.BigEndian.Uint32(res[0:4]) {
+			case action:
+				if read < n {
+					return nil, fmt.Errorf("reply too short, %d bytes", read)
+				}
+				return res, nil
+			case udpActionError:
+				return nil, fmt.Errorf("tracker failed: %s", res[8:])
+			default:
+				return nil, fmt.Errorf("unexpected action %d in reply", binary.BigEndian.Uint32(res[0:4]))
+			}
+		}
+	}
+	return nil, errors.New("tracker didn't reply")
+}
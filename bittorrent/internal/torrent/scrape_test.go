@@ -0,0 +1,108 @@
+package torrent
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce?x=2/4", "http://example.com/scrape?x=2/4"},
+		{"http://example.com/x%064announce", ""},
+	}
+	for _, tt := range tests {
+		have, err := ScrapeURL(tt.announce)
+		if tt.want == "" && err == nil {
+			t.Errorf("expected %s not to support scrape, got %s", tt.announce, have)
+		}
+		if tt.want != "" && have != tt.want {
+			t.Errorf("expected scrape url %s for %s, got %s (%v)", tt.want, tt.announce, have, err)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	h1, h2 := sha1.Sum([]byte("one")), sha1.Sum([]byte("two"))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || len(r.URL.Query()["info_hash"]) != 2 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei5e10:downloadedi50e10:incompletei10eeee", h1[:])
+	}))
+	defer srv.Close()
+	res, err := Scrape(context.Background(), srv.URL+"/announce", h1, h2)
+	if err != nil {
+		t.Fatalf("unexpected error scraping: %v", err)
+	}
+	want := map[[20]byte]ScrapeResult{h1: {Seeders: 5, Leechers: 10, Completed: 50}}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("expected %v, got %v", want, res)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	defer conn.Close()
+	const connID = 0x1234
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			res := make([]byte, 8)
+			copy(res[4:8], req[12:16]) // transaction id
+			switch binary.BigEndian.Uint32(req[8:12]) {
+			case udpActionConnect:
+				res = append(res, make([]byte, 8)...)
+				binary.BigEndian.PutUint64(res[8:16], connID)
+			case udpActionScrape:
+				if binary.BigEndian.Uint64(req[0:8]) != connID {
+					continue
+				}
+				binary.BigEndian.PutUint32(res[0:4], udpActionScrape)
+				for i := 16; i < n; i += 20 {
+					stats := make([]byte, 12)
+					binary.BigEndian.PutUint32(stats[0:4], uint32(req[i]))
+					binary.BigEndian.PutUint32(stats[4:8], 7)
+					binary.BigEndian.PutUint32(stats[8:12], 3)
+					res = append(res, stats...)
+				}
+			}
+			conn.WriteTo(res, addr)
+		}
+	}()
+
+	tf, _ := testTorrentFile(1000, 256)
+	tf.Announce = "udp://" + conn.LocalAddr().String() + "/announce"
+	to := NewTorrent(tf)
+	res, err := to.Scrape(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error scraping: %v", err)
+	}
+	want := ScrapeResult{Seeders: int(tf.InfoHash[0]), Completed: 7, Leechers: 3}
+	if res != want {
+		t.Errorf("expected %+v, got %+v", want, res)
+	}
+}
@@ -0,0 +1,322 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/connmgr"
+	"go-bt-learning.brk3.github.io/internal/merkle"
+	"go-bt-learning.brk3.github.io/internal/message"
+	"go-bt-learning.brk3.github.io/internal/metadata"
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// uploadPeer is a peer we're seeding to. Writes can come from other peers' workers when
+// super-seeding, which the client serialises.
+type uploadPeer struct {
+	c      *client.Client
+	has    bitfield.Bitfield
+	choked bool
+}
+
+// Seed serves the pieces we have to peers until ctx is cancelled, taking peers from t.Peers and
+// connections handed over with AddConn. If SuperSeed is set pieces are offered one at a time
+// instead of advertising all of them (BEP 16).
+func (t *Torrent) Seed(ctx context.Context) error {
+	if t.Storage == nil {
+		return fmt.Errorf("torrent has no storage to seed from")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	t.mu.Lock()
+	if t.SuperSeed {
+		t.super = newSuperSeeder(t.Bitfield, t.File.NumPieces())
+	}
+	t.cache = newReadCache(ReadCacheSize)
+	managers := t.startConns()
+	peers := [][]client.Peer{t.Peers, t.PeersV2}
+	t.mu.Unlock()
+	for i, conns := range managers {
+		conns.AddPeers(peers[i])
+		conns.Start(func(c *client.Client) {
+			t.startUploadWorker(ctx, c)
+		})
+	}
+	<-ctx.Done()
+	for _, conns := range managers {
+		conns.Close()
+	}
+	t.mu.Lock()
+	t.super = nil
+	t.cache = nil
+	t.mu.Unlock()
+	t.stop()
+	return ctx.Err()
+}
+
+// startConns creates a connection manager for each swarm the torrent is in, refusing peers banned
+// in earlier downloads or seeding. Must be called with t.mu held.
+func (t *Torrent) startConns() []*connmgr.Manager {
+	swarms := t.File.SwarmHashes()
+	t.conns = connmgr.New(t.Limits, t.Conns, swarms[0], t.Logger)
+	if len(swarms) > 1 {
+		t.connsV2 = connmgr.New(t.Limits, t.Conns, swarms[1], t.Logger)
+	}
+	managers := t.managers()
+	banned := t.scores.bannedIPs()
+	for _, conns := range managers {
+		conns.SetRateLimits(t.DownLimit, t.UpLimit)
+		for _, ip := range banned {
+			conns.Ban(net.ParseIP(ip))
+		}
+	}
+	return managers
+}
+
+// startUploadWorker serves a peer's requests for pieces we have until the connection fails. Peers
+// are unchoked as soon as they're interested.
+func (t *Torrent) startUploadWorker(ctx context.Context, c *client.Client) {
+	numPieces := t.File.NumPieces()
+	c.NumPieces = numPieces
+	defer c.KeepAlive(t.idleTimeout())()
+	p := &uploadPeer{c: c, has: bitfield.New(numPieces), choked: true}
+	t.mu.Lock()
+	super := t.super
+	ours := append(bitfield.Bitfield{}, t.Bitfield...)
+	t.mu.Unlock()
+	if super != nil {
+		// the peer only learns about the pieces we offer it, one at a time. It still gets an empty
+		// bitfield, as some peers won't request anything until they've had one.
+		super.add(p)
+		defer func() { t.offer(super.remove(p)) }()
+		ours = make(bitfield.Bitfield, len(ours))
+	}
+	if err := p.c.Send(message.Bitfield{Bits: ours}); err != nil {
+		return
+	}
+	meta := t.metadataResponder(c)
+	if meta != nil {
+		if err := c.Send(meta.Handshake()); err != nil {
+			return
+		}
+	}
+	for ctx.Err() == nil {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.logf("%s: error reading message from peer: %v\n", c.Peer.String(), err)
+			return
+		}
+		if msg == nil {
+			continue // keepalive
+		}
+		switch msg.ID {
+		case message.MsgInterested:
+			if p.choked {
+				p.choked = false
+				err = p.c.Send(message.Unchoke{})
+			}
+			if super != nil {
+				t.offer(super.next(p))
+			}
+		case message.MsgBitfield:
+			var bf bitfield.Bitfield
+			if bf, err = message.ParseBitfield(msg, numPieces); err != nil {
+				break
+			}
+			if super != nil {
+				t.offer(super.bitfield(p, bf))
+			} else {
+				copy(p.has, bf)
+			}
+		case message.MsgHave:
+			var index int
+			if index, err = message.ParseHave(msg, numPieces); err != nil {
+				break
+			}
+			if super != nil {
+				t.offer(super.have(p, index))
+			} else {
+				p.has.SetPiece(index)
+			}
+		case message.MsgRequest:
+			err = t.serveRequest(p, msg, super)
+		case message.MsgHashRequest:
+			err = t.serveHashRequest(c, msg)
+		case message.MsgExtended:
+			if meta == nil {
+				break
+			}
+			var typed message.Typed
+			if typed, err = message.Decode(msg); err != nil {
+				break
+			}
+			err = meta.Handle(c, typed.(message.Extended))
+		}
+		if err != nil {
+			t.logf("%s: error serving peer: %v\n", c.Peer.String(), err)
+			return
+		}
+	}
+}
+
+// metadataResponder returns what answers the peer's requests for the torrent's info dict, or nil
+// if it can't ask. Only peers in the v1 swarm can check what they're sent, as the v2 info hash is
+// truncated.
+func (t *Torrent) metadataResponder(c *client.Client) *metadata.Responder {
+	if !c.Capabilities.Has(client.CapExtensions) || len(t.File.Info) == 0 ||
+		len(t.File.PieceHashes) == 0 || c.InfoHash != t.File.InfoHash {
+		return nil
+	}
+	return metadata.NewResponder(t.File.Info)
+}
+
+// serveRequest sends the block a peer asked for, if it's one it's allowed
+func (t *Torrent) serveRequest(p *uploadPeer, msg *message.Message, super *superSeeder) error {
+	r, err := message.ParseRequest(msg, t.File.NumPieces(), t.calculatePieceSize)
+	if err != nil {
+		return err
+	}
+	index, begin, length := r.Index, r.Begin, r.Length
+	t.mu.Lock()
+	have := t.Bitfield.HasPiece(index)
+	cache := t.cache
+	t.mu.Unlock()
+	if p.choked || !have || cache == nil || (super != nil && !super.allowed(p, index)) {
+		return nil // peers can't count on requests being served, so just drop it
+	}
+	piece, err := cache.get(index, func() ([]byte, error) {
+		pieceBegin, pieceEnd := t.calculateBoundsForPiece(index)
+		buf := make([]byte, pieceEnd-pieceBegin)
+		_, err := t.Storage.ReadAt(buf, int64(pieceBegin))
+		return buf, err
+	})
+	if err != nil {
+		return fmt.Errorf("error reading piece %d: %w", index, err)
+	}
+	if err := p.c.Send(message.Piece{Index: index, Begin: begin, Block: piece[begin : begin+length]}); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.uploads.add(index, begin, length)
+	t.mu.Unlock()
+	return nil
+}
+
+// MaxHashesPerRequest is the most hashes we'll send in answer to one hash request
+const MaxHashesPerRequest = 512
+
+// serveHashRequest answers a v2 peer's request for part of a file's piece layer (BEP 52), or
+// rejects it if it's for hashes we don't keep
+func (t *Torrent) serveHashRequest(c *client.Client, msg *message.Message) error {
+	typed, err := message.Decode(msg)
+	if err != nil {
+		return err
+	}
+	r, ok := typed.(message.HashRequest)
+	if !ok {
+		return fmt.Errorf("expected a hash request, got message ID %d", msg.ID)
+	}
+	hashes, ok := t.pieceLayerHashes(r)
+	if !ok {
+		return c.Send(message.HashReject(r))
+	}
+	return c.Send(message.Hashes{HashRequest: r, Hashes: hashes})
+}
+
+// pieceLayerHashes returns the requested run of a file's piece layer followed by the uncle hashes
+// proving it, up to r.ProofLayers of them. Only the piece layer of files of more than one piece is
+// kept, as that's all a torrent file holds.
+func (t *Torrent) pieceLayerHashes(r message.HashRequest) ([][32]byte, bool) {
+	pl := t.File.PieceLength
+	padLeaves := pl / merkle.BlockSize
+	if len(t.File.PiecesV2) == 0 || 1<<r.BaseLayer != padLeaves {
+		return nil, false
+	}
+	var f *torrentfile.File
+	for i := range t.File.Files {
+		if !t.File.Files[i].Padding && t.File.Files[i].Length > pl && t.File.Files[i].PiecesRoot == r.PiecesRoot {
+			f = &t.File.Files[i]
+			break
+		}
+	}
+	if f == nil {
+		return nil, false
+	}
+	first, n := f.Offset/pl, (f.Length+pl-1)/pl
+	width := merkle.NextPow2(n)
+	if r.Length <= 0 || r.Length > MaxHashesPerRequest || r.Length != merkle.NextPow2(r.Length) ||
+		r.Index < 0 || r.Index%r.Length != 0 || r.Index+r.Length > width {
+		return nil, false
+	}
+	layer := make([][32]byte, n)
+	for i := range layer {
+		layer[i] = t.File.PiecesV2[first+i].Hash
+	}
+	pad := merkle.PadHash(padLeaves)
+	hashes := [][32]byte{}
+	for i := r.Index; i < r.Index+r.Length; i++ {
+		if i < n {
+			hashes = append(hashes, layer[i])
+		} else {
+			hashes = append(hashes, pad)
+		}
+	}
+	// the first uncles are inside the requested run, so the peer can work them out itself
+	proof := merkle.Proof(layer, width, pad, r.Index)
+	for k := r.Length; k > 1; k /= 2 {
+		proof = proof[1:]
+	}
+	if r.ProofLayers < len(proof) {
+		proof = proof[:r.ProofLayers]
+	}
+	return append(hashes, proof...), true
+}
+
+// offer tells each peer about the piece it's been offered
+func (t *Torrent) offer(offers []superOffer) {
+	for _, o := range offers {
+		if err := o.peer.c.Send(message.Have{Index: o.index}); err != nil {
+			t.logf("%s: error offering piece %d: %v\n", o.peer.c.Peer.String(), o.index, err)
+		}
+	}
+}
+
+// uploadStats counts what we've uploaded. Guarded by t.mu.
+type uploadStats struct {
+	bytes  int64
+	blocks map[[2]int]bool // piece index and offset of each block we've uploaded at least once
+	unique int64           // bytes in those blocks
+}
+
+func (u *uploadStats) add(index, begin, length int) {
+	u.bytes += int64(length)
+	if u.blocks == nil {
+		u.blocks = map[[2]int]bool{}
+	}
+	if !u.blocks[[2]int{index, begin}] {
+		u.blocks[[2]int{index, begin}] = true
+		u.unique += int64(length)
+	}
+}
+
+// Uploaded returns how many bytes of piece data we've sent to peers
+func (t *Torrent) Uploaded() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.uploads.bytes
+}
+
+// SeedRatio returns how many bytes we've uploaded for each distinct byte of the torrent we've put
+// into the swarm. 1 means nothing was sent twice, which is what super-seeding aims for when we're
+// the only seeder.
+func (t *Torrent) SeedRatio() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.uploads.unique == 0 {
+		return 0
+	}
+	return float64(t.uploads.bytes) / float64(t.uploads.unique)
+}
@@ -0,0 +1,257 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/merkle"
+	"go-bt-learning.brk3.github.io/internal/message"
+	"go-bt-learning.brk3.github.io/internal/metadata"
+	"go-bt-learning.brk3.github.io/internal/ratelimit"
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+func TestSuperSeeder(t *testing.T) {
+	s := newSuperSeeder(bitfield.Bitfield{0xf0}, 4)
+	a := &uploadPeer{has: make(bitfield.Bitfield, 1)}
+	b := &uploadPeer{has: make(bitfield.Bitfield, 1)}
+	s.add(a)
+	s.add(b)
+	offerA, offerB := s.next(a), s.next(b)
+	if len(offerA) != 1 || len(offerB) != 1 || offerA[0].index == offerB[0].index {
+		t.Fatalf("expected each peer to be offered a different piece, got %v and %v", offerA, offerB)
+	}
+	pa, pb := offerA[0].index, offerB[0].index
+	if s.allowed(a, pb) || !s.allowed(a, pa) {
+		t.Errorf("expected a to only be allowed its own piece")
+	}
+	if res := s.have(a, pa); len(res) != 0 {
+		t.Errorf("expected a to wait until its piece is passed on, got offers %v", res)
+	}
+	res := s.have(b, pa)
+	if len(res) != 1 || res[0].peer != a || res[0].index == pa || res[0].index == pb {
+		t.Errorf("expected a to be offered a new piece once b has its last one, got %v", res)
+	}
+	// left alone, b is offered more once it has its piece
+	s.remove(a)
+	res = s.have(b, pb)
+	if len(res) != 1 || res[0].peer != b {
+		t.Errorf("expected a lone peer to get a new piece straight away, got %v", res)
+	}
+}
+
+// seedTo runs a seeder for tf that accepts one peer, returning the peer to dial and a function
+// stopping the seeder
+func seedTo(t testing.TB, seeder *Torrent) (client.Peer, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		seeder.Seed(ctx)
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c, _, err := client.Accept(conn, func([20]byte) bool { return true })
+			if err != nil || !seeder.AddConn(c) {
+				conn.Close()
+			}
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return client.Peer{IP: addr.IP, Port: uint16(addr.Port)}, func() {
+		ln.Close()
+		cancel()
+		<-done
+	}
+}
+
+func TestSeed(t *testing.T) {
+	for _, super := range []bool{false, true} {
+		tf, data := testTorrentFile(100000, 32768)
+		seeder := NewTorrent(tf)
+		seeder.Storage = newTestStorage(t)
+		seeder.Storage.WriteAt(data, 0)
+		if err := seeder.Recheck(); err != nil {
+			t.Fatalf("unexpected error rechecking: %v", err)
+		}
+		seeder.SuperSeed = super
+		peer, stop := seedTo(t, seeder)
+
+		// give the seeder a moment to start accepting peers
+		time.Sleep(50 * time.Millisecond)
+		to := NewTorrent(tf)
+		to.Storage = newTestStorage(t)
+		to.Peers = []client.Peer{peer}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := to.Download(ctx)
+		cancel()
+		stop()
+		if err != nil {
+			t.Fatalf("unexpected error downloading with super seeding %v: %v", super, err)
+		}
+		have, _ := os.ReadFile(to.Storage.(*os.File).Name())
+		if !bytes.Equal(have, data) {
+			t.Errorf("downloaded data doesn't match with super seeding %v", super)
+		}
+		if seeder.Uploaded() != int64(len(data)) || seeder.SeedRatio() != 1 {
+			t.Errorf("expected to upload %d bytes at a ratio of 1, got %d at %v", len(data), seeder.Uploaded(), seeder.SeedRatio())
+		}
+	}
+}
+
+// TestSeedRateLimited runs downloads with both ends throttled, which under -race checks the
+// throttled connections are safe to close while they're in use
+func TestSeedRateLimited(t *testing.T) {
+	tf, data := testTorrentFile(100000, 32768)
+	for _, rate := range []int{1 << 10, 1 << 20} {
+		seeder := NewTorrent(tf)
+		seeder.Storage = newTestStorage(t)
+		seeder.Storage.WriteAt(data, 0)
+		if err := seeder.Recheck(); err != nil {
+			t.Fatalf("unexpected error rechecking: %v", err)
+		}
+		seeder.DownLimit = ratelimit.NewLimiter(1 << 20)
+		seeder.UpLimit = ratelimit.NewLimiter(1 << 20)
+		peer, stop := seedTo(t, seeder)
+		time.Sleep(50 * time.Millisecond)
+
+		to := NewTorrent(tf)
+		to.Storage = newTestStorage(t)
+		to.Peers = []client.Peer{peer}
+		to.DownLimit = ratelimit.NewLimiter(rate)
+		to.UpLimit = ratelimit.NewLimiter(rate)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if rate < len(data) {
+			// cancelled part way through the first piece
+			ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+		}
+		err := to.Download(ctx)
+		cancel()
+		stop()
+		if rate < len(data) {
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected a throttled download to be cancelled, got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error downloading: %v", err)
+		}
+		have, _ := os.ReadFile(to.Storage.(*os.File).Name())
+		if !bytes.Equal(have, data) {
+			t.Errorf("downloaded data doesn't match")
+		}
+	}
+}
+
+func TestSeedMetadata(t *testing.T) {
+	tf, data := testTorrentFile(100000, 32768)
+	tf.Info = []byte("d6:lengthi100000e4:name4:test12:piece lengthi32768e6:pieces100:...e")
+	tf.InfoHash = sha1.Sum(tf.Info)
+	seeder := NewTorrent(tf)
+	seeder.Storage = newTestStorage(t)
+	seeder.Storage.WriteAt(data, 0)
+	if err := seeder.Recheck(); err != nil {
+		t.Fatalf("unexpected error rechecking: %v", err)
+	}
+	peer, stop := seedTo(t, seeder)
+	defer stop()
+
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	info, err := metadata.FetchFrom(ctx, peer, tf.InfoHash, nil)
+	if err != nil {
+		t.Fatalf("unexpected error fetching metadata: %v", err)
+	}
+	if !bytes.Equal(info, tf.Info) {
+		t.Errorf("expected metadata %q, got %q", tf.Info, info)
+	}
+}
+
+func TestSeedHashRequest(t *testing.T) {
+	tf, data := testTorrentFile(100000, 32768)
+	tf = hybridTorrentFile(tf, data)
+	layer := [][32]byte{}
+	for _, p := range tf.PiecesV2 {
+		layer = append(layer, p.Hash)
+	}
+	pad := merkle.PadHash(tf.PieceLength / merkle.BlockSize)
+	root := merkle.Root(layer, merkle.NextPow2(len(layer)), pad)
+	tf.Files = []torrentfile.File{{Path: "test", Length: len(data), PiecesRoot: root}}
+	seeder := NewTorrent(tf)
+	seeder.Storage = newTestStorage(t)
+	seeder.Storage.WriteAt(data, 0)
+	if err := seeder.Recheck(); err != nil {
+		t.Fatalf("unexpected error rechecking: %v", err)
+	}
+	peer, stop := seedTo(t, seeder)
+	defer stop()
+
+	time.Sleep(50 * time.Millisecond)
+	c, err := client.NewClient(peer, tf.InfoHash)
+	if err != nil {
+		t.Fatalf("unexpected error connecting: %v", err)
+	}
+	defer c.Conn.Close()
+	c.Conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the piece layer is layer 1, as pieces are two blocks
+	good := message.HashRequest{PiecesRoot: root, BaseLayer: 1, Index: 2, Length: 2, ProofLayers: 8}
+	bad := []message.HashRequest{
+		{PiecesRoot: root, BaseLayer: 0, Index: 0, Length: 2},
+		{PiecesRoot: root, BaseLayer: 1, Index: 1, Length: 2},
+		{PiecesRoot: root, BaseLayer: 1, Index: 0, Length: 8},
+		{PiecesRoot: [32]byte{1}, BaseLayer: 1, Index: 0, Length: 2},
+	}
+	for _, r := range append([]message.HashRequest{good}, bad...) {
+		if err := c.Send(r); err != nil {
+			t.Fatalf("unexpected error sending hash request: %v", err)
+		}
+	}
+	replies := []message.Typed{}
+	for len(replies) < 1+len(bad) {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("unexpected error reading: %v", err)
+		}
+		if msg == nil || (msg.ID != message.MsgHashes && msg.ID != message.MsgHashReject) {
+			continue
+		}
+		typed, err := message.Decode(msg)
+		if err != nil {
+			t.Fatalf("unexpected error decoding: %v", err)
+		}
+		replies = append(replies, typed)
+	}
+	hashes, ok := replies[0].(message.Hashes)
+	if !ok || hashes.HashRequest != good || len(hashes.Hashes) != 3 {
+		t.Fatalf("expected the two hashes and one uncle, got %+v", replies[0])
+	}
+	if hashes.Hashes[0] != layer[2] || hashes.Hashes[1] != layer[3] {
+		t.Errorf("expected pieces 2 and 3 of the piece layer")
+	}
+	if !merkle.VerifyRange(hashes.Hashes[:2], 2, hashes.Hashes[2:], root) {
+		t.Errorf("expected the hashes to verify against the pieces root")
+	}
+	for i, r := range bad {
+		if reject, ok := replies[1+i].(message.HashReject); !ok || message.HashRequest(reject) != r {
+			t.Errorf("expected %+v to be rejected, got %+v", r, replies[1+i])
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package torrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// DefaultReadahead is how far ahead of a reader's position pieces are fetched first
+const DefaultReadahead = 8 << 20
+
+// FileReader reads one of the torrent's files while it downloads. Reads block until the pieces they
+// need have been verified, and the pieces just ahead of the read position are downloaded before
+// anything else, so the start of a file can be used before the rest of it arrives.
+type FileReader struct {
+	t    *Torrent
+	ctx  context.Context
+	file torrentfile.File
+	pos  int64
+}
+
+// NewFileReader returns a reader for the file at index. Reads give up with ctx's error once it's
+// cancelled. The reader should be closed when it's done with so its pieces stop being favoured.
+func (t *Torrent) NewFileReader(ctx context.Context, index int) (*FileReader, error) {
+	if index < 0 || index >= len(t.File.Files) {
+		return nil, fmt.Errorf("file index %d out of range, torrent has %d files", index, len(t.File.Files))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.filePriorities[index] == PrioritySkip {
+		return nil, fmt.Errorf("file %s is skipped", t.File.Files[index].Path)
+	}
+	r := &FileReader{t: t, ctx: ctx, file: t.File.Files[index]}
+	t.setWindow(r, r.file.Offset)
+	return r, nil
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.pos >= int64(r.file.Length) {
+		return 0, io.EOF
+	}
+	off := int64(r.file.Offset) + r.pos
+	index := int(off / int64(r.t.File.PieceLength))
+	if err := r.t.waitForPiece(r.ctx, index); err != nil {
+		return 0, err
+	}
+	// only read as far as the end of this piece, the next one might not be here yet
+	_, end := r.t.calculateBoundsForPiece(index)
+	if n := int64(end) - off; int64(len(p)) > n {
+		p = p[:n]
+	}
+	if n := int64(r.file.Length) - r.pos; int64(len(p)) > n {
+		p = p[:n]
+	}
+	n, err := r.t.Storage.ReadAt(p, off)
+	r.pos += int64(n)
+	r.t.mu.Lock()
+	r.t.setWindow(r, int(off)+n)
+	r.t.mu.Unlock()
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek moves the read position, and the window of pieces downloaded first along with it
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += int64(r.file.Length)
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	if r.pos < int64(r.file.Length) {
+		r.t.mu.Lock()
+		r.t.setWindow(r, r.file.Offset+int(r.pos))
+		r.t.mu.Unlock()
+	}
+	return r.pos, nil
+}
+
+// Close stops the reader's pieces being favoured
+func (r *FileReader) Close() error {
+	r.t.mu.Lock()
+	defer r.t.mu.Unlock()
+	delete(r.t.windows, r)
+	r.t.updateWindows()
+	return nil
+}
+
+// waitForPiece blocks until we have the piece or ctx is cancelled
+func (t *Torrent) waitForPiece(ctx context.Context, index int) error {
+	for {
+		t.mu.Lock()
+		have := t.Bitfield.HasPiece(index)
+		wait := t.pieceDone
+		t.mu.Unlock()
+		if have {
+			return nil
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// notifyPieces wakes any reader waiting for a piece. Must be called with t.mu held.
+func (t *Torrent) notifyPieces() {
+	close(t.pieceDone)
+	t.pieceDone = make(chan struct{})
+}
+
+// setWindow moves a reader's window to start at the piece containing offset. Must be called with
+// t.mu held.
+func (t *Torrent) setWindow(r *FileReader, offset int) {
+	t.windows[r] = offset / t.File.PieceLength
+	t.updateWindows()
+}
+
+// updateWindows passes the readers' windows on to the picker. Must be called with t.mu held.
+func (t *Torrent) updateWindows() {
+	if t.picker == nil {
+		return
+	}
+	t.picker.setWindows(t.windowRanges())
+}
+
+// windowRanges returns the pieces each reader wants next. Must be called with t.mu held.
+func (t *Torrent) windowRanges() []window {
+	size := (t.Readahead + t.File.PieceLength - 1) / t.File.PieceLength
+	if size < 1 {
+		size = 1
+	}
+	res := []window{}
+	for _, start := range t.windows {
+		end := start + size
+		if end > t.File.NumPieces() {
+			end = t.File.NumPieces()
+		}
+		res = append(res, window{start, end})
+	}
+	return res
+}
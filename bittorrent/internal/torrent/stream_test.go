@@ -0,0 +1,73 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+	"go-bt-learning.brk3.github.io/internal/client"
+)
+
+func TestPickerWindow(t *testing.T) {
+	p := newPiecePicker([]Priority{PriorityHigh, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal}, make(bitfield.Bitfield, 1))
+	p.setWindows([]window{{start: 2, end: 4}})
+	all := bitfield.Bitfield{0xff}
+	want := []int{2, 3, 0, 1, 4}
+	for _, w := range want {
+		index, ok, _ := p.pick(all)
+		if !ok || index != w {
+			t.Fatalf("expected to pick piece %d, got %d (ok %v)", w, index, ok)
+		}
+	}
+}
+
+func TestFileReader(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 16384)
+	tf = multiFile(tf, 30000, 70000)
+	seeder := newFakeSeeder(t, tf, data, true)
+	to := NewTorrent(tf)
+	to.Storage = newFileStorage(t, t.TempDir(), tf)
+	to.Peers = []client.Peer{seeder.peer()}
+	to.Readahead = 16384
+
+	r, err := to.NewFileReader(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("unexpected error opening reader: %v", err)
+	}
+	if _, err := r.Seek(40000, io.SeekStart); err != nil {
+		t.Fatalf("unexpected error seeking: %v", err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- to.Download(context.Background()) }()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error reading: %v", err)
+	}
+	if want := data[70000:]; !bytes.Equal(b, want) {
+		t.Errorf("expected to read the last %d bytes of the file, got %d different bytes", len(want), len(b))
+	}
+	r.Close()
+	if err := <-errs; err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	seeder.close()
+	leaks()
+}
+
+func TestFileReaderCancel(t *testing.T) {
+	tf, _ := testTorrentFile(1000, 256)
+	to := NewTorrent(tf)
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := to.NewFileReader(ctx, 0)
+	if err != nil {
+		t.Fatalf("unexpected error opening reader: %v", err)
+	}
+	defer r.Close()
+	cancel()
+	if _, err := r.Read(make([]byte, 10)); err != context.Canceled {
+		t.Errorf("expected read to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package torrent
+
+import (
+	"sync"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+)
+
+// superSeeder decides which piece to offer each peer when super-seeding (BEP 16). Each peer is
+// offered one piece, the rarest we know of, and isn't offered another until a different peer says
+// it has the piece, which shows the first peer passed it on rather than keeping it to itself. A
+// peer that's alone with us has nobody to pass pieces to, so it gets a new one as soon as it has
+// the last.
+type superSeeder struct {
+	mu      sync.Mutex
+	ours    bitfield.Bitfield // the pieces we can offer
+	peers   map[*uploadPeer]*superPeer
+	seen    []int // how many peers have each piece
+	offered []int // how many peers each piece is on offer to
+}
+
+type superPeer struct {
+	current int          // piece on offer, -1 if none
+	given   map[int]bool // every piece we've offered, which the peer may request
+}
+
+// superOffer is a piece to tell a peer we have
+type superOffer struct {
+	peer  *uploadPeer
+	index int
+}
+
+func newSuperSeeder(ours bitfield.Bitfield, numPieces int) *superSeeder {
+	return &superSeeder{
+		ours:    append(bitfield.Bitfield{}, ours...),
+		peers:   map[*uploadPeer]*superPeer{},
+		seen:    make([]int, numPieces),
+		offered: make([]int, numPieces),
+	}
+}
+
+func (s *superSeeder) add(p *uploadPeer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[p] = &superPeer{current: -1, given: map[int]bool{}}
+}
+
+// remove forgets a peer, returning offers for any peers left alone with us whose piece is done
+func (s *superSeeder) remove(p *uploadPeer) []superOffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.peers[p]
+	if !ok {
+		return nil
+	}
+	if sp.current != -1 {
+		s.offered[sp.current]--
+	}
+	for i := range s.seen {
+		if p.has.HasPiece(i) {
+			s.seen[i]--
+		}
+	}
+	delete(s.peers, p)
+	return s.alone()
+}
+
+// next offers the peer a piece if it isn't waiting on one already
+func (s *superSeeder) next(p *uploadPeer) []superOffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sp, ok := s.peers[p]; ok && sp.current == -1 {
+		return s.pick(p, sp)
+	}
+	return nil
+}
+
+// allowed reports whether the peer may request the piece
+func (s *superSeeder) allowed(p *uploadPeer, index int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.peers[p]
+	return ok && sp.given[index]
+}
+
+// bitfield records the pieces a peer says it has
+func (s *superSeeder) bitfield(p *uploadPeer, bf bitfield.Bitfield) []superOffer {
+	res := []superOffer{}
+	news := bf.AndNot(p.has)
+	for i := news.NextSet(0); i != -1; i = news.NextSet(i + 1) {
+		res = append(res, s.have(p, i)...)
+	}
+	return res
+}
+
+// have records that a peer has a piece, returning new offers for peers whose piece it passed on
+func (s *superSeeder) have(p *uploadPeer, index int) []superOffer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sp, ok := s.peers[p]
+	if !ok || p.has.HasPiece(index) {
+		return nil
+	}
+	p.has.SetPiece(index)
+	s.seen[index]++
+	res := []superOffer{}
+	for q, sq := range s.peers {
+		if q != p && sq.current == index {
+			s.offered[index]--
+			sq.current = -1
+			res = append(res, s.pick(q, sq)...)
+		}
+	}
+	if sp.current == index && len(s.peers) == 1 {
+		s.offered[index]--
+		sp.current = -1
+		res = append(res, s.pick(p, sp)...)
+	}
+	return res
+}
+
+// alone offers a new piece to a lone peer that's finished its last one. Must be called with s.mu
+// held.
+func (s *superSeeder) alone() []superOffer {
+	if len(s.peers) != 1 {
+		return nil
+	}
+	for p, sp := range s.peers {
+		if sp.current != -1 && p.has.HasPiece(sp.current) {
+			s.offered[sp.current]--
+			sp.current = -1
+			return s.pick(p, sp)
+		}
+	}
+	return nil
+}
+
+// pick offers the peer the rarest piece it doesn't have, counting pieces on offer to others as
+// though they'd already been passed on. Must be called with s.mu held.
+func (s *superSeeder) pick(p *uploadPeer, sp *superPeer) []superOffer {
+	best := -1
+	for i := range s.seen {
+		if p.has.HasPiece(i) || !s.ours.HasPiece(i) {
+			continue
+		}
+		if best == -1 || s.seen[i]+s.offered[i] < s.seen[best]+s.offered[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil // the peer has everything
+	}
+	sp.current = best
+	sp.given[best] = true
+	s.offered[best]++
+	return []superOffer{{p, best}}
+}
@@ -0,0 +1,131 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// swarm is a simulated swarm on loopback: fake seeders with injected faults behind a fake tracker
+// that leechers find them through
+type swarm struct {
+	tf      torrentfile.TorrentFile
+	data    []byte
+	seeders []*fakeSeeder
+	tracker *fakeTracker
+}
+
+// newSwarm starts a seeder for each set of faults. Each seeder gets its own loopback address, as
+// peers are banned by IP and a corrupt seeder mustn't take the others down with it.
+func newSwarm(t *testing.T, tf torrentfile.TorrentFile, data []byte, seeders ...faults) *swarm {
+	s := &swarm{data: data}
+	peers := []client.Peer{}
+	for i, f := range seeders {
+		seeder := newFaultySeeder(t, loopbackIP(t, i+1), tf, data, f)
+		s.seeders = append(s.seeders, seeder)
+		peers = append(peers, seeder.peer())
+	}
+	s.tracker = newFakeTracker(peers...)
+	tf.Announce = s.tracker.URL + "/announce"
+	s.tf = tf
+	return s
+}
+
+// loopbackIP returns the nth address in 127.0.0.0/8, skipping the test on systems where only
+// 127.0.0.1 is usable
+func loopbackIP(t *testing.T, n int) string {
+	ip := fmt.Sprintf("127.0.0.%d", n)
+	ln, err := net.Listen("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		t.Skipf("can't listen on %s: %v", ip, err)
+	}
+	ln.Close()
+	return ip
+}
+
+func (s *swarm) close() {
+	for _, seeder := range s.seeders {
+		seeder.close()
+	}
+	s.tracker.Close()
+}
+
+// download runs leechers at the same time, each announcing to the tracker and downloading the
+// whole torrent, and checks every one of them ends up with an identical copy
+func (s *swarm) download(t *testing.T, leechers int) {
+	t.Helper()
+	errs := make([]error, leechers)
+	storage := make([]*os.File, leechers)
+	var wg sync.WaitGroup
+	for i := 0; i < leechers; i++ {
+		to := NewTorrent(s.tf)
+		storage[i] = newTestStorage(t)
+		to.Storage = storage[i]
+		// faulty seeders fail a lot, so retry them quickly and for longer than usual
+		to.Conns.BackoffBase = 10 * time.Millisecond
+		to.Conns.BackoffMax = 100 * time.Millisecond
+		to.Conns.MaxAttempts = 50
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if errs[i] = to.Announce(ctx, client.PeerID, 6881); errs[i] == nil {
+				errs[i] = to.Download(ctx)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("leecher %d: unexpected error downloading: %v", i, err)
+			continue
+		}
+		have, _ := os.ReadFile(storage[i].Name())
+		if !bytes.Equal(have, s.data) {
+			t.Errorf("leecher %d: downloaded data doesn't match", i)
+		}
+	}
+}
+
+func TestSwarm(t *testing.T) {
+	allPieces := map[int]bool{}
+	for i := 0; i < 8; i++ {
+		allPieces[i] = true
+	}
+	tests := []struct {
+		name     string
+		seeders  []faults
+		leechers int
+	}{
+		{"clean", []faults{{}, {}, {}}, 3},
+		{"latency", []faults{{latency: 2 * time.Millisecond}, {latency: 5 * time.Millisecond}}, 2},
+		{"loss", []faults{{loss: 0.1}, {loss: 0.1}}, 2},
+		{"choking", []faults{{choke: true}, {}}, 2},
+		{"corrupt", []faults{{corrupt: allPieces}, {}}, 2},
+		{"everything", []faults{
+			{choke: true},
+			{corrupt: map[int]bool{1: true, 5: true}, latency: time.Millisecond},
+			{loss: 0.1, latency: 2 * time.Millisecond},
+			{},
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaks := checkGoroutines(t)
+			tf, data := testTorrentFile(8*32768-1000, 32768)
+			s := newSwarm(t, tf, data, tt.seeders...)
+			s.download(t, tt.leechers)
+			s.close()
+			leaks()
+		})
+	}
+}
@@ -2,22 +2,30 @@ package torrent
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go-bt-learning.brk3.github.io/internal/bencodecustom"
 	"go-bt-learning.brk3.github.io/internal/bitfield"
 	"go-bt-learning.brk3.github.io/internal/client"
+	"go-bt-learning.brk3.github.io/internal/connmgr"
 	"go-bt-learning.brk3.github.io/internal/message"
+	"go-bt-learning.brk3.github.io/internal/ratelimit"
+	"go-bt-learning.brk3.github.io/internal/storage"
 	"go-bt-learning.brk3.github.io/internal/torrentfile"
 )
 
 const (
 	// MaxBlockSize is the largest number of bytes a request can ask for
-	MaxBlockSize = 16384
+	MaxBlockSize = message.MaxBlockSize
 
 	// MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
 	MaxBacklog = 5
@@ -26,27 +34,60 @@ const (
 type Torrent struct {
 	File     torrentfile.TorrentFile
 	Peers    []client.Peer
+	PeersV2  []client.Peer // peers in a hybrid torrent's v2 swarm, which are dialled with the v2 info hash
 	Bitfield bitfield.Bitfield
+	Limits   *connmgr.Limits // can be shared with other torrents to cap connections process-wide
+	Conns    connmgr.Config
+	Storage  storage.Storage // where verified pieces are written
+
+	// DownLimit and UpLimit throttle every peer connection. Either may be nil for no limit.
+	DownLimit *ratelimit.Limiter
+	UpLimit   *ratelimit.Limiter
+
+	// Listening is set when peers can connect to us on a listen port, so running out of peers to
+	// dial isn't the end of the download
+	Listening bool
+
+	// Readahead is how many bytes ahead of a FileReader are downloaded before anything else
+	Readahead int
+
+	// SuperSeed makes Seed offer peers one piece at a time rather than everything we have, so an
+	// initial seeder uploads as little as possible twice (BEP 16)
+	SuperSeed bool
+
+	// Logger gets the torrent's diagnostics, which are discarded if it's nil
+	Logger *log.Logger
+
+	mu             sync.Mutex // guards Bitfield, Peers, filePriorities, picker and conns
+	filePriorities []Priority
+	scores         *peerScores
+	conns          *connmgr.Manager
+	connsV2        *connmgr.Manager    // a hybrid torrent's v2 swarm, nil otherwise
+	picker         *piecePicker        // nil unless a download is running
+	windows        map[*FileReader]int // first piece each open reader wants
+	pieceDone      chan struct{}       // closed and replaced whenever we get a piece
+	webSeeds       int32               // web seeds still in use, accessed atomically
+	super          *superSeeder        // nil unless super-seeding
+	cache          *readCache          // nil unless seeding
+	uploads        uploadStats
+	peerID         string // what we last announced ourselves as, so we can tell the tracker when we stop
+	port           uint16
 }
 
+// errNoPeers is returned by Download when every peer we know of has failed or been banned
+var errNoPeers = fmt.Errorf("no peers left to download from")
+
+// stoppedTimeout bounds how long shutdown waits to tell the tracker we've stopped
+const stoppedTimeout = 5 * time.Second
+
 type pieceWork struct {
 	index  int
-	hash   [20]byte
 	length int
 }
 
 type pieceResult struct {
 	index int
 	buf   []byte
-	err   error
-}
-
-type pieceProgress struct {
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
 }
 
 type trackerResponse struct {
@@ -56,45 +97,110 @@ type trackerResponse struct {
 }
 
 func NewTorrent(t torrentfile.TorrentFile) *Torrent {
-	return &Torrent{
+	if len(t.Files) == 0 {
+		t.Files = []torrentfile.File{{Path: t.Name, Length: t.Length}}
+	}
+	priorities := make([]Priority, len(t.Files))
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+	}
+	to := &Torrent{
 		File:     t,
-		Bitfield: make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8), // round up trick to ensure enough bytes
+		Bitfield: bitfield.New(t.NumPieces()),
+		Limits:   connmgr.DefaultLimits(),
+		Conns:    connmgr.DefaultConfig,
+
+		Readahead: DefaultReadahead,
+
+		filePriorities: priorities,
+		windows:        map[*FileReader]int{},
+		pieceDone:      make(chan struct{}),
 	}
+	to.scores = newPeerScores(to.logf)
+	return to
 }
 
-func (t *Torrent) Announce(peerID string, port uint16) error {
-	tu, err := t.File.BuildTrackerURL(peerID, port)
+// logf logs to t.Logger, if there is one
+func (t *Torrent) logf(format string, args ...any) {
+	if t.Logger != nil {
+		t.Logger.Printf(format, args...)
+	}
+}
+
+// Announce tells the tracker we've started downloading and stores the peers it returns. Hybrid
+// torrents are announced in both their v1 and v2 swarms.
+func (t *Torrent) Announce(ctx context.Context, peerID string, port uint16) error {
+	t.peerID, t.port = peerID, port
+	return t.announce(ctx, "started")
+}
+
+func (t *Torrent) announce(ctx context.Context, event string) error {
+	for i, infoHash := range t.File.SwarmHashes() {
+		peers, err := t.announceSwarm(ctx, infoHash, event)
+		if err != nil {
+			return err
+		}
+		if event == "stopped" {
+			continue // the peers we know of are still worth keeping for next time
+		}
+		t.mu.Lock()
+		if i == 0 {
+			t.Peers = peers
+		} else {
+			t.PeersV2 = peers
+		}
+		t.mu.Unlock()
+	}
+	return nil
+}
+
+// AnnounceInfoHash asks a tracker for peers in a swarm we don't have the metadata for yet, as for a
+// torrent added from a magnet link. We can't say how much we have left, so we claim a byte to make
+// sure the tracker treats us as a leecher and hands out its seeders.
+func AnnounceInfoHash(ctx context.Context, announce string, infoHash [20]byte, peerID string, port uint16) ([]client.Peer, error) {
+	t := &Torrent{
+		File:   torrentfile.TorrentFile{Announce: announce, InfoHash: infoHash, Length: 1},
+		peerID: peerID,
+		port:   port,
+	}
+	return t.announceSwarm(ctx, infoHash, "started")
+}
+
+func (t *Torrent) announceSwarm(ctx context.Context, infoHash [20]byte, event string) ([]client.Peer, error) {
+	tu, err := t.File.BuildTrackerURLFor(infoHash, t.peerID, t.port, event)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	c := &http.Client{
 		Timeout: 5 * time.Second,
 	}
-	req, err := http.NewRequest("GET", tu, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", tu, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	res, err := c.Do(req)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
-		return fmt.Errorf("tracker returned non-200 status: %d", res.StatusCode)
+		return nil, fmt.Errorf("tracker returned non-200 status: %d", res.StatusCode)
+	}
+	if event == "stopped" {
+		return nil, nil // there's nothing we need from the response
 	}
 	tr, err := unmarshalTrackerResponse(res.Body)
 	if err != nil {
-		return fmt.Errorf("error decoding tracker response: %w", err)
+		return nil, fmt.Errorf("error decoding tracker response: %w", err)
 	}
 	if tr.FailureReason != "" {
-		return fmt.Errorf("tracker failed: %s", tr.FailureReason)
+		return nil, fmt.Errorf("tracker failed: %s", tr.FailureReason)
 	}
 	peers, err := client.Unmarshal([]byte(tr.Peers))
 	if err != nil {
-		return fmt.Errorf("error parsing peers: %w", err)
+		return nil, fmt.Errorf("error parsing peers: %w", err)
 	}
-	t.Peers = peers
-	return nil
+	return peers, nil
 }
 
 func unmarshalTrackerResponse(r io.Reader) (trackerResponse, error) {
@@ -138,7 +244,7 @@ func safeGet[T any](m map[string]any, key string) (T, error) {
 
 func (t *Torrent) calculatePieceSize(index int) int {
 	remainder := t.File.Length % t.File.PieceLength
-	if remainder > 0 && index == len(t.File.PieceHashes)-1 {
+	if remainder > 0 && index == t.File.NumPieces()-1 {
 		return remainder
 	}
 	return t.File.PieceLength
@@ -149,120 +255,431 @@ func (t *Torrent) calculateBoundsForPiece(index int) (begin, end int) {
 	return prevEnd, prevEnd + t.calculatePieceSize(index)
 }
 
-func (t *Torrent) startDownloadWorker(peer client.Peer, workQueue chan pieceWork, resQueue chan pieceResult) {
-	c, err := client.NewClient(peer, t.File.InfoHash)
-	if err != nil {
-		fmt.Printf("%s: error creating client for peer: %v\n", peer.String(), err)
+// PeerSource is how we found out about a peer
+type PeerSource int
+
+const (
+	SourceTracker PeerSource = iota
+	SourceDHT
+	SourcePEX
+	SourceLSD
+	SourceMagnet // listed in the magnet link the torrent was added from
+)
+
+func (s PeerSource) String() string {
+	switch s {
+	case SourceTracker:
+		return "tracker"
+	case SourceDHT:
+		return "dht"
+	case SourcePEX:
+		return "pex"
+	case SourceLSD:
+		return "lsd"
+	case SourceMagnet:
+		return "magnet"
+	}
+	return fmt.Sprintf("PeerSource(%d)", int(s))
+}
+
+// AddPeers gives the torrent more peers to connect to, straight away if it's downloading. Private
+// torrents (BEP 27) only take peers from the tracker, so peers from anywhere else are dropped and
+// false is returned.
+func (t *Torrent) AddPeers(peers []client.Peer, source PeerSource) bool {
+	if t.File.Private && source != SourceTracker {
+		t.logf("ignoring %d peers from %s for private torrent %s\n", len(peers), source, t.File.Name)
+		return false
+	}
+	t.mu.Lock()
+	conns := t.conns
+	if conns == nil {
+		t.Peers = append(t.Peers, peers...)
+	}
+	t.mu.Unlock()
+	if conns != nil {
+		conns.AddPeers(peers)
+	}
+	return true
+}
+
+// AddConn hands the torrent a connection a peer opened to us. It returns false if we aren't
+// downloading or don't want the peer, in which case the caller should close the connection. Private
+// torrents accept these too, as the peer will have found us through the tracker. Peers of a hybrid
+// torrent join whichever swarm they handshook in.
+func (t *Torrent) AddConn(c *client.Client) bool {
+	t.mu.Lock()
+	conns := t.conns
+	if t.connsV2 != nil && c.InfoHash != t.File.InfoHash {
+		conns = t.connsV2
+	}
+	t.mu.Unlock()
+	if conns == nil {
+		return false
+	}
+	return conns.AddConn(c)
+}
+
+// NumPeers returns how many peers we're connected to
+func (t *Torrent) NumPeers() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, conns := range t.managers() {
+		n += conns.NumConns()
+	}
+	return n
+}
+
+// managers returns the connection managers of each swarm we're in, none if we aren't downloading.
+// Must be called with t.mu held.
+func (t *Torrent) managers() []*connmgr.Manager {
+	res := []*connmgr.Manager{}
+	for _, conns := range []*connmgr.Manager{t.conns, t.connsV2} {
+		if conns != nil {
+			res = append(res, conns)
+		}
+	}
+	return res
+}
+
+// Completed returns how many pieces we have
+func (t *Torrent) Completed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Bitfield.Count()
+}
+
+// Recheck hashes whatever is already in storage and replaces our bitfield with the pieces that
+// turned out to be intact. It mustn't be called while a download is running.
+func (t *Torrent) Recheck() error {
+	bf := bitfield.New(t.File.NumPieces())
+	buf := make([]byte, t.File.PieceLength)
+	for index := 0; index < t.File.NumPieces(); index++ {
+		begin, end := t.calculateBoundsForPiece(index)
+		n, err := t.Storage.ReadAt(buf[:end-begin], int64(begin))
+		if err == io.EOF && n < end-begin {
+			break // the rest of the data was never written
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading piece %d: %w", index, err)
+		}
+		if t.checkIntegrity(index, buf[:n]) == nil {
+			bf.SetPiece(index)
+		}
+	}
+	t.mu.Lock()
+	t.Bitfield = bf
+	t.notifyPieces()
+	t.mu.Unlock()
+	return nil
+}
+
+// startDownloadWorker downloads pieces from a connected peer until ctx is cancelled or the
+// connection fails. The connection manager closes the connection once it returns, which is also how
+// a worker blocked reading from the peer is stopped.
+func (t *Torrent) startDownloadWorker(ctx context.Context, c *client.Client, picker *piecePicker, hashers *hashPool) {
+	peer := c.Peer
+	c.NumPieces = t.File.NumPieces()
+	defer c.KeepAlive(t.idleTimeout())()
+	if err := c.Send(message.Interested{}); err != nil {
+		t.logf("%s: error sending interested message: %v\n", peer.String(), err)
 		return
 	}
-	defer c.Conn.Close()
-	c.Conn.Write((&message.Message{ID: message.MsgInterested}).Serialize())
+	t.mu.Lock()
+	told := &toldPieces{bf: append(bitfield.Bitfield{}, t.Bitfield...)}
+	t.mu.Unlock()
+	var uselessSince time.Time
 	for {
-		if !c.Choked && c.Bitfield != nil {
-			pw, ok := <-workQueue
-			if !ok {
-				fmt.Printf("%s: no more work in queue, closing\n", peer.String())
+		if err := t.sendHaves(c, told); err != nil {
+			t.logf("%s: error sending have message: %v\n", peer.String(), err)
+			return
+		}
+		// a peer that keeps us choked or has nothing we want is taking a slot someone else could use
+		if c.Choked || c.Bitfield == nil || !picker.interesting(c.Bitfield) {
+			if uselessSince.IsZero() {
+				uselessSince = time.Now()
+			} else if time.Since(uselessSince) > t.idleTimeout() {
+				t.logf("%s: nothing to download from peer for %v, disconnecting\n", peer.String(), t.idleTimeout())
 				return
 			}
-			if !c.Bitfield.HasPiece(pw.index) {
-				fmt.Printf("%s: peer doesn't have piece index %d, requeuing\n", peer.String(), pw.index)
-				workQueue <- pw
-				continue
-			}
-			buf, err := downloadPiece(c, pw)
+		} else {
+			uselessSince = time.Time{}
+		}
+		if c.Choked || c.Bitfield == nil {
+			_, err := c.HandleMessage()
 			if err != nil {
-				fmt.Printf("%s: error downloading piece index %d, requeuing\n", peer.String(), pw.index)
-				workQueue <- pw
-				continue
+				t.logf("%s: error reading message from peer: %v\n", peer.String(), err)
+				return
 			}
-			err = checkIntegrity(pw, buf)
-			if err != nil {
-				fmt.Printf("%s: piece #%d failed integrity check, requeueing\n", peer.String(), pw.index)
-				workQueue <- pw
+			continue
+		}
+		index, ok, wait := picker.pick(c.Bitfield)
+		var pp *partialPiece
+		if ok {
+			pp = picker.start(t.pieceWork(index))
+		} else {
+			// everything the peer has that we want is being fetched from someone else, so help
+			// fetch whatever blocks are still missing
+			pp = picker.join(c.Bitfield)
+		}
+		if pp == nil {
+			if picker.interesting(c.Bitfield) {
+				// that might not work out
+				select {
+				case <-wait:
+				case <-ctx.Done():
+					return
+				}
 				continue
 			}
-			resQueue <- pieceResult{index: pw.index, buf: buf}
-		} else {
+			// nothing to do until the peer tells us it has something new
 			_, err := c.HandleMessage()
 			if err != nil {
-				fmt.Printf("%s: error reading message from peer: %v\n", peer.String(), err)
+				t.logf("%s: error reading message from peer: %v\n", peer.String(), err)
 				return
 			}
+			continue
+		}
+		finished, err := downloadPiece(c, picker, pp)
+		picker.leave(pp)
+		if err != nil {
+			// the connection is left in an unknown state, so it can't be used for anything else
+			t.logf("%s: error downloading piece index %d, requeuing: %v\n", peer.String(), pp.index, err)
+			return
+		}
+		if !finished {
+			continue // other peers sent the rest of it
+		}
+		t.logf("%s: successfully downloaded piece %d, size %d\n", peer.String(), pp.index, len(pp.buf))
+		if !hashers.submit(ctx, hashJob{index: pp.index, buf: pp.buf, sources: pp.sources, c: c, told: told}) {
+			picker.abort(pp.index)
+			return
 		}
 	}
 }
 
-func checkIntegrity(pw pieceWork, buf []byte) error {
-	if s := sha1.Sum(buf); s != pw.hash {
-		return fmt.Errorf("received piece hash (%s) doesn't match expected (%s)\n", s, pw.hash)
+// idleTimeout is how long peers get to be useful to us before they're disconnected
+func (t *Torrent) idleTimeout() time.Duration {
+	if t.Conns.IdleTimeout <= 0 {
+		return client.DefaultIdleTimeout
 	}
-	return nil
+	return t.Conns.IdleTimeout
+}
+
+// sendHaves tells the peer about pieces we've got since it was last told, so a super-seeder
+// (BEP 16) can see the pieces it offers being passed on
+func (t *Torrent) sendHaves(c *client.Client, told *toldPieces) error {
+	t.mu.Lock()
+	ours := append(bitfield.Bitfield{}, t.Bitfield...)
+	t.mu.Unlock()
+	return told.tell(c, ours)
+}
+
+func (t *Torrent) pieceWork(index int) pieceWork {
+	return pieceWork{index, t.calculatePieceSize(index)}
 }
 
-func downloadPiece(c *client.Client, pw pieceWork) ([]byte, error) {
-	piece := pieceProgress{
-		client: c,
-		buf:    make([]byte, pw.length),
+// ban disconnects and blocks each of the IPs
+func (t *Torrent) ban(ips []string) {
+	t.mu.Lock()
+	managers := t.managers()
+	t.mu.Unlock()
+	for _, ip := range ips {
+		for _, conns := range managers {
+			conns.Ban(net.ParseIP(ip))
+		}
+	}
+}
+
+// checkIntegrity checks a piece against its SHA-1 hash, its merkle tree for v2 torrents, or both
+// for hybrid torrents
+func (t *Torrent) checkIntegrity(index int, buf []byte) error {
+	if index < 0 || index >= t.File.NumPieces() {
+		return fmt.Errorf("piece %d out of range", index)
 	}
+	if len(t.File.PieceHashes) > 0 {
+		if s, want := sha1.Sum(buf), t.File.PieceHashes[index]; s != want {
+			return fmt.Errorf("received piece hash (%x) doesn't match expected (%x)", s, want)
+		}
+	}
+	if len(t.File.PiecesV2) > 0 && !t.File.PiecesV2[index].Verify(buf) {
+		return fmt.Errorf("piece %d doesn't match its merkle tree", index)
+	}
+	return nil
+}
+
+// downloadPiece requests blocks of the piece from the peer until every block has arrived, from it
+// or from other peers fetching the same piece. Returns true if the peer sent the last block.
+func downloadPiece(c *client.Client, picker *piecePicker, pp *partialPiece) (bool, error) {
+	requested := make([]bool, len(pp.sources))   // blocks asked for
+	outstanding := make([]bool, len(pp.sources)) // blocks asked for that haven't arrived
+	backlog := 0
 	// Setting a deadline helps get unresponsive peers unstuck.
 	// 30 seconds is more than enough time to download a 262 KB piece
 	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
 	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
-	for piece.downloaded < pw.length {
-		// If unchoked, send requests until we have enough unfulfilled requests
-		if !piece.client.Choked {
-			for piece.backlog < MaxBacklog && piece.requested < pw.length {
-				blockSize := MaxBlockSize
-				// Last block might be shorter than the typical block
-				if pw.length-piece.requested < blockSize {
-					blockSize = pw.length - piece.requested
+	for !picker.isDone(pp) {
+		// If unchoked, send requests until we have enough unfulfilled requests, in one write
+		if !c.Choked {
+			for backlog < MaxBacklog {
+				block := picker.nextBlock(pp, requested)
+				if block == -1 {
+					break
 				}
-				err := c.SendRequest(pw.index, piece.requested, blockSize)
+				err := c.Queue(message.Request{Index: pp.index, Begin: block * MaxBlockSize, Length: len(blockOf(pp.buf, block))})
 				if err != nil {
-					return nil, err
+					return false, err
 				}
-				piece.backlog++
-				piece.requested += blockSize
+				requested[block] = true
+				outstanding[block] = true
+				backlog++
+			}
+			if err := c.Flush(); err != nil {
+				return false, err
 			}
 		}
-		msg, err := piece.client.HandleMessage()
+		msg, err := c.HandleMessage()
 		if err != nil {
-			return nil, err
+			return false, err
+		}
+		if msg == nil || msg.ID != message.MsgPiece {
+			continue
 		}
-		if msg != nil && msg.ID == message.MsgPiece {
-			n := message.ParsePiece(piece.buf, msg)
-			piece.downloaded += n
-			piece.backlog--
+		typed, err := message.Decode(msg)
+		if err != nil {
+			return false, err
+		}
+		p := typed.(message.Piece)
+		if p.Index != pp.index {
+			continue // asked for before another peer finished the piece we wanted it for
+		}
+		finished, err := picker.put(pp, p.Begin, p.Block, c.Peer.IP.String())
+		if err != nil {
+			return false, err
+		}
+		if block := p.Begin / MaxBlockSize; outstanding[block] {
+			outstanding[block] = false
+			backlog--
+		}
+		if finished {
+			return true, nil
 		}
 	}
-	fmt.Printf("%s: successfully downloaded piece %d, size %d\n", c.Peer.String(), pw.index, len(piece.buf))
-	return piece.buf, nil
+	return false, nil
 }
 
-func (t *Torrent) Download() []byte {
-	workQueue := make(chan pieceWork, len(t.File.PieceHashes)) // buffered channel
-	resQueue := make(chan pieceResult)
-	fmt.Printf("we have %d pieces to fetch\n", len(t.File.PieceHashes))
-	for index, hash := range t.File.PieceHashes {
-		length := t.calculatePieceSize(index)
-		workQueue <- pieceWork{index, hash, length}
+// Download fetches every piece we want and don't already have, writing them to t.Storage. It
+// returns once the download completes, ctx is cancelled or there's nobody left to download from.
+// Either way every connection is closed, storage is flushed and the tracker is told we've stopped
+// before it returns.
+func (t *Torrent) Download(ctx context.Context) error {
+	if t.Storage == nil {
+		return fmt.Errorf("torrent has no storage to download into")
 	}
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, resQueue)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resQueue := make(chan pieceResult, MaxQueuedPieces)
+	t.mu.Lock()
+	if err := t.applySkipped(); err != nil {
+		t.mu.Unlock()
+		return err
 	}
-	buf := make([]byte, t.File.Length)
-	donePieces := 0
-	for donePieces < len(t.File.PieceHashes) {
-		res := <-resQueue
-		if res.err != nil {
-			// TODO: handle worker failure
-			fmt.Printf("worker error downloading piece %d: %v\n", res.index, res.err)
-			continue
+	picker := newPiecePicker(t.piecePriorities(), t.Bitfield)
+	picker.setWindows(t.windowRanges())
+	t.picker = picker
+	managers := t.startConns()
+	peers := [][]client.Peer{t.Peers, t.PeersV2}
+	t.mu.Unlock()
+	t.logf("we have %d pieces to fetch\n", picker.remaining())
+	hashers := t.startHashers(ctx, picker, resQueue)
+	for i, conns := range managers {
+		conns.AddPeers(peers[i])
+		conns.Start(func(c *client.Client) {
+			t.startDownloadWorker(ctx, c, picker, hashers)
+		})
+	}
+	waitWebSeeds := t.startWebSeeds(ctx, picker, resQueue)
+	err := t.collectPieces(ctx, picker, resQueue)
+	cancel()
+	for _, conns := range managers {
+		conns.Close()
+	}
+	waitWebSeeds()
+	hashers.close()
+	if serr := t.Storage.Sync(); serr != nil && err == nil {
+		err = fmt.Errorf("error flushing storage: %w", serr)
+	}
+	t.mu.Lock()
+	t.picker = nil
+	t.mu.Unlock()
+	t.stop()
+	return err
+}
+
+// collectPieces writes pieces to storage as the workers finish them, until we have every piece we
+// want
+func (t *Torrent) collectPieces(ctx context.Context, picker *piecePicker, resQueue chan pieceResult) error {
+	// nobody's connected when we start, so give the connection manager a chance before deciding
+	// we've run out of peers
+	check := time.NewTicker(5 * time.Second)
+	defer check.Stop()
+	for picker.remaining() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-check.C:
+			if !t.Listening && t.exhausted() && atomic.LoadInt32(&t.webSeeds) == 0 {
+				return errNoPeers
+			}
+		case res := <-resQueue:
+			// write whatever else is waiting along with it
+			batch := []pieceResult{res}
+		drain:
+			for len(batch) < MaxQueuedPieces {
+				select {
+				case res := <-resQueue:
+					batch = append(batch, res)
+				default:
+					break drain
+				}
+			}
+			if err := t.writePieces(batch); err != nil {
+				return err
+			}
+			t.mu.Lock()
+			for _, res := range batch {
+				t.Bitfield.SetPiece(res.index)
+			}
+			t.notifyPieces()
+			t.mu.Unlock()
+			for _, res := range batch {
+				picker.finish(res.index)
+			}
 		}
-		begin, end := t.calculateBoundsForPiece(res.index)
-		copy(buf[begin:end], res.buf)
-		donePieces++
 	}
-	close(workQueue)
-	return buf
+	return nil
+}
+
+// exhausted reports whether every swarm has run out of peers to try
+func (t *Torrent) exhausted() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, conns := range t.managers() {
+		if !conns.Exhausted() {
+			return false
+		}
+	}
+	return true
+}
+
+// stop tells the tracker we've stopped, if we ever told it we'd started
+func (t *Torrent) stop() {
+	if t.peerID == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stoppedTimeout)
+	defer cancel()
+	if err := t.announce(ctx, "stopped"); err != nil {
+		t.logf("error announcing stop to tracker: %v\n", err)
+	}
 }
@@ -0,0 +1,181 @@
+package torrent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/bitfield"
+	"go-bt-learning.brk3.github.io/internal/ratelimit"
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+// webSeedTimeout bounds a single range request to a web seed
+const webSeedTimeout = 30 * time.Second
+
+// startWebSeeds downloads from each of the torrent's web seeds (BEP 19) alongside the peers. Web
+// seeds are plain HTTP servers holding the torrent's files, so they have every piece and never choke
+// us. The returned function waits for them all to stop once ctx is cancelled.
+func (t *Torrent) startWebSeeds(ctx context.Context, picker *piecePicker, resQueue chan pieceResult) func() {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil || (t.DownLimit == nil && t.UpLimit == nil) {
+				return conn, err
+			}
+			return ratelimit.NewConn(conn, t.DownLimit, t.UpLimit), nil
+		},
+	}
+	c := &http.Client{Transport: transport, Timeout: webSeedTimeout}
+	wg := sync.WaitGroup{}
+	for _, u := range t.File.URLList {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			// there's no FTP client in the standard library, so ftp:// seeds go unused
+			t.logf("%s: ignoring web seed, only http and https are supported\n", u)
+			continue
+		}
+		atomic.AddInt32(&t.webSeeds, 1)
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			defer atomic.AddInt32(&t.webSeeds, -1)
+			t.runWebSeed(ctx, c, u, picker, resQueue)
+		}(u)
+	}
+	return func() {
+		wg.Wait()
+		transport.CloseIdleConnections()
+	}
+}
+
+// runWebSeed downloads pieces from one web seed until ctx is cancelled or the seed has failed too
+// many times in a row. Failures are retried with the same backoff as peers.
+func (t *Torrent) runWebSeed(ctx context.Context, c *http.Client, seed string, picker *piecePicker, resQueue chan pieceResult) {
+	all := bitfield.Full(t.File.NumPieces())
+	failures, hashFailures := 0, 0
+	for {
+		index, ok, wait := picker.pick(all)
+		if !ok {
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		pw := t.pieceWork(index)
+		buf, err := t.fetchPiece(ctx, c, seed, pw)
+		if err == nil {
+			if err = t.checkIntegrity(pw.index, buf); err != nil {
+				hashFailures++
+			}
+		}
+		if err != nil {
+			picker.abort(index)
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			t.logf("%s: error fetching piece %d from web seed: %v\n", seed, index, err)
+			if failures >= t.Conns.MaxAttempts || hashFailures >= MaxHashFailures {
+				t.logf("%s: giving up on web seed after %d failures\n", seed, failures)
+				return
+			}
+			timer := time.NewTimer(t.Conns.Backoff(failures))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+			continue
+		}
+		failures = 0
+		t.logf("%s: successfully downloaded piece %d from web seed, size %d\n", seed, index, len(buf))
+		select {
+		case resQueue <- pieceResult{index: index, buf: buf}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchPiece requests the byte range of each file the piece spans
+func (t *Torrent) fetchPiece(ctx context.Context, c *http.Client, seed string, pw pieceWork) ([]byte, error) {
+	begin, end := t.calculateBoundsForPiece(pw.index)
+	buf := make([]byte, pw.length)
+	for _, f := range t.File.Files {
+		start, stop := f.Offset, f.Offset+f.Length
+		if start < begin {
+			start = begin
+		}
+		if stop > end {
+			stop = end
+		}
+		if start >= stop || f.Padding {
+			continue // padding is zeros, which buf already is
+		}
+		u := webSeedURL(seed, t.File, f)
+		if err := fetchRange(ctx, c, u, int64(start-f.Offset), buf[start-begin:stop-begin]); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// fetchRange reads len(buf) bytes of the file at u starting at off
+func fetchRange(ctx context.Context, c *http.Client, u string, off int64, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(buf))-1))
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the server ignored the range and is sending the whole file
+		if _, err := io.CopyN(io.Discard, res.Body, off); err != nil {
+			return fmt.Errorf("error skipping to offset %d: %w", off, err)
+		}
+	default:
+		return fmt.Errorf("web seed returned status %d for %s", res.StatusCode, u)
+	}
+	if _, err := io.ReadFull(res.Body, buf); err != nil {
+		return fmt.Errorf("error reading %s: %w", u, err)
+	}
+	return nil
+}
+
+// webSeedURL returns where a web seed keeps one of the torrent's files. A single file torrent's url
+// is the file itself unless it ends in a slash, in which case the torrent's name is added. Files in
+// a multi file torrent are always found under the url as name/path.
+func webSeedURL(seed string, tf torrentfile.TorrentFile, f torrentfile.File) string {
+	parts := strings.Split(filepath.ToSlash(f.Path), "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	single := len(tf.Files) == 1 && tf.Files[0].Path == tf.Name
+	if single && !strings.HasSuffix(seed, "/") {
+		return seed
+	}
+	if !strings.HasSuffix(seed, "/") {
+		seed += "/"
+	}
+	return seed + strings.Join(parts, "/")
+}
@@ -0,0 +1,109 @@
+package torrent
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/torrentfile"
+)
+
+func TestWebSeedURL(t *testing.T) {
+	single, _ := testTorrentFile(10, 10)
+	single.Name = "file.iso"
+	multi := multiFile(single, 5, 5)
+	multi.Files[1].Path = filepath.Join("file.iso", "sub dir", "b")
+	single.Files = []torrentfile.File{{Path: "file.iso", Length: 10}}
+	tests := []struct {
+		seed string
+		tf   torrentfile.TorrentFile
+		file int
+		want string
+	}{
+		{"http://a/pub/file.iso", single, 0, "http://a/pub/file.iso"},
+		{"http://a/pub/", single, 0, "http://a/pub/file.iso"},
+		{"http://a/pub", multi, 0, "http://a/pub/file.iso/a"},
+		{"http://a/pub/", multi, 1, "http://a/pub/file.iso/sub%20dir/b"},
+	}
+	for _, tt := range tests {
+		if have := webSeedURL(tt.seed, tt.tf, tt.tf.Files[tt.file]); have != tt.want {
+			t.Errorf("expected url %s for file %d under %s, got %s", tt.want, tt.file, tt.seed, have)
+		}
+	}
+}
+
+// webSeedDir writes out tf's files for a web seed to serve
+func webSeedDir(t *testing.T, tf torrentfile.TorrentFile, data []byte) string {
+	dir := t.TempDir()
+	for _, f := range tf.Files {
+		path := filepath.Join(dir, f.Path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, data[f.Offset:f.Offset+f.Length], 0644); err != nil {
+			t.Fatalf("error writing web seed file: %v", err)
+		}
+	}
+	return dir
+}
+
+func TestWebSeedDownload(t *testing.T) {
+	leaks := checkGoroutines(t)
+	tf, data := testTorrentFile(100000, 16384)
+	tf = multiFile(tf, 30000, 0, 70000)
+	srv := httptest.NewServer(http.FileServer(http.Dir(webSeedDir(t, tf, data))))
+	tf.URLList = []string{"ftp://unsupported/", srv.URL}
+	to := NewTorrent(tf)
+	storage := newTestStorage(t)
+	to.Storage = storage
+	if err := to.Download(context.Background()); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	srv.Close()
+	leaks()
+	b, _ := os.ReadFile(storage.Name())
+	if !bytes.Equal(b, data) {
+		t.Errorf("downloaded data doesn't match the web seed's files")
+	}
+}
+
+func TestWebSeedBackoff(t *testing.T) {
+	tf, data := testTorrentFile(50000, 16384)
+	tf.Files = []torrentfile.File{{Path: tf.Name, Length: tf.Length}}
+	files := http.FileServer(http.Dir(webSeedDir(t, tf, data)))
+	requests := int32(0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	tf.URLList = []string{srv.URL + "/"}
+	to := NewTorrent(tf)
+	to.Conns.BackoffBase = 10 * time.Millisecond
+	storage := newTestStorage(t)
+	to.Storage = storage
+	if err := to.Download(context.Background()); err != nil {
+		t.Fatalf("unexpected error downloading: %v", err)
+	}
+	b, _ := os.ReadFile(storage.Name())
+	if !bytes.Equal(b, data) {
+		t.Errorf("downloaded data doesn't match the web seed's files")
+	}
+
+	// a seed that never works is given up on and the download fails
+	tf.URLList = []string{srv.URL + "/missing"}
+	to = NewTorrent(tf)
+	to.Conns.BackoffBase = time.Millisecond
+	to.Conns.MaxAttempts = 2
+	to.Storage = newTestStorage(t)
+	if err := to.Download(context.Background()); err != errNoPeers {
+		t.Errorf("expected %v once the web seed was given up on, got %v", errNoPeers, err)
+	}
+}
@@ -1,31 +1,47 @@
 package torrentfile
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha1"
 	"fmt"
 	"io"
 	"net/url"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"go-bt-learning.brk3.github.io/internal/bencodecustom"
 )
 
 // serialisation structs - directly maps to torrentfile spec
 type bencodeInfo struct {
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
+	Files       []bencodeFile `bencode:"files"` // only set for multi file torrents
+	Length      int           `bencode:"length"`
+	Name        string        `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Private     *int          `bencode:"private"` // nil if the key isn't there, so the info hash still matches
+
+	// v2 torrents (BEP 52)
+	MetaVersion int            `bencode:"meta version"`
+	FileTree    map[string]any `bencode:"file tree"`
+	raw         []byte         // the info dict exactly as it was encoded, which info hashes are taken over
+}
+
+type bencodeFile struct {
+	Attr   string   `bencode:"attr"` // "p" marks padding files (BEP 47)
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
 }
 
 type bencodeTorrent struct {
-	Announce     string      `bencode:"announce"`
-	Comment      string      `bencode:"comment"`
-	CreatedBy    string      `bencode:"created by"`
-	CreationDate int         `bencode:"creation date"`
-	Info         bencodeInfo `bencode:"info"`
+	Announce     string         `bencode:"announce"`
+	Comment      string         `bencode:"comment"`
+	CreatedBy    string         `bencode:"created by"`
+	CreationDate int            `bencode:"creation date"`
+	Info         bencodeInfo    `bencode:"info"`
+	URLList      []string       `bencode:"url-list"`     // web seeds, a single string or a list in the file
+	PieceLayers  map[string]any `bencode:"piece layers"` // v2 piece hashes for each file, keyed by pieces root
 }
 
 // domain model - decouple ourselves from bencode format specifics
@@ -36,10 +52,38 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []File   // the files making up the torrent's data, in order
+	URLList     []string // web seeds serving the torrent's files over HTTP (BEP 19)
+	Private     bool     // peers may only come from the tracker (BEP 27)
+
+	// Info is the bencoded info dict the info hash is taken over, which peers fetching the
+	// torrent's metadata are sent (BEP 9)
+	Info []byte
+
+	// MetaVersion is 2 for v2 and hybrid torrents (BEP 52). A v2 torrent's InfoHash is its SHA-256
+	// info hash truncated to 20 bytes, which is what peers and trackers use for it. A hybrid torrent
+	// keeps its v1 InfoHash and can also be found under the truncated v2 one.
+	MetaVersion int
+	InfoHashV2  [32]byte
+	PiecesV2    []V2Piece // for verifying pieces with their merkle trees, one per piece
+}
+
+// File is one of the files in a torrent
+type File struct {
+	Path   string // relative to the download directory, under a directory named after the torrent for multi file torrents
+	Length int
+	Offset int // where the file starts in the torrent's data
+
+	Padding    bool     // fills the gap before the next file's first piece, so has no data to store
+	PiecesRoot [32]byte // root of the file's merkle tree in v2 torrents, zero for empty files
 }
 
 func NewTorrentFile(r io.Reader) (TorrentFile, error) {
-	b, err := unmarshal(bufio.NewReader(r))
+	data, err := io.ReadAll(io.LimitReader(r, bencodecustom.DefaultMaxSize+1))
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	b, err := unmarshal(data)
 	if err != nil {
 		return TorrentFile{}, err
 	}
@@ -51,58 +95,233 @@ func NewTorrentFile(r io.Reader) (TorrentFile, error) {
 	}
 	tf := TorrentFile{}
 	tf.PieceHashes = pieceHashes
-	tf.InfoHash = sha1.Sum(b.Info.marshal())
+	tf.Info = b.Info.raw
+	tf.InfoHash = sha1.Sum(tf.Info)
 	tf.Announce = b.Announce
 	tf.PieceLength = b.Info.PieceLength
 	tf.Length = b.Info.Length
 	tf.Name = b.Info.Name
+	tf.URLList = b.URLList
+	tf.Private = b.Info.Private != nil && *b.Info.Private == 1
+	if len(b.Info.Files) == 0 {
+		tf.Files = []File{{Path: b.Info.Name, Length: b.Info.Length}}
+	} else {
+		offset := 0
+		for _, f := range b.Info.Files {
+			parts := append([]string{b.Info.Name}, f.Path...)
+			tf.Files = append(tf.Files, File{
+				Path:    filepath.Join(parts...),
+				Length:  f.Length,
+				Offset:  offset,
+				Padding: strings.Contains(f.Attr, "p"),
+			})
+			offset += f.Length
+		}
+		tf.Length = offset
+	}
+	if b.Info.MetaVersion != 2 || len(b.Info.Pieces) > 0 {
+		if want := (tf.Length + tf.PieceLength - 1) / tf.PieceLength; numPieces != want {
+			return TorrentFile{}, fmt.Errorf("torrent has %d piece hashes for %d pieces of data", numPieces, want)
+		}
+	}
+	if b.Info.MetaVersion == 2 {
+		if err := tf.loadV2(b); err != nil {
+			return TorrentFile{}, err
+		}
+		if numPieces > 0 && len(tf.PiecesV2) != numPieces {
+			return TorrentFile{}, fmt.Errorf("hybrid torrent has %d v1 pieces but %d v2 pieces", numPieces, len(tf.PiecesV2))
+		}
+	}
 	return tf, nil
 }
 
-func unmarshal(b *bufio.Reader) (bencodeTorrent, error) {
-	val, err := bencodecustom.Parse(b)
+// FromInfo builds a torrent from its bencoded info dict alone, as fetched from peers for a magnet
+// link, with announce as its tracker
+func FromInfo(info []byte, announce string) (TorrentFile, error) {
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("d8:announce%d:%s4:info", len(announce), announce))
+	buf.Write(info)
+	buf.WriteByte('e')
+	tf, err := NewTorrentFile(&buf)
 	if err != nil {
-		return bencodeTorrent{}, err
+		return TorrentFile{}, err
 	}
-	t, ok := val.(map[string]any)
-	if !ok {
-		return bencodeTorrent{}, fmt.Errorf("error converting Parse response to map[string]any")
+	if tf.MetaVersion == 2 {
+		// piece layers live outside the info dict, and we can't fetch them from peers yet
+		return TorrentFile{}, fmt.Errorf("can't load a v2 torrent from its info dict alone")
+	}
+	return tf, nil
+}
+
+// NumPieces returns how many pieces the torrent's data is split into
+func (t *TorrentFile) NumPieces() int {
+	if len(t.PieceHashes) > 0 {
+		return len(t.PieceHashes)
+	}
+	return len(t.PiecesV2)
+}
+
+func unmarshal(data []byte) (bencodeTorrent, error) {
+	t, rawInfo, err := parseTorrent(data)
+	if err != nil {
+		return bencodeTorrent{}, err
 	}
 	info, ok := t["info"].(map[string]any)
 	if !ok {
 		return bencodeTorrent{}, fmt.Errorf("error converting Info from response to map[string]any")
 	}
-	bt := bencodeTorrent{
-		Announce: t["announce"].(string),
-		Info: bencodeInfo{
-			Length:      info["length"].(int),
-			Name:        info["name"].(string),
-			PieceLength: info["piece length"].(int),
-			Pieces:      info["pieces"].(string),
-		},
+	bt := bencodeTorrent{}
+	bt.Info.raw = append([]byte{}, rawInfo...) // not the whole file, which may have large piece layers
+	bt.Announce, _ = t["announce"].(string)
+	if bt.Info.Name, ok = info["name"].(string); !ok {
+		return bencodeTorrent{}, fmt.Errorf("torrent has no name")
 	}
+	if bt.Info.PieceLength, ok = info["piece length"].(int); !ok || bt.Info.PieceLength <= 0 {
+		return bencodeTorrent{}, fmt.Errorf("torrent has missing or invalid piece length")
+	}
+	if err := checkPathPart(bt.Info.Name); err != nil {
+		return bencodeTorrent{}, err
+	}
+	bt.URLList = unmarshalURLList(t["url-list"])
+	if private, ok := info["private"].(int); ok {
+		bt.Info.Private = &private
+	}
+	bt.Info.MetaVersion, _ = info["meta version"].(int)
+	if bt.Info.MetaVersion == 2 {
+		if bt.Info.FileTree, ok = info["file tree"].(map[string]any); !ok {
+			return bencodeTorrent{}, fmt.Errorf("v2 torrent has no file tree")
+		}
+		bt.PieceLayers, _ = t["piece layers"].(map[string]any)
+		if _, hybrid := info["pieces"]; !hybrid {
+			return bt, nil
+		}
+	}
+	if bt.Info.Pieces, ok = info["pieces"].(string); !ok || len(bt.Info.Pieces)%20 != 0 {
+		return bencodeTorrent{}, fmt.Errorf("torrent has missing or invalid piece hashes")
+	}
+	if _, multi := info["files"]; !multi {
+		if bt.Info.Length, ok = info["length"].(int); !ok || bt.Info.Length < 0 {
+			return bencodeTorrent{}, fmt.Errorf("torrent has missing or invalid length")
+		}
+		return bt, nil
+	}
+	files, err := unmarshalFiles(info["files"])
+	if err != nil {
+		return bencodeTorrent{}, err
+	}
+	bt.Info.Files = files
 	return bt, nil
 }
 
-func (i bencodeInfo) marshal() []byte {
-	buf := bytes.Buffer{}
-	buf.WriteByte('d')
-	buf.WriteString(fmt.Sprintf("6:lengthi%se", strconv.Itoa(i.Length)))
-	buf.WriteString(fmt.Sprintf("4:name%s:%s", strconv.Itoa(len(i.Name)), i.Name))
-	buf.WriteString(fmt.Sprintf("12:piece lengthi%se", strconv.Itoa(i.PieceLength)))
-	buf.WriteString(fmt.Sprintf("6:pieces%s:%s", strconv.Itoa(len(i.Pieces)), i.Pieces))
-	buf.WriteByte('e')
-	return buf.Bytes()
+// parseTorrent reads a torrent file's top level dict, along with the bytes its info dict was encoded
+// as. Info hashes have to be taken over those bytes: encoding the parsed dict again would sort keys
+// the creator may have left unsorted.
+func parseTorrent(data []byte) (map[string]any, []byte, error) {
+	dec := bencodecustom.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, nil, err
+	} else if tok != bencodecustom.Delim('d') {
+		return nil, nil, fmt.Errorf("torrent file isn't a dict")
+	}
+	t := map[string]any{}
+	var info []byte
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		start := dec.InputOffset()
+		var val any
+		if err := dec.Decode(&val); err != nil {
+			return nil, nil, err
+		}
+		if key == "info" {
+			info = data[start:dec.InputOffset()]
+		}
+		t[key.(string)] = val
+	}
+	if _, err := dec.Token(); err != nil { // the dict's end
+		return nil, nil, err
+	}
+	return t, info, nil
+}
+
+func unmarshalFiles(val any) ([]bencodeFile, error) {
+	list, ok := val.([]any)
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("error converting files to a non-empty []any")
+	}
+	files := []bencodeFile{}
+	for _, item := range list {
+		f, ok := item.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("error converting file to map[string]any")
+		}
+		length, ok := f["length"].(int)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("file has missing or invalid length")
+		}
+		rawPath, ok := f["path"].([]any)
+		if !ok || len(rawPath) == 0 {
+			return nil, fmt.Errorf("file has missing or empty path")
+		}
+		path := []string{}
+		for _, p := range rawPath {
+			part, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("file path contains a %T, not a string", p)
+			}
+			if err := checkPathPart(part); err != nil {
+				return nil, err
+			}
+			path = append(path, part)
+		}
+		attr, _ := f["attr"].(string)
+		files = append(files, bencodeFile{Attr: attr, Length: length, Path: path})
+	}
+	return files, nil
+}
+
+// unmarshalURLList accepts either a single url or a list of them, ignoring anything else
+func unmarshalURLList(val any) []string {
+	switch v := val.(type) {
+	case string:
+		if v != "" {
+			return []string{v}
+		}
+	case []any:
+		urls := []string{}
+		for _, item := range v {
+			if u, ok := item.(string); ok && u != "" {
+				urls = append(urls, u)
+			}
+		}
+		return urls
+	}
+	return nil
+}
+
+// checkPathPart stops a torrent from writing outside the download directory
+func checkPathPart(part string) error {
+	if part == "" || part == "." || part == ".." || filepath.Base(part) != part {
+		return fmt.Errorf("invalid file name %q in torrent", part)
+	}
+	return nil
 }
 
 // buildTrackerURL combines the torrentfile's announce url with several key parameters namely our
-// info_hash and peer_id
-func (t *TorrentFile) BuildTrackerURL(peerID string, port uint16) (string, error) {
+// info_hash and peer_id. event is one of "started", "stopped" or "completed", or empty for a
+// regular announce.
+func (t *TorrentFile) BuildTrackerURL(peerID string, port uint16, event string) (string, error) {
+	return t.BuildTrackerURLFor(t.InfoHash, peerID, port, event)
+}
+
+// BuildTrackerURLFor is BuildTrackerURL for one of the torrent's other swarms, see SwarmHashes
+func (t *TorrentFile) BuildTrackerURLFor(infoHash [20]byte, peerID string, port uint16, event string) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
 	}
-	infoHash := t.InfoHash
 	params := url.Values{
 		"info_hash": []string{string(infoHash[:])}, // the file we’re trying to download
 		// TODO: find out how to properly pass [20]byte here instead of string
@@ -113,6 +332,9 @@ func (t *TorrentFile) BuildTrackerURL(peerID string, port uint16) (string, error
 		"compact":    []string{"1"},
 		"left":       []string{strconv.Itoa(t.Length)},
 	}
+	if event != "" {
+		params.Set("event", event)
+	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
@@ -2,21 +2,161 @@ package torrentfile
 
 import (
 	"crypto/sha1"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 )
 
-func TestMarshal(t *testing.T) {
+// onePiece is the hashes of a torrent with a single piece, for tests that don't look at them
+var onePiece = "6:pieces20:" + strings.Repeat("h", 20)
+
+func TestInfoHash(t *testing.T) {
 	p1 := sha1.Sum([]byte("piece1"))
 	p2 := sha1.Sum([]byte("piece2"))
-	b := bencodeInfo{
-		Length:      10,
-		Name:        "foo",
-		PieceLength: 5,
-		Pieces:      string(p1[:]) + string(p2[:]),
+	info := "d6:lengthi10e4:name3:foo12:piece lengthi5e6:pieces40:" + string(p1[:]) + string(p2[:]) + "e"
+	tf, err := NewTorrentFile(strings.NewReader("d8:announce3:url4:info" + info + "e"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
 	}
 	want := [20]uint8{237, 244, 120, 216, 145, 14, 59, 209, 182, 21, 51, 112, 162, 150, 171, 205, 224, 159, 244, 129}
-	have := sha1.Sum(b.marshal())
-	if want != have {
-		t.Errorf("unexpected infohash, have: %x, want: %x", have, want)
+	if want != tf.InfoHash {
+		t.Errorf("unexpected infohash, have: %x, want: %x", tf.InfoHash, want)
+	}
+}
+
+// TestInfoHashRaw checks the info hash is taken over the info dict exactly as it's encoded, keys we
+// don't know about and keys out of order included
+func TestInfoHashRaw(t *testing.T) {
+	tests := map[string]string{
+		"unknown key":   "d6:lengthi3e4:name1:a12:piece lengthi5e" + onePiece + "7:privatei1e6:source3:PTPe",
+		"unsorted keys": "d4:name1:a6:lengthi3e" + onePiece + "12:piece lengthi5ee",
+	}
+	for name, info := range tests {
+		tf, err := NewTorrentFile(strings.NewReader("d8:announce3:url4:info" + info + "7:comment2:hie"))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if have := sha1.Sum([]byte(info)); tf.InfoHash != have {
+			t.Errorf("%s: unexpected infohash, have: %x, want: %x", name, tf.InfoHash, have)
+		}
+		if string(tf.Info) != info {
+			t.Errorf("%s: expected info %q, got %q", name, info, tf.Info)
+		}
+		if tf.Name != "a" || tf.Length != 3 || tf.PieceLength != 5 {
+			t.Errorf("%s: unexpected torrent %+v", name, tf)
+		}
+	}
+}
+
+func TestMultiFile(t *testing.T) {
+	p1 := sha1.Sum([]byte("piece1"))
+	p2 := sha1.Sum([]byte("piece2"))
+	info := "d5:filesld6:lengthi3e4:pathl1:aee" + "d6:lengthi7e4:pathl3:sub1:beee" +
+		"4:name3:dir12:piece lengthi5e6:pieces40:" + string(p1[:]) + string(p2[:]) + "e"
+	tf, err := NewTorrentFile(strings.NewReader("d8:announce3:url4:info" + info + "e"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if have := sha1.Sum([]byte(info)); tf.InfoHash != have {
+		t.Errorf("unexpected infohash, have: %x, want: %x", tf.InfoHash, have)
+	}
+	if tf.Length != 10 {
+		t.Errorf("expected total length of 10, got %d", tf.Length)
+	}
+	want := []File{
+		{Path: filepath.Join("dir", "a"), Length: 3, Offset: 0},
+		{Path: filepath.Join("dir", "sub", "b"), Length: 7, Offset: 3},
+	}
+	if !reflect.DeepEqual(tf.Files, want) {
+		t.Errorf("expected files %+v, got %+v", want, tf.Files)
+	}
+}
+
+// TestPieceCountMismatch checks a torrent whose piece hashes don't cover its data is rejected, as
+// pieces past the end of the hashes could never be verified
+func TestPieceCountMismatch(t *testing.T) {
+	tests := map[string]string{
+		"too few":  "d6:lengthi11e4:name1:a12:piece lengthi5e" + onePiece + "e",
+		"too many": "d6:lengthi3e4:name1:a12:piece lengthi5e6:pieces40:" + strings.Repeat("h", 40) + "e",
+		"none":     "d6:lengthi3e4:name1:a12:piece lengthi5e6:pieces0:e",
+	}
+	for name, info := range tests {
+		if _, err := NewTorrentFile(strings.NewReader("d8:announce3:url4:info" + info + "e")); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPathTraversalRejected(t *testing.T) {
+	info := "d5:filesld6:lengthi3e4:pathl2:..1:aeee4:name3:dir12:piece lengthi5e6:pieces0:e"
+	_, err := NewTorrentFile(strings.NewReader("d8:announce3:url4:info" + info + "e"))
+	if err == nil {
+		t.Errorf("expected an error for a path containing '..'")
+	}
+}
+
+func TestURLList(t *testing.T) {
+	info := "d6:lengthi3e4:name1:a12:piece lengthi5e" + onePiece + "e"
+	tests := []struct {
+		urlList string
+		want    []string
+	}{
+		{"", nil},
+		{"8:url-list14:http://a/file1", []string{"http://a/file1"}},
+		{"8:url-listl9:http://a/9:http://b/e", []string{"http://a/", "http://b/"}},
+	}
+	for _, tt := range tests {
+		tf, err := NewTorrentFile(strings.NewReader("d8:announce3:url4:info" + info + tt.urlList + "e"))
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", tt.urlList, err)
+		}
+		if !reflect.DeepEqual(tf.URLList, tt.want) {
+			t.Errorf("expected url list %q for %q, got %q", tt.want, tt.urlList, tf.URLList)
+		}
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	tests := []struct {
+		private string
+		want    bool
+	}{
+		{"", false},
+		{"7:privatei0e", false},
+		{"7:privatei1e", true},
+	}
+	for _, tt := range tests {
+		info := "d6:lengthi3e4:name1:a12:piece lengthi5e" + onePiece + tt.private + "e"
+		tf, err := NewTorrentFile(strings.NewReader("d8:announce3:url4:info" + info + "e"))
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", tt.private, err)
+		}
+		if tf.Private != tt.want {
+			t.Errorf("expected private %v for %q, got %v", tt.want, tt.private, tf.Private)
+		}
+		if have := sha1.Sum([]byte(info)); tf.InfoHash != have {
+			t.Errorf("unexpected infohash for %q, have: %x, want: %x", tt.private, tf.InfoHash, have)
+		}
+	}
+}
+
+func TestFromInfo(t *testing.T) {
+	// keys we don't know about still count towards the info hash
+	info := "d6:lengthi3e4:name1:a12:piece lengthi5e" + onePiece + "6:source3:xyze"
+	tf, err := FromInfo([]byte(info), "http://tracker/announce")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := sha1.Sum([]byte(info)); tf.InfoHash != want {
+		t.Errorf("expected info hash %x, got %x", want, tf.InfoHash)
+	}
+	if string(tf.Info) != info || tf.Announce != "http://tracker/announce" || tf.Name != "a" || tf.Length != 3 {
+		t.Errorf("unexpected torrent %+v", tf)
+	}
+	for _, bad := range []string{"d6:lengthi3ee", "d4:name1:a12:piece lengthi0ee", "d4:name1:a12:piece lengthi5e6:pieces1:xe", "le"} {
+		if _, err := FromInfo([]byte(bad), ""); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
 	}
 }
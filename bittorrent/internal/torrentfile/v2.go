@@ -0,0 +1,192 @@
+package torrentfile
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"go-bt-learning.brk3.github.io/internal/merkle"
+)
+
+// V2Piece is what's needed to check a piece of a v2 torrent against its file's merkle tree
+type V2Piece struct {
+	Hash   [32]byte // root of the piece's subtree, which is the pieces root for files of one piece
+	Length int      // bytes of file data in the piece, anything after is padding
+	Leaves int      // how many leaves the piece's subtree is padded out to
+}
+
+// Verify reports whether piece, which may include trailing padding, matches the hash
+func (p V2Piece) Verify(piece []byte) bool {
+	if len(piece) < p.Length {
+		return false
+	}
+	return merkle.Root(merkle.Leaves(piece[:p.Length]), p.Leaves, [32]byte{}) == p.Hash
+}
+
+// v2File is a file found in a v2 file tree
+type v2File struct {
+	path       []string
+	length     int
+	piecesRoot [32]byte
+}
+
+// loadV2 fills in the v2 parts of a torrent (BEP 52). Hybrid torrents already have their files laid
+// out from the v1 file list, which must agree with the file tree. v2 only torrents are laid out here,
+// with padding so every file starts on a piece boundary as it does in hybrid torrents.
+func (t *TorrentFile) loadV2(b bencodeTorrent) error {
+	pl := t.PieceLength
+	if pl < merkle.BlockSize || pl != merkle.NextPow2(pl) {
+		return fmt.Errorf("v2 piece length %d isn't a power of two of at least %d", pl, merkle.BlockSize)
+	}
+	files, err := walkFileTree(b.Info.FileTree, nil)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("v2 torrent has no files")
+	}
+	t.MetaVersion = 2
+	t.InfoHashV2 = sha256.Sum256(b.Info.raw)
+	single := len(files) == 1 && len(files[0].path) == 1 && files[0].path[0] == t.Name
+	pathOf := func(f v2File) string {
+		if single {
+			return t.Name
+		}
+		return filepath.Join(append([]string{t.Name}, f.path...)...)
+	}
+
+	if len(t.PieceHashes) > 0 {
+		i := 0
+		for index := range t.Files {
+			f := &t.Files[index]
+			if f.Padding {
+				continue
+			}
+			if i == len(files) || pathOf(files[i]) != f.Path || files[i].length != f.Length {
+				return fmt.Errorf("hybrid torrent's file list doesn't match its file tree at %s", f.Path)
+			}
+			f.PiecesRoot = files[i].piecesRoot
+			i++
+		}
+		if i != len(files) {
+			return fmt.Errorf("hybrid torrent's file tree has %d files missing from its file list", len(files)-i)
+		}
+	} else {
+		copy(t.InfoHash[:], t.InfoHashV2[:])
+		t.Files = nil
+		offset := 0
+		for _, f := range files {
+			if gap := offset % pl; gap != 0 && f.length > 0 {
+				pad := pl - gap
+				t.Files = append(t.Files, File{
+					Path:    filepath.Join(t.Name, ".pad", strconv.Itoa(pad)),
+					Length:  pad,
+					Offset:  offset,
+					Padding: true,
+				})
+				offset += pad
+			}
+			t.Files = append(t.Files, File{Path: pathOf(f), Length: f.length, Offset: offset, PiecesRoot: f.piecesRoot})
+			offset += f.length
+		}
+		t.Length = offset
+	}
+	return t.loadPieceLayers(b.PieceLayers)
+}
+
+// loadPieceLayers works out the hash of every piece, checking each file's piece layer against its
+// pieces root
+func (t *TorrentFile) loadPieceLayers(layers map[string]any) error {
+	pl := t.PieceLength
+	t.PiecesV2 = make([]V2Piece, (t.Length+pl-1)/pl)
+	padLeaves := pl / merkle.BlockSize
+	for _, f := range t.Files {
+		if f.Padding || f.Length == 0 {
+			continue
+		}
+		if f.Offset%pl != 0 {
+			return fmt.Errorf("file %s doesn't start on a piece boundary", f.Path)
+		}
+		first, n := f.Offset/pl, (f.Length+pl-1)/pl
+		if n == 1 {
+			blocks := (f.Length + merkle.BlockSize - 1) / merkle.BlockSize
+			t.PiecesV2[first] = V2Piece{Hash: f.PiecesRoot, Length: f.Length, Leaves: merkle.NextPow2(blocks)}
+			continue
+		}
+		layer, ok := layers[string(f.PiecesRoot[:])].(string)
+		if !ok || len(layer) != 32*n {
+			return fmt.Errorf("missing or invalid piece layer for %s", f.Path)
+		}
+		hashes := make([][32]byte, n)
+		for i := range hashes {
+			copy(hashes[i][:], layer[32*i:])
+		}
+		if merkle.Root(hashes, merkle.NextPow2(n), merkle.PadHash(padLeaves)) != f.PiecesRoot {
+			return fmt.Errorf("piece layer for %s doesn't match its pieces root", f.Path)
+		}
+		for i, h := range hashes {
+			length := pl
+			if i == n-1 {
+				length = f.Length - i*pl
+			}
+			t.PiecesV2[first+i] = V2Piece{Hash: h, Length: length, Leaves: padLeaves}
+		}
+	}
+	return nil
+}
+
+// walkFileTree lists the files in a v2 file tree in order. Each file is a dictionary under the
+// empty key, holding its length and pieces root.
+func walkFileTree(tree map[string]any, path []string) ([]v2File, error) {
+	keys := make([]string, 0, len(tree))
+	for k := range tree {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	files := []v2File{}
+	for _, k := range keys {
+		node, ok := tree[k].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("file tree entry %q is a %T, not a dictionary", k, tree[k])
+		}
+		if k == "" {
+			if len(path) == 0 {
+				return nil, fmt.Errorf("file tree has a file with no name")
+			}
+			f := v2File{path: append([]string{}, path...)}
+			if f.length, ok = node["length"].(int); !ok || f.length < 0 {
+				return nil, fmt.Errorf("file %v has missing or invalid length", path)
+			}
+			root, _ := node["pieces root"].(string)
+			if f.length > 0 && len(root) != 32 {
+				return nil, fmt.Errorf("file %v has missing or invalid pieces root", path)
+			}
+			copy(f.piecesRoot[:], root)
+			files = append(files, f)
+			continue
+		}
+		if err := checkPathPart(k); err != nil {
+			return nil, err
+		}
+		sub, err := walkFileTree(node, append(path, k))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// SwarmHashes returns the info hashes the torrent is shared under: just InfoHash, or for hybrid
+// torrents the truncated v2 hash as well
+func (t *TorrentFile) SwarmHashes() [][20]byte {
+	hashes := [][20]byte{t.InfoHash}
+	v2 := [20]byte{}
+	copy(v2[:], t.InfoHashV2[:])
+	if t.MetaVersion == 2 && v2 != t.InfoHash {
+		hashes = append(hashes, v2)
+	}
+	return hashes
+}
@@ -0,0 +1,243 @@
+package torrentfile
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+	"go-bt-learning.brk3.github.io/internal/merkle"
+)
+
+type testFile struct {
+	path []string
+	data []byte
+}
+
+// makeV2 builds a v2 torrent of the files, and a hybrid one with a v1 file list and padding if
+// hybrid is set. It returns the torrent and the data laid out as the torrent's pieces.
+func makeV2(t *testing.T, files []testFile, pieceLength int, hybrid bool) ([]byte, []byte) {
+	t.Helper()
+	tree := map[string]any{}
+	layers := map[string]any{}
+	v1Files := []any{}
+	data := []byte{}
+	for _, f := range files {
+		if gap := len(data) % pieceLength; gap != 0 && len(f.data) > 0 {
+			pad := pieceLength - gap
+			data = append(data, make([]byte, pad)...)
+			v1Files = append(v1Files, map[string]any{"attr": "p", "length": pad, "path": []any{".pad", "x"}})
+		}
+		data = append(data, f.data...)
+		path := []any{}
+		for _, p := range f.path {
+			path = append(path, p)
+		}
+		v1Files = append(v1Files, map[string]any{"length": len(f.data), "path": path})
+
+		padLeaves := pieceLength / merkle.BlockSize
+		pieces := [][32]byte{}
+		for i := 0; i < len(f.data); i += pieceLength {
+			end := i + pieceLength
+			if end > len(f.data) {
+				end = len(f.data)
+			}
+			pieces = append(pieces, merkle.Root(merkle.Leaves(f.data[i:end]), padLeaves, [32]byte{}))
+		}
+		var root [32]byte
+		if len(pieces) == 1 {
+			leaves := merkle.Leaves(f.data)
+			root = merkle.Root(leaves, merkle.NextPow2(len(leaves)), [32]byte{})
+		} else {
+			root = merkle.Root(pieces, merkle.NextPow2(len(pieces)), merkle.PadHash(padLeaves))
+			layer := []byte{}
+			for _, p := range pieces {
+				layer = append(layer, p[:]...)
+			}
+			layers[string(root[:])] = string(layer)
+		}
+		node := tree
+		for _, p := range f.path {
+			if _, ok := node[p]; !ok {
+				node[p] = map[string]any{}
+			}
+			node = node[p].(map[string]any)
+		}
+		node[""] = map[string]any{"length": len(f.data), "pieces root": string(root[:])}
+	}
+	info := map[string]any{
+		"file tree":    tree,
+		"meta version": 2,
+		"name":         "dir",
+		"piece length": pieceLength,
+	}
+	if hybrid {
+		pieces := ""
+		for i := 0; i < len(data); i += pieceLength {
+			end := i + pieceLength
+			if end > len(data) {
+				end = len(data)
+			}
+			h := sha1.Sum(data[i:end])
+			pieces += string(h[:])
+		}
+		info["files"] = v1Files
+		info["pieces"] = pieces
+	}
+	b, err := bencodecustom.Marshal(map[string]any{
+		"announce":     "http://tracker/announce",
+		"info":         info,
+		"piece layers": layers,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, data
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+func TestV2(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	pl := 2 * merkle.BlockSize
+	files := []testFile{
+		{[]string{"a"}, randomBytes(r, 3*pl+100)},
+		{[]string{"sub", "b"}, randomBytes(r, merkle.BlockSize+5)},
+		{[]string{"sub", "c"}, nil},
+	}
+	b, data := makeV2(t, files, pl, false)
+	tf, err := NewTorrentFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error loading v2 torrent: %v", err)
+	}
+	if tf.MetaVersion != 2 || len(tf.PieceHashes) != 0 {
+		t.Errorf("expected a v2 only torrent, got meta version %d with %d v1 hashes", tf.MetaVersion, len(tf.PieceHashes))
+	}
+	raw, _ := bencodecustom.Parse(bufio.NewReader(bytes.NewReader(b)))
+	info, _ := bencodecustom.Marshal(raw.(map[string]any)["info"])
+	if want := sha256.Sum256(info); tf.InfoHashV2 != want || !bytes.Equal(tf.InfoHash[:], want[:20]) {
+		t.Errorf("expected info hash %x, got %x and %x", want, tf.InfoHashV2, tf.InfoHash)
+	}
+	if len(tf.SwarmHashes()) != 1 {
+		t.Errorf("expected a v2 only torrent to be in one swarm, got %d", len(tf.SwarmHashes()))
+	}
+	if tf.Length != len(data) || tf.NumPieces() != 5 {
+		t.Errorf("expected %d bytes in 5 pieces, got %d in %d", len(data), tf.Length, tf.NumPieces())
+	}
+	paths := []string{}
+	for _, f := range tf.Files {
+		paths = append(paths, f.Path)
+		if f.Padding && f.Length != pl-100 {
+			t.Errorf("expected padding of %d, got %d", pl-100, f.Length)
+		}
+	}
+	want := []string{"dir/a", "dir/.pad/32668", "dir/sub/b", "dir/sub/c"}
+	if strings.Join(paths, ",") != filepath.FromSlash(strings.Join(want, ",")) {
+		t.Errorf("expected files %v, got %v", want, paths)
+	}
+	for i, p := range tf.PiecesV2 {
+		end := (i + 1) * pl
+		if end > len(data) {
+			end = len(data)
+		}
+		piece := append([]byte{}, data[i*pl:end]...)
+		if !p.Verify(piece) {
+			t.Errorf("piece %d failed to verify", i)
+		}
+		piece[0] ^= 1
+		if p.Verify(piece) {
+			t.Errorf("corrupt piece %d verified", i)
+		}
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	pl := merkle.BlockSize
+	files := []testFile{
+		{[]string{"a"}, randomBytes(r, 2*pl+10)},
+		{[]string{"b"}, randomBytes(r, 10)},
+	}
+	b, data := makeV2(t, files, pl, true)
+	tf, err := NewTorrentFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("unexpected error loading hybrid torrent: %v", err)
+	}
+	raw, _ := bencodecustom.Parse(bufio.NewReader(bytes.NewReader(b)))
+	info, _ := bencodecustom.Marshal(raw.(map[string]any)["info"])
+	if want := sha1.Sum(info); tf.InfoHash != want {
+		t.Errorf("expected v1 info hash %x, got %x", want, tf.InfoHash)
+	}
+	if hashes := tf.SwarmHashes(); len(hashes) != 2 || !bytes.Equal(hashes[1][:], tf.InfoHashV2[:20]) {
+		t.Errorf("expected the v1 and truncated v2 swarms, got %x", hashes)
+	}
+	if tf.Length != len(data) || len(tf.PieceHashes) != 4 || len(tf.PiecesV2) != 4 {
+		t.Errorf("expected %d bytes in 4 pieces, got %d with %d v1 and %d v2 hashes",
+			len(data), tf.Length, len(tf.PieceHashes), len(tf.PiecesV2))
+	}
+	if !tf.Files[1].Padding || tf.Files[0].PiecesRoot == ([32]byte{}) {
+		t.Errorf("expected a padding file after a file with a pieces root, got %+v", tf.Files)
+	}
+}
+
+// TestHybridPieceCountMismatch checks a hybrid torrent missing one of its v1 piece hashes is
+// rejected, rather than having more v2 pieces than v1 ones
+func TestHybridPieceCountMismatch(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	pl := merkle.BlockSize
+	b, _ := makeV2(t, []testFile{{[]string{"a"}, randomBytes(r, 3*pl)}}, pl, true)
+	raw, _ := bencodecustom.Parse(bufio.NewReader(bytes.NewReader(b)))
+	info := raw.(map[string]any)["info"].(map[string]any)
+	info["pieces"] = info["pieces"].(string)[20:]
+	b, err := bencodecustom.Marshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewTorrentFile(bytes.NewReader(b)); err == nil {
+		t.Errorf("expected an error for a hybrid torrent with too few v1 piece hashes")
+	}
+}
+
+func TestV2BadPieceLayer(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	b, _ := makeV2(t, []testFile{{[]string{"a"}, randomBytes(r, 3*merkle.BlockSize)}}, merkle.BlockSize, false)
+	// flip a bit in the piece layer, which is the last string in the torrent
+	i := bytes.LastIndex(b, []byte("96:")) + 3
+	b[i] ^= 1
+	if _, err := NewTorrentFile(bytes.NewReader(b)); err == nil || !strings.Contains(err.Error(), "pieces root") {
+		t.Errorf("expected a piece layer mismatch, got %v", err)
+	}
+}
+
+// TestV2RawInfo checks v2 info hashes are taken over the info dict as it's encoded, rather than
+// as we'd encode it
+func TestV2RawInfo(t *testing.T) {
+	r := rand.New(rand.NewSource(4))
+	b, _ := makeV2(t, []testFile{{[]string{"a"}, randomBytes(r, 3*merkle.BlockSize)}}, merkle.BlockSize, false)
+	raw, _ := bencodecustom.Parse(bufio.NewReader(bytes.NewReader(b)))
+	canonical, _ := bencodecustom.Marshal(raw.(map[string]any)["info"])
+	layers, _ := bencodecustom.Marshal(raw.(map[string]any)["piece layers"])
+	// an unknown key, out of order
+	info := append([]byte("d6:source3:PTP"), canonical[1:]...)
+	torrent := append(append([]byte("d4:info"), info...), "12:piece layers"...)
+	torrent = append(append(torrent, layers...), 'e')
+	tf, err := NewTorrentFile(bytes.NewReader(torrent))
+	if err != nil {
+		t.Fatalf("unexpected error loading v2 torrent: %v", err)
+	}
+	if want := sha256.Sum256(info); tf.InfoHashV2 != want {
+		t.Errorf("expected info hash %x, got %x", want, tf.InfoHashV2)
+	}
+	if !bytes.Equal(tf.Info, info) {
+		t.Errorf("expected info %q, got %q", info, tf.Info)
+	}
+}
@@ -0,0 +1,315 @@
+// Package tracker is a BitTorrent HTTP tracker, for running swarms without any public
+// infrastructure
+package tracker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+)
+
+const (
+	// DefaultInterval is how often peers are asked to announce
+	DefaultInterval = 30 * time.Minute
+
+	// DefaultNumWant is how many peers an announce gets if it doesn't ask for a number
+	DefaultNumWant = 50
+
+	// MaxNumWant caps how many peers a single announce can get
+	MaxNumWant = 200
+)
+
+// Server keeps track of who's in each torrent's swarm. Peers that stop announcing are forgotten
+// after PeerTTL, and swarms once they have no peers left.
+type Server struct {
+	Interval time.Duration
+	PeerTTL  time.Duration
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	lastSweep time.Time        // when every swarm was last checked for expired peers
+	now       func() time.Time // replaced in tests
+}
+
+type swarm struct {
+	peers      map[[20]byte]*peer // keyed by peer id
+	downloaded int                // completed events seen
+}
+
+type peer struct {
+	id       [20]byte
+	ip       net.IP
+	port     uint16
+	seeding  bool
+	lastSeen time.Time
+}
+
+// NewServer returns a tracker telling peers to announce every interval
+func NewServer(interval time.Duration) *Server {
+	return &Server{
+		Interval: interval,
+		PeerTTL:  2 * interval,
+		swarms:   map[[20]byte]*swarm{},
+		now:      time.Now,
+	}
+}
+
+// Handler returns the tracker's endpoints:
+//
+//	GET /announce  add or update a peer and get others in the same swarm
+//	GET /scrape    swarm sizes for the given info_hash parameters, or every torrent if there are none
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/announce", s.handleAnnounce)
+	mux.HandleFunc("/scrape", s.handleScrape)
+	return mux
+}
+
+// announceRequest holds the parameters of an announce we care about
+type announceRequest struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	ip       net.IP
+	port     uint16
+	event    string
+	left     int
+	compact  bool
+	numWant  int
+}
+
+func parseAnnounce(r *http.Request) (announceRequest, error) {
+	q := r.URL.Query()
+	req := announceRequest{}
+	infoHash, peerID := q.Get("info_hash"), q.Get("peer_id")
+	if len(infoHash) != 20 {
+		return req, fmt.Errorf("invalid info_hash")
+	}
+	if len(peerID) != 20 {
+		return req, fmt.Errorf("invalid peer_id")
+	}
+	copy(req.infoHash[:], infoHash)
+	copy(req.peerID[:], peerID)
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return req, fmt.Errorf("invalid port")
+	}
+	req.port = uint16(port)
+	req.left, err = strconv.Atoi(q.Get("left"))
+	if err != nil || req.left < 0 {
+		return req, fmt.Errorf("invalid left")
+	}
+	req.event = q.Get("event")
+	switch req.event {
+	case "", "started", "stopped", "completed":
+	default:
+		return req, fmt.Errorf("invalid event %q", req.event)
+	}
+	req.compact = q.Get("compact") != "0"
+	req.numWant = DefaultNumWant
+	if n := q.Get("numwant"); n != "" {
+		req.numWant, err = strconv.Atoi(n)
+		if err != nil || req.numWant < 0 {
+			return req, fmt.Errorf("invalid numwant")
+		}
+		if req.numWant > MaxNumWant {
+			req.numWant = MaxNumWant
+		}
+	}
+	// trusting an ip parameter would let anyone point the swarm at someone else, so the peer is
+	// always where the request came from
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return req, err
+	}
+	req.ip = net.ParseIP(host)
+	if req.ip == nil {
+		return req, fmt.Errorf("invalid remote address %s", r.RemoteAddr)
+	}
+	if ip4 := req.ip.To4(); ip4 != nil {
+		req.ip = ip4
+	}
+	return req, nil
+}
+
+func (s *Server) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	req, err := parseAnnounce(r)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	sw := s.swarm(req.infoHash, now)
+	if req.event == "stopped" {
+		// only the peer itself gets to take it out of the swarm, not anyone who knows its id
+		if p, ok := sw.peers[req.peerID]; ok && p.ip.Equal(req.ip) {
+			delete(sw.peers, req.peerID)
+		}
+		writeResponse(w, s.announceResponse(sw, ""))
+		s.prune(req.infoHash, sw)
+		return
+	}
+	if req.event == "completed" {
+		sw.downloaded++
+	}
+	sw.peers[req.peerID] = &peer{id: req.peerID, ip: req.ip, port: req.port, seeding: req.left == 0, lastSeen: now}
+
+	others := []*peer{}
+	for _, p := range sw.peers {
+		if p.id != req.peerID && !(req.left == 0 && p.seeding) { // seeders have no use for each other
+			others = append(others, p)
+		}
+	}
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+	if len(others) > req.numWant {
+		others = others[:req.numWant]
+	}
+	if !req.compact {
+		list := []any{}
+		for _, p := range others {
+			list = append(list, map[string]any{
+				"ip":      p.ip.String(),
+				"peer id": string(p.id[:]),
+				"port":    int(p.port),
+			})
+		}
+		writeResponse(w, s.announceResponse(sw, list))
+		return
+	}
+	// IPv4 peers go in peers, IPv6 in peers6 (BEP 7)
+	peers4, peers6 := []byte{}, []byte{}
+	for _, p := range others {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, p.port)
+		if ip4 := p.ip.To4(); ip4 != nil {
+			peers4 = append(append(peers4, ip4...), port...)
+		} else {
+			peers6 = append(append(peers6, p.ip.To16()...), port...)
+		}
+	}
+	res := s.announceResponse(sw, string(peers4))
+	if len(peers6) > 0 {
+		res["peers6"] = string(peers6)
+	}
+	writeResponse(w, res)
+}
+
+// announceResponse builds the reply to an announce, with the swarm's size and the given peers.
+// Must be called with s.mu held.
+func (s *Server) announceResponse(sw *swarm, peers any) map[string]any {
+	seeders, leechers := sw.counts()
+	return map[string]any{
+		"complete":   seeders,
+		"incomplete": leechers,
+		"interval":   int(s.Interval / time.Second),
+		"peers":      peers,
+	}
+}
+
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	infoHashes := [][20]byte{}
+	for _, h := range r.URL.Query()["info_hash"] {
+		if len(h) != 20 {
+			writeFailure(w, "invalid info_hash")
+			return
+		}
+		infoHash := [20]byte{}
+		copy(infoHash[:], h)
+		infoHashes = append(infoHashes, infoHash)
+	}
+	if len(infoHashes) == 0 {
+		for h := range s.swarms {
+			infoHashes = append(infoHashes, h)
+		}
+	}
+	files := map[string]any{}
+	for _, h := range infoHashes {
+		sw, ok := s.swarms[h]
+		if !ok {
+			continue
+		}
+		sw.expire(now, s.PeerTTL)
+		if s.prune(h, sw) {
+			continue
+		}
+		seeders, leechers := sw.counts()
+		files[string(h[:])] = map[string]any{
+			"complete":   seeders,
+			"downloaded": sw.downloaded,
+			"incomplete": leechers,
+		}
+	}
+	writeResponse(w, map[string]any{"files": files})
+}
+
+// swarm returns the info hash's swarm, creating it if it's new and forgetting peers that have
+// expired. Every PeerTTL the other swarms are checked too, so swarms nobody announces to any more
+// are dropped. Must be called with s.mu held.
+func (s *Server) swarm(infoHash [20]byte, now time.Time) *swarm {
+	if now.Sub(s.lastSweep) > s.PeerTTL {
+		for h, sw := range s.swarms {
+			sw.expire(now, s.PeerTTL)
+			s.prune(h, sw)
+		}
+		s.lastSweep = now
+	}
+	sw, ok := s.swarms[infoHash]
+	if !ok {
+		sw = &swarm{peers: map[[20]byte]*peer{}}
+		s.swarms[infoHash] = sw
+	}
+	sw.expire(now, s.PeerTTL)
+	return sw
+}
+
+// prune drops the swarm if it has no peers left, returning true if it did. Must be called with
+// s.mu held.
+func (s *Server) prune(infoHash [20]byte, sw *swarm) bool {
+	if len(sw.peers) > 0 {
+		return false
+	}
+	delete(s.swarms, infoHash)
+	return true
+}
+
+// expire forgets peers we haven't heard from in ttl
+func (sw *swarm) expire(now time.Time, ttl time.Duration) {
+	for id, p := range sw.peers {
+		if now.Sub(p.lastSeen) > ttl {
+			delete(sw.peers, id)
+		}
+	}
+}
+
+func (sw *swarm) counts() (seeders, leechers int) {
+	for _, p := range sw.peers {
+		if p.seeding {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+	return seeders, leechers
+}
+
+// writeResponse bencodes a reply to the client
+func writeResponse(w http.ResponseWriter, res map[string]any) {
+	bencodecustom.NewEncoder(w).Encode(res)
+}
+
+// writeFailure tells the client its request failed. Trackers reply 200 with a failure reason so
+// clients show the reason rather than a bare status code.
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeResponse(w, map[string]any{"failure reason": reason})
+}
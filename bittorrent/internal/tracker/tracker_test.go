@@ -0,0 +1,183 @@
+package tracker
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"go-bt-learning.brk3.github.io/internal/bencodecustom"
+)
+
+var infoHash = sha1.Sum([]byte("torrent"))
+
+// announce sends an announce for the peer listening on port and returns the decoded response
+func announce(t *testing.T, srv *httptest.Server, port int, params url.Values) map[string]any {
+	t.Helper()
+	q := url.Values{
+		"info_hash": {string(infoHash[:])},
+		"peer_id":   {"peer-id-" + strconv.Itoa(100000000000+port)},
+		"port":      {strconv.Itoa(port)},
+		"left":      {"100"},
+	}
+	for k, v := range params {
+		q[k] = v
+	}
+	return get(t, srv.URL+"/announce?"+q.Encode())
+}
+
+func get(t *testing.T, u string) map[string]any {
+	t.Helper()
+	res, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("unexpected error requesting %s: %v", u, err)
+	}
+	defer res.Body.Close()
+	val, err := bencodecustom.Parse(bufio.NewReader(res.Body))
+	if err != nil {
+		t.Fatalf("error decoding response: %v", err)
+	}
+	return val.(map[string]any)
+}
+
+func TestAnnounce(t *testing.T) {
+	s := NewServer(time.Minute)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	announce(t, srv, 1001, url.Values{"event": {"started"}, "left": {"0"}})
+	announce(t, srv, 1002, url.Values{"event": {"started"}})
+	res := announce(t, srv, 1003, url.Values{"event": {"started"}})
+	if res["interval"] != 60 || res["complete"] != 1 || res["incomplete"] != 2 {
+		t.Errorf("unexpected announce response %v", res)
+	}
+	if peers := res["peers"].(string); len(peers) != 12 {
+		t.Errorf("expected 2 compact peers, got %d bytes", len(peers))
+	}
+
+	res = announce(t, srv, 1003, url.Values{"compact": {"0"}, "numwant": {"1"}})
+	peers := res["peers"].([]any)
+	if len(peers) != 1 {
+		t.Fatalf("expected 1 peer with numwant=1, got %v", peers)
+	}
+	p := peers[0].(map[string]any)
+	if p["ip"] != "127.0.0.1" || (p["port"] != 1001 && p["port"] != 1002) {
+		t.Errorf("unexpected peer %v", p)
+	}
+
+	// seeders aren't given other seeders
+	res = announce(t, srv, 1001, url.Values{"left": {"0"}})
+	if peers := res["peers"].(string); len(peers) != 12 {
+		t.Errorf("expected the seeder to get the 2 leechers, got %d bytes", len(peers))
+	}
+
+	announce(t, srv, 1002, url.Values{"event": {"stopped"}})
+	res = announce(t, srv, 1003, url.Values{"event": {"completed"}, "left": {"0"}})
+	if res["complete"] != 2 || res["incomplete"] != 0 {
+		t.Errorf("unexpected counts after stop and complete %v", res)
+	}
+
+	if res := get(t, srv.URL+"/announce?info_hash=short"); res["failure reason"] == nil {
+		t.Errorf("expected a failure reason for a bad request, got %v", res)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := NewServer(time.Minute)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	announce(t, srv, 1001, nil)
+	now = now.Add(s.PeerTTL / 2)
+	announce(t, srv, 1002, nil)
+	now = now.Add(s.PeerTTL/2 + time.Second)
+	res := announce(t, srv, 1003, nil)
+	if res["incomplete"] != 2 {
+		t.Errorf("expected the first peer to have expired, got %v", res)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	s := NewServer(time.Minute)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	announce(t, srv, 1001, url.Values{"left": {"0"}, "event": {"completed"}})
+	announce(t, srv, 1002, nil)
+
+	unknown := sha1.Sum([]byte("unknown"))
+	q := url.Values{"info_hash": {string(infoHash[:]), string(unknown[:])}}
+	res := get(t, srv.URL+"/scrape?"+q.Encode())
+	files := res["files"].(map[string]any)
+	if len(files) != 1 {
+		t.Fatalf("expected stats for 1 torrent, got %v", files)
+	}
+	stats := files[string(infoHash[:])].(map[string]any)
+	if stats["complete"] != 1 || stats["incomplete"] != 1 || stats["downloaded"] != 1 {
+		t.Errorf("unexpected scrape stats %v", stats)
+	}
+	if res := get(t, srv.URL+"/scrape"); len(res["files"].(map[string]any)) != 1 {
+		t.Errorf("expected a scrape without info hashes to cover every torrent, got %v", res)
+	}
+}
+
+// TestStoppedFromOtherIP checks a stopped event only removes a peer when it comes from the peer's
+// own address, so knowing a peer's id isn't enough to take it out of the swarm
+func TestStoppedFromOtherIP(t *testing.T) {
+	s := NewServer(time.Minute)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+	announce(t, srv, 1001, nil)
+
+	q := url.Values{
+		"info_hash": {string(infoHash[:])},
+		"peer_id":   {"peer-id-" + strconv.Itoa(100000000000+1001)},
+		"port":      {"1001"},
+		"left":      {"100"},
+		"event":     {"stopped"},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/announce?"+q.Encode(), nil)
+	req.RemoteAddr = "10.0.0.9:1234"
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+	if res := announce(t, srv, 1002, nil); res["incomplete"] != 2 {
+		t.Errorf("expected the peer to stay after a stop from another address, got %v", res)
+	}
+
+	announce(t, srv, 1001, url.Values{"event": {"stopped"}})
+	if res := announce(t, srv, 1002, nil); res["incomplete"] != 1 {
+		t.Errorf("expected the peer to be removed by its own stop, got %v", res)
+	}
+}
+
+// TestEmptySwarmsDropped checks swarms are forgotten once their last peer stops or expires
+func TestEmptySwarmsDropped(t *testing.T) {
+	s := NewServer(time.Minute)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	announce(t, srv, 1001, nil)
+	announce(t, srv, 1001, url.Values{"event": {"stopped"}})
+	if len(s.swarms) != 0 {
+		t.Errorf("expected the swarm to be dropped when its last peer stopped, got %d swarms", len(s.swarms))
+	}
+
+	announce(t, srv, 1001, nil)
+	now = now.Add(s.PeerTTL + time.Second)
+	other := sha1.Sum([]byte("other torrent"))
+	q := url.Values{
+		"info_hash": {string(other[:])},
+		"peer_id":   {"peer-id-" + strconv.Itoa(100000000000+1002)},
+		"port":      {"1002"},
+		"left":      {"100"},
+	}
+	get(t, srv.URL+"/announce?"+q.Encode())
+	if _, ok := s.swarms[infoHash]; ok || len(s.swarms) != 1 {
+		t.Errorf("expected the expired swarm to be dropped, got %d swarms", len(s.swarms))
+	}
+}